@@ -1,6 +1,7 @@
 package filter
 
 import (
+	"fmt"
 	"regexp"
 )
 
@@ -15,17 +16,38 @@ const (
 	// ActionTypeBlock represents a domain, expression, or list that will be
 	// filtered
 	ActionTypeBlock
+
+	// ActionTypeDeny represents a domain, expression, or list that will be
+	// filtered, regardless if the domain or expression is set to be allowed
+	ActionTypeDeny
+
+	// ActionTypeOverride represents a domain or list that is answered with
+	// local records, regardless if the domain is set to be allowed or blocked
+	ActionTypeOverride
 )
 
 // String returns the action type
 func (a ActionType) String() string {
 	actions := map[ActionType]string{
-		ActionTypeAllow: "allow",
-		ActionTypeBlock: "block",
+		ActionTypeAllow:    "allow",
+		ActionTypeBlock:    "block",
+		ActionTypeDeny:     "deny",
+		ActionTypeOverride: "override",
 	}
 	return actions[a]
 }
 
+// verb returns the action as it describes a request, such as "blocked"
+func (a ActionType) verb() string {
+	verbs := map[ActionType]string{
+		ActionTypeAllow:    "allowed",
+		ActionTypeBlock:    "blocked",
+		ActionTypeDeny:     "denied",
+		ActionTypeOverride: "overridden",
+	}
+	return verbs[a]
+}
+
 // ActionList is list of URLs and the functions required to load them
 type ActionList map[string]ListLoader
 
@@ -37,13 +59,30 @@ type ActionConfig struct {
 	regex      map[string]*regexp.Regexp
 	wildcards  map[string]bool
 
-	domainLists   ActionList
-	hostsLists    ActionList
-	regexLists    ActionList
-	wildcardLists ActionList
+	// answers and wildcardAnswers are the records of domains and wildcards
+	answers         map[string]RespListed
+	wildcardAnswers map[string]RespListed
+
+	// priorities are the priorities of domains, wildcards, and expressions, as
+	// written
+	priorities map[ruleKey]int
+
+	// lists are keyed by the name of their type's ListParser
+	lists map[string]ActionList
+
+	// listOptions are the options of each list which apply to its rules
+	listOptions map[listKey]ListOptions
+
+	// fetched are the rules of the lists as last fetched
+	fetched *fetchedLists
 
 	FileLoader FileListLoader
 	HTTPLoader HTTPListLoader
+	AXFRLoader *AXFRListLoader
+
+	// fetchSlots limits the number of lists fetched concurrently. It may be
+	// shared between actions so that the limit applies to both.
+	fetchSlots chan struct{}
 }
 
 // DNSNameRegexp matches valid domain names.
@@ -60,16 +99,20 @@ var HostsRegexp = regexp.MustCompile(`\s+|\t+`)
 // NewActionConfig returns an action ready to accept configurations
 func NewActionConfig(action ActionType) ActionConfig {
 	return ActionConfig{
-		configType:    action,
-		domains:       make(map[string]bool),
-		regex:         make(map[string]*regexp.Regexp),
-		wildcards:     make(map[string]bool),
-		domainLists:   make(ActionList),
-		hostsLists:    make(ActionList),
-		regexLists:    make(ActionList),
-		wildcardLists: make(ActionList),
-		FileLoader:    FileListLoader{},
-		HTTPLoader:    HTTPListLoader{},
+		configType:      action,
+		domains:         make(map[string]bool),
+		regex:           make(map[string]*regexp.Regexp),
+		wildcards:       make(map[string]bool),
+		answers:         make(map[string]RespListed),
+		wildcardAnswers: make(map[string]RespListed),
+		priorities:      make(map[ruleKey]int),
+		lists:           make(map[string]ActionList),
+		listOptions:     make(map[listKey]ListOptions),
+		fetched:         newFetchedLists(),
+		FileLoader:      FileListLoader{},
+		HTTPLoader:      HTTPListLoader{Defaults: &HTTPOptions{}},
+		AXFRLoader:      NewAXFRListLoader(),
+		fetchSlots:      newFetchSlots(DefaultListWorkers),
 	}
 }
 
@@ -90,3 +133,99 @@ func (a ActionConfig) shouldSkip(line []byte) bool {
 	}
 	return false
 }
+
+// AddList of a type registered with RegisterListParser to match contents
+func (a ActionConfig) AddList(kind, url string, opts ListOptions) error {
+	if _, ok := getListParser(kind); !ok {
+		return fmt.Errorf("unknown list type %q", kind)
+	}
+	lists, ok := a.lists[kind]
+	if !ok {
+		lists = make(ActionList)
+		a.lists[kind] = lists
+	}
+	a.listOptions[listKey{kind, url}] = opts
+	return a.addList(lists, kind, url, opts)
+}
+
+// listKey identifies a list of an action
+type listKey struct {
+	kind string
+	url  string
+}
+
+// buildRules populates rules with the action's explicit entries and the rules
+// of its lists, fetching those selected by refresh. Rules of audited lists are
+// added to audit instead. Exception rules of lists are added to exceptions.
+//
+// Only rules which list an answer are used by overrides, and their exceptions
+// are ignored.
+func (a ActionConfig) buildRules(rules, audit, exceptions ruleSet, refresh listRefresh) {
+	for domain := range a.domains {
+		a.addExplicit(rules, Rule{Kind: RuleExact, Value: domain})
+	}
+	for expression, regex := range a.regex {
+		rules.regex[expression] = regex
+		rules.prioritize(Rule{Kind: RuleRegex, Value: expression}, a.priorities[ruleKey{RuleRegex, expression}])
+	}
+	for wildcard := range a.wildcards {
+		a.addExplicit(rules, Rule{Kind: RuleSuffix, Value: wildcard})
+	}
+	for kind, answers := range map[RuleKind]map[string]RespListed{
+		RuleExact:  a.answers,
+		RuleSuffix: a.wildcardAnswers,
+	} {
+		for domain, answer := range answers {
+			for _, addr := range answer.Addrs {
+				a.addExplicit(rules, Rule{Kind: kind, Value: domain, Address: addr})
+			}
+			if answer.Target != "" {
+				a.addExplicit(rules, Rule{Kind: kind, Value: domain, Target: answer.Target})
+			}
+		}
+	}
+
+	override := a.configType == ActionTypeOverride
+	for _, list := range a.fetchLists(refresh) {
+		opts := a.listOptions[listKey{list.kind, list.url}]
+		listed := opts.ListedAnswer
+		set := rules
+		if opts.Audit {
+			set = audit
+		}
+		for _, rule := range list.rules {
+			if override && (rule.Exception || !rule.listsAnswer()) {
+				continue
+			}
+			if rule.Exception {
+				// Exceptions of audited lists would only allow requests
+				if !opts.Audit {
+					exceptions.add(rule)
+					exceptions.prioritize(rule, opts.Priority)
+				}
+				continue
+			}
+			set.add(rule)
+			set.prioritize(rule, opts.Priority)
+			if override || listed && rule.listsAnswer() {
+				set.addAnswer(rule)
+			}
+		}
+	}
+}
+
+// addExplicit normalizes and adds an entry of the Corefile to rules, with its
+// priority. Entries are kept as written until the rules are built.
+func (a ActionConfig) addExplicit(rules ruleSet, rule Rule) {
+	priority := a.priorities[ruleKey{rule.Kind, rule.Value}]
+	rule, err := normalizeRule(rule)
+	if err != nil {
+		log.Warningf("skipping %s %s %q; %s", a.configType, rule.Kind, rule.Value, err)
+		return
+	}
+	rules.add(rule)
+	rules.prioritize(rule, priority)
+	if rule.listsAnswer() {
+		rules.addAnswer(rule)
+	}
+}
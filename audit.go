@@ -0,0 +1,52 @@
+package filter
+
+import (
+	"context"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/metrics"
+)
+
+func parseMode(c *caddy.Controller, f *Filter) error {
+	if !c.NextArg() {
+		return c.Err("no mode specified")
+	}
+	switch c.Val() {
+	case "audit":
+		f.audit = true
+	case "enforce":
+		f.audit = false
+	default:
+		return c.Errf("invalid mode %q; expected 'audit' or 'enforce'", c.Val())
+	}
+	return ensureEOL(c)
+}
+
+// evaluateAudit returns the rule of an audited list which would block or deny
+// a request that isn't otherwise blocked or denied. Audited rules are decided
+// against the allow rules as if they were enforced. The filter must be read
+// locked.
+func (f *Filter) evaluateAudit(qname string) (ruleMatch, bool) {
+	if f.auditBlockRules.size() == 0 && f.auditDenyRules.size() == 0 {
+		return ruleMatch{}, false
+	}
+	winner, matched := f.decide(qname, f.auditDenyRules, f.allowRules(), f.auditBlockRules)
+	return winner, matched && winner.action != ActionTypeAllow
+}
+
+// reportWouldBlock logs and counts a request which would have been blocked or
+// denied if it weren't audited
+func (f *Filter) reportWouldBlock(ctx context.Context, qname string, client clientInfo, winner ruleMatch) {
+	log.Infof(
+		"audit: request %q of client %s would be %s; matched %s",
+		qname,
+		client,
+		winner.action.verb(),
+		winner,
+	)
+	wouldBlockCount.WithLabelValues(
+		metrics.WithServer(ctx),
+		winner.action.String(),
+		winner.category,
+	).Inc()
+}
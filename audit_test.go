@@ -0,0 +1,224 @@
+package filter
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAudit(t *testing.T) {
+	aggressive := writeTestFile(t, "aggressive", []byte(
+		"tracker.example.com\n"+
+			"both.example.com\n"+
+			"allowed.example.com\n"+
+			"denied.example.net\n",
+	))
+	enforced := writeTestFile(t, "enforced", []byte(
+		"ads.example.com\n"+
+			"both.example.com\n",
+	))
+	tests := []struct {
+		name       string
+		corefile   string
+		qname      string
+		wantBlock  bool
+		wouldBlock string
+	}{
+		{
+			"audited list",
+			`filter {
+				block list domain file://` + aggressive + ` {
+					mode audit
+				}
+				block list domain file://` + enforced + `
+			}`,
+			"tracker.example.com.",
+			false,
+			"block",
+		},
+		{
+			"enforced list",
+			`filter {
+				block list domain file://` + aggressive + ` {
+					mode audit
+				}
+				block list domain file://` + enforced + `
+			}`,
+			"ads.example.com.",
+			true,
+			"",
+		},
+		{
+			"audited and enforced list",
+			`filter {
+				block list domain file://` + aggressive + ` {
+					mode audit
+				}
+				block list domain file://` + enforced + `
+			}`,
+			"both.example.com.",
+			true,
+			"",
+		},
+		{
+			"audited list allowed",
+			`filter {
+				allow domain allowed.example.com
+				block list domain file://` + aggressive + ` {
+					mode audit
+				}
+			}`,
+			"allowed.example.com.",
+			false,
+			"",
+		},
+		{
+			"audited deny list",
+			`filter {
+				allow wildcard example.net
+				deny list domain file://` + aggressive + ` {
+					mode audit
+				}
+			}`,
+			"denied.example.net.",
+			false,
+			"deny",
+		},
+		{
+			"global audit",
+			`filter {
+				mode audit
+				block domain ads.example.com
+			}`,
+			"ads.example.com.",
+			false,
+			"block",
+		},
+		{
+			"global audit deny",
+			`filter {
+				mode audit
+				deny domain ads.example.com
+			}`,
+			"ads.example.com.",
+			false,
+			"deny",
+		},
+		{
+			"global enforce",
+			`filter {
+				mode enforce
+				block domain ads.example.com
+			}`,
+			"ads.example.com.",
+			true,
+			"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := NewTestFilter(t, tt.corefile)
+			filter.Build()
+			before := map[string]float64{
+				"block": testutil.ToFloat64(wouldBlockCount.WithLabelValues("", "block", "")),
+				"deny":  testutil.ToFloat64(wouldBlockCount.WithLabelValues("", "deny", "")),
+			}
+			req := new(dns.Msg).SetQuestion(tt.qname, dns.TypeA)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			rcode, _ := filter.ServeDNS(context.Background(), rec, req)
+			// The next plugin of test filters fails every request
+			if blocked := rcode != dns.RcodeServerFailure; blocked != tt.wantBlock {
+				t.Errorf("expected blocked %t; got %t", tt.wantBlock, blocked)
+			}
+			for action, count := range before {
+				want := count
+				if action == tt.wouldBlock {
+					want++
+				}
+				got := testutil.ToFloat64(wouldBlockCount.WithLabelValues("", action, ""))
+				if got != want {
+					t.Errorf("expected %v would %s requests; got %v", want, action, got)
+				}
+			}
+		})
+	}
+}
+
+func TestSetupAudit(t *testing.T) {
+	tests := []TestSetup{
+		{
+			"mode audit",
+			`filter {
+				mode audit
+			}`,
+			false,
+		},
+		{
+			"mode enforce",
+			`filter {
+				mode enforce
+			}`,
+			false,
+		},
+		{
+			"mode missing",
+			`filter {
+				mode
+			}`,
+			true,
+		},
+		{
+			"mode invalid",
+			`filter {
+				mode dryrun
+			}`,
+			true,
+		},
+		{
+			"list mode audit",
+			`filter {
+				block list domain https://example.com/list.txt {
+					mode audit
+				}
+				deny list wildcard https://example.com/list.txt {
+					mode audit
+				}
+			}`,
+			false,
+		},
+		{
+			"list mode invalid",
+			`filter {
+				block list domain https://example.com/list.txt {
+					mode dryrun
+				}
+			}`,
+			true,
+		},
+		{
+			"allow list mode audit",
+			`filter {
+				allow list domain https://example.com/list.txt {
+					mode audit
+				}
+			}`,
+			true,
+		},
+		{
+			"override list mode audit",
+			`filter {
+				override list records https://example.com/records.txt {
+					mode audit
+				}
+			}`,
+			true,
+		},
+	}
+	for _, test := range tests {
+		RunSetupTest(t, test)
+	}
+}
@@ -0,0 +1,389 @@
+package filter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// AXFRListLoader retrieves Response Policy Zones (RPZ) using zone transfers.
+// The first load of a zone performs a full transfer (AXFR). Subsequent loads
+// request an incremental transfer (IXFR) from the last known serial, falling
+// back to a full transfer if the server refuses.
+//
+// Lists are addressed as axfr://SERVER[:PORT]/ZONE. Only QNAME triggers are
+// used; IP, NSDNAME, NSIP, and client IP triggers are ignored. Each trigger is
+// returned on its own line relative to the zone origin, with wildcard triggers
+// keeping their '*.' prefix. 'rpz-passthru.' actions are ignored, except by
+// the loader of rpz lists, which returns them as 'TRIGGER CNAME rpz-passthru.'.
+type AXFRListLoader struct {
+	// TsigName is the name of the TSIG key used to sign transfer requests.
+	// Transfers are not signed if empty.
+	TsigName string
+
+	// TsigAlgorithm is the TSIG algorithm, such as dns.HmacSHA256
+	TsigAlgorithm string
+
+	// TsigSecret is the base64 encoded TSIG secret
+	TsigSecret string
+
+	// TsigSecretFile is a file containing the TSIG secret, which is read for
+	// each transfer instead of using TsigSecret, if set
+	TsigSecretFile string
+
+	// lock guards zones and the sources of each zone. It isn't held during
+	// transfers, so that NOTIFY messages are answered without waiting.
+	lock  sync.Mutex
+	zones map[string]*axfrZone
+}
+
+// axfrZone is the last transferred state of a single zone
+type axfrZone struct {
+	name string
+
+	// sources are the addresses of the transfer server, as last resolved
+	sources []netip.Addr
+
+	// lock serializes the transfers of the zone
+	lock     sync.Mutex
+	serial   uint32
+	loaded   bool
+	triggers map[rpzTrigger]int
+}
+
+// rpzTrigger is a QNAME trigger of a policy zone
+type rpzTrigger struct {
+	name     string
+	passthru bool
+}
+
+// axfrResolveTimeout is the maximum time to resolve the host name of a
+// transfer server
+const axfrResolveTimeout = 5 * time.Second
+
+// NewAXFRListLoader returns a zone transfer loader without a TSIG key
+func NewAXFRListLoader() *AXFRListLoader {
+	return &AXFRListLoader{
+		TsigAlgorithm: dns.HmacSHA256,
+		zones:         make(map[string]*axfrZone),
+	}
+}
+
+// Load implements ListLoader
+func (l *AXFRListLoader) Load(path string) (io.ReadCloser, error) {
+	return l.load(path, false)
+}
+
+// rpzLoader returns a loader of the zones which includes passthru triggers, for
+// lists parsed by parseRPZLine
+func (l *AXFRListLoader) rpzLoader() ListLoader {
+	return rpzListLoader{l}
+}
+
+type rpzListLoader struct {
+	*AXFRListLoader
+}
+
+// Load implements ListLoader
+func (l rpzListLoader) Load(path string) (io.ReadCloser, error) {
+	return l.load(path, true)
+}
+
+func (l *AXFRListLoader) load(path string, passthru bool) (io.ReadCloser, error) {
+	server, zone, err := parseAXFRURL(path)
+	if err != nil {
+		return nil, err
+	}
+
+	l.lock.Lock()
+	z, ok := l.zones[path]
+	if !ok {
+		z = &axfrZone{name: zone, triggers: make(map[rpzTrigger]int)}
+		l.zones[path] = z
+	}
+	l.lock.Unlock()
+
+	if sources, err := resolveServer(server); err == nil {
+		l.lock.Lock()
+		z.sources = sources
+		l.lock.Unlock()
+	} else {
+		log.Warningf("error resolving transfer server of zone %q; %s", path, err)
+	}
+
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	if err := l.transfer(server, zone, z); err != nil {
+		return nil, fmt.Errorf("error transferring zone %q; %w", path, err)
+	}
+
+	return io.NopCloser(z.render(passthru)), nil
+}
+
+// HasZone reports whether a zone, in any case and with or without a trailing
+// dot, is transferred from server. Servers are matched against the addresses
+// they were resolved to when the zone was last transferred.
+func (l *AXFRListLoader) HasZone(zone string, server net.IP) bool {
+	addr, ok := netip.AddrFromSlice(server)
+	if !ok {
+		return false
+	}
+	addr = addr.Unmap()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, z := range l.zones {
+		if strings.EqualFold(z.name, dns.Fqdn(zone)) && slices.Contains(z.sources, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *AXFRListLoader) transfer(server, zone string, z *axfrZone) error {
+	if z.loaded {
+		err := l.ixfr(server, zone, z)
+		if err == nil {
+			return nil
+		}
+		log.Warningf(
+			"incremental transfer of %q from %s failed, "+
+				"falling back to full transfer; %s",
+			zone,
+			server,
+			err,
+		)
+	}
+	return l.axfr(server, zone, z)
+}
+
+func (l *AXFRListLoader) axfr(server, zone string, z *axfrZone) error {
+	msg := new(dns.Msg)
+	msg.SetAxfr(zone)
+	rrs, err := l.exchange(msg, server)
+	if err != nil {
+		return err
+	}
+	return z.replace(zone, rrs)
+}
+
+func (l *AXFRListLoader) ixfr(server, zone string, z *axfrZone) error {
+	msg := new(dns.Msg)
+	msg.SetIxfr(zone, z.serial, ".", ".")
+	rrs, err := l.exchange(msg, server)
+	if err != nil {
+		return err
+	}
+	if len(rrs) == 0 {
+		return fmt.Errorf("empty transfer")
+	}
+	soa, ok := rrs[0].(*dns.SOA)
+	if !ok {
+		return dns.ErrSoa
+	}
+
+	// A single SOA record means the zone has not changed since our serial
+	if len(rrs) == 1 {
+		z.serial = soa.Serial
+		return nil
+	}
+
+	// A server may answer an IXFR request with a full zone; RFC 1995 Section 4
+	if _, incremental := rrs[1].(*dns.SOA); !incremental {
+		return z.replace(zone, rrs)
+	}
+
+	// Incremental transfers are sequences of difference sections, each
+	// beginning with the old SOA and its deletions, followed by the new SOA
+	// and its additions. The closing SOA is the current zone SOA.
+	deleting := false
+	for _, rr := range rrs[1 : len(rrs)-1] {
+		if _, ok := rr.(*dns.SOA); ok {
+			deleting = !deleting
+			continue
+		}
+		if deleting {
+			z.remove(zone, rr)
+		} else {
+			z.add(zone, rr)
+		}
+	}
+	z.serial = soa.Serial
+	return nil
+}
+
+func (l *AXFRListLoader) exchange(msg *dns.Msg, server string) ([]dns.RR, error) {
+	xfr := &dns.Transfer{
+		DialTimeout: 5 * time.Second,
+		ReadTimeout: 30 * time.Second,
+	}
+	if l.TsigName != "" {
+		secret := l.TsigSecret
+		if l.TsigSecretFile != "" {
+			var err error
+			if secret, err = readSecret(l.TsigSecretFile); err != nil {
+				return nil, fmt.Errorf("error reading tsig secret; %w", err)
+			}
+		}
+		name := dns.Fqdn(strings.ToLower(l.TsigName))
+		xfr.TsigSecret = map[string]string{name: secret}
+		msg.SetTsig(name, l.TsigAlgorithm, 300, time.Now().Unix())
+	}
+	env, err := xfr.In(msg, server)
+	if err != nil {
+		return nil, err
+	}
+	var rrs []dns.RR
+	for e := range env {
+		if e.Error != nil {
+			return nil, e.Error
+		}
+		rrs = append(rrs, e.RR...)
+	}
+	return rrs, nil
+}
+
+func (z *axfrZone) replace(zone string, rrs []dns.RR) error {
+	if len(rrs) == 0 {
+		return fmt.Errorf("empty transfer")
+	}
+	soa, ok := rrs[0].(*dns.SOA)
+	if !ok {
+		return dns.ErrSoa
+	}
+	z.triggers = make(map[rpzTrigger]int)
+	for _, rr := range rrs {
+		z.add(zone, rr)
+	}
+	z.serial = soa.Serial
+	z.loaded = true
+	return nil
+}
+
+func (z *axfrZone) add(zone string, rr dns.RR) {
+	if trigger, ok := parseRPZTrigger(zone, rr); ok {
+		z.triggers[trigger]++
+	}
+}
+
+func (z *axfrZone) remove(zone string, rr dns.RR) {
+	trigger, ok := parseRPZTrigger(zone, rr)
+	if !ok {
+		return
+	}
+	z.triggers[trigger]--
+	if z.triggers[trigger] <= 0 {
+		delete(z.triggers, trigger)
+	}
+}
+
+// render the triggers of the zone, one per line. Passthru triggers are only
+// rendered if passthru is set.
+func (z *axfrZone) render(passthru bool) io.Reader {
+	lines := make([]string, 0, len(z.triggers))
+	seen := make(map[string]bool, len(z.triggers))
+	for trigger := range z.triggers {
+		line := trigger.name
+		if trigger.passthru {
+			if !passthru {
+				continue
+			}
+			line += " CNAME " + rpzPassthru
+		}
+		if !seen[line] {
+			seen[line] = true
+			lines = append(lines, line)
+		}
+	}
+	sort.Strings(lines)
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	return &buf
+}
+
+// rpzPassthru is the policy target of triggers which are exempt from the zone
+const rpzPassthru = "rpz-passthru."
+
+// parseRPZTrigger returns the QNAME trigger of a policy record relative to the
+// zone origin. Records at the zone apex and non-QNAME triggers are not
+// triggers.
+func parseRPZTrigger(zone string, rr dns.RR) (rpzTrigger, bool) {
+	switch rr.Header().Rrtype {
+	case dns.TypeSOA, dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+		return rpzTrigger{}, false
+	}
+	owner := strings.ToLower(rr.Header().Name)
+	origin := strings.ToLower(dns.Fqdn(zone))
+	if owner == origin || !dns.IsSubDomain(origin, owner) {
+		return rpzTrigger{}, false
+	}
+	name := strings.TrimSuffix(owner, "."+origin)
+	for _, label := range dns.SplitDomainName(name) {
+		switch label {
+		case "rpz-ip", "rpz-nsip", "rpz-nsdname", "rpz-client-ip":
+			return rpzTrigger{}, false
+		}
+	}
+	cname, ok := rr.(*dns.CNAME)
+	passthru := ok && strings.EqualFold(cname.Target, rpzPassthru)
+	return rpzTrigger{name: name, passthru: passthru}, true
+}
+
+// parseAXFRURL returns the server address and fully qualified zone name of an
+// axfr:// list URL
+func parseAXFRURL(path string) (string, string, error) {
+	listUrl, err := url.Parse(path)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid list URL %q; %w", path, err)
+	}
+	if len(listUrl.Host) == 0 {
+		return "", "", fmt.Errorf("invalid list URL %q; host empty", path)
+	}
+	zone := strings.Trim(listUrl.Path, "/")
+	if len(zone) == 0 {
+		return "", "", fmt.Errorf("invalid list URL %q; zone empty", path)
+	}
+	if _, ok := dns.IsDomainName(zone); !ok {
+		return "", "", fmt.Errorf("invalid list URL %q; invalid zone %q", path, zone)
+	}
+	server := listUrl.Host
+	if len(listUrl.Port()) == 0 {
+		server = net.JoinHostPort(listUrl.Hostname(), "53")
+	}
+	return server, dns.Fqdn(zone), nil
+}
+
+// resolveServer returns the addresses of a host:port server. Host names are
+// resolved using the system resolver.
+func resolveServer(server string) ([]netip.Addr, error) {
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return nil, err
+	}
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr.Unmap()}, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), axfrResolveTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	for i, addr := range addrs {
+		addrs[i] = addr.Unmap()
+	}
+	return addrs, nil
+}
@@ -0,0 +1,491 @@
+package filter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+const (
+	testTsigName   = "transfer.key."
+	testTsigSecret = "dGVzdGluZyB0c2lnIHNlY3JldCBmb3IgZmlsdGVy"
+	testRPZZone    = "rpz.example."
+)
+
+// testRPZServer is a primary server for a Response Policy Zone that answers
+// AXFR and IXFR requests signed with the test TSIG key
+type testRPZServer struct {
+	lock     sync.Mutex
+	serial   uint32
+	records  []string
+	history  map[uint32][2][]string
+	requests []uint16
+	addr     string
+	server   *dns.Server
+
+	// hold delays transfers until it is closed, if set
+	hold chan struct{}
+}
+
+func newTestRPZServer(t *testing.T, records ...string) *testRPZServer {
+	t.Helper()
+	s := &testRPZServer{
+		serial:  1,
+		records: records,
+		history: make(map[uint32][2][]string),
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error starting test rpz server: %v", err)
+	}
+	s.addr = listener.Addr().String()
+	s.server = &dns.Server{
+		Listener:   listener,
+		TsigSecret: map[string]string{testTsigName: testTsigSecret},
+		Handler:    dns.HandlerFunc(s.serveDNS),
+	}
+	started := make(chan struct{})
+	s.server.NotifyStartedFunc = func() { close(started) }
+	go s.server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { s.server.Shutdown() })
+	return s
+}
+
+// update moves the zone to the next serial, recording the difference so that
+// it can be served incrementally
+func (s *testRPZServer) update(deleted, added []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.history[s.serial] = [2][]string{deleted, added}
+	remaining := make([]string, 0, len(s.records))
+	for _, record := range s.records {
+		keep := true
+		for _, del := range deleted {
+			if record == del {
+				keep = false
+			}
+		}
+		if keep {
+			remaining = append(remaining, record)
+		}
+	}
+	s.records = append(remaining, added...)
+	s.serial++
+}
+
+func (s *testRPZServer) soa(serial uint32) dns.RR {
+	rr, _ := dns.NewRR(fmt.Sprintf(
+		"%s 300 IN SOA ns.%s admin.%s %d 3600 600 86400 300",
+		testRPZZone, testRPZZone, testRPZZone, serial,
+	))
+	return rr
+}
+
+func (s *testRPZServer) rrs(records []string) []dns.RR {
+	out := make([]dns.RR, 0, len(records))
+	for _, record := range records {
+		rr, _ := dns.NewRR(record)
+		out = append(out, rr)
+	}
+	return out
+}
+
+func (s *testRPZServer) serveDNS(w dns.ResponseWriter, r *dns.Msg) {
+	if r.IsTsig() == nil || w.TsigStatus() != nil {
+		msg := new(dns.Msg)
+		msg.SetRcode(r, dns.RcodeRefused)
+		w.WriteMsg(msg)
+		return
+	}
+
+	s.lock.Lock()
+	qtype := r.Question[0].Qtype
+	s.requests = append(s.requests, qtype)
+	current := s.soa(s.serial)
+	answer := []dns.RR{current}
+	switch qtype {
+	case dns.TypeAXFR:
+		answer = append(answer, s.rrs(s.records)...)
+		answer = append(answer, current)
+	case dns.TypeIXFR:
+		serial := r.Ns[0].(*dns.SOA).Serial
+		for ; serial < s.serial; serial++ {
+			diff := s.history[serial]
+			answer = append(answer, s.soa(serial))
+			answer = append(answer, s.rrs(diff[0])...)
+			answer = append(answer, s.soa(serial+1))
+			answer = append(answer, s.rrs(diff[1])...)
+		}
+		if 1 < len(answer) {
+			answer = append(answer, current)
+		}
+	}
+	hold := s.hold
+	s.lock.Unlock()
+	if hold != nil {
+		<-hold
+	}
+
+	ch := make(chan *dns.Envelope, 1)
+	ch <- &dns.Envelope{RR: answer}
+	close(ch)
+	tr := new(dns.Transfer)
+	tr.Out(w, r, ch)
+}
+
+func (s *testRPZServer) requestCount() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.requests)
+}
+
+func (s *testRPZServer) lastRequest() uint16 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.requests[len(s.requests)-1]
+}
+
+func TestAXFRTransfer(t *testing.T) {
+	server := newTestRPZServer(t,
+		"example.com.rpz.example. 300 IN CNAME .",
+		"*.example.net.rpz.example. 300 IN CNAME .",
+		"safe.example.net.rpz.example. 300 IN CNAME rpz-passthru.",
+		"32.1.0.0.127.rpz-ip.rpz.example. 300 IN CNAME .",
+	)
+	corefile := `filter {
+		listtsig ` + testTsigName + ` ` + testTsigSecret + `
+		block list wildcard axfr://` + server.addr + `/` + testRPZZone + `
+	}`
+	filter := NewTestFilter(t, corefile)
+	filter.Build()
+
+	if server.lastRequest() != dns.TypeAXFR {
+		t.Errorf("expected initial AXFR; got %s", dns.TypeToString[server.lastRequest()])
+	}
+	for _, wildcard := range []string{"example.com", "example.net"} {
+		if !filter.blockWildcards[wildcard] {
+			t.Errorf("expected wildcard %q from zone transfer", wildcard)
+		}
+	}
+	if len(filter.blockWildcards) != 2 {
+		t.Errorf("expected 2 wildcards; got %d", len(filter.blockWildcards))
+	}
+
+	server.update(
+		[]string{"example.com.rpz.example. 300 IN CNAME ."},
+		[]string{"example.org.rpz.example. 300 IN CNAME ."},
+	)
+	filter.Build()
+
+	if server.lastRequest() != dns.TypeIXFR {
+		t.Errorf("expected IXFR update; got %s", dns.TypeToString[server.lastRequest()])
+	}
+	if filter.blockWildcards["example.com"] {
+		t.Error("expected wildcard \"example.com\" to be removed by IXFR")
+	}
+	if !filter.blockWildcards["example.org"] {
+		t.Error("expected wildcard \"example.org\" to be added by IXFR")
+	}
+
+	// An up-to-date zone is a single SOA record and leaves entries unchanged
+	filter.Build()
+	if len(filter.blockWildcards) != 2 {
+		t.Errorf("expected 2 wildcards; got %d", len(filter.blockWildcards))
+	}
+}
+
+func TestAXFRTransferRPZ(t *testing.T) {
+	server := newTestRPZServer(t,
+		"example.com.rpz.example. 300 IN CNAME .",
+		"*.example.net.rpz.example. 300 IN CNAME .",
+		"safe.example.net.rpz.example. 300 IN CNAME rpz-passthru.",
+	)
+	corefile := `filter {
+		listtsig ` + testTsigName + ` ` + testTsigSecret + `
+		block list rpz axfr://` + server.addr + `/` + testRPZZone + `
+	}`
+	tests := []TestFilterRequest{
+		{"check exact trigger", "example.com", true},
+		{"check subdomain of exact trigger", "www.example.com", false},
+		{"check wildcard trigger", "www.example.net", true},
+		{"check passthru trigger", "safe.example.net", false},
+	}
+	RunFilterTests(t, corefile, tests)
+}
+
+func TestAXFRHasZoneDuringTransfer(t *testing.T) {
+	server := newTestRPZServer(t, "example.com.rpz.example. 300 IN CNAME .")
+	loader := NewAXFRListLoader()
+	loader.TsigName = testTsigName
+	loader.TsigSecret = testTsigSecret
+	path := "axfr://" + server.addr + "/" + testRPZZone
+	if _, err := loader.Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	hold := make(chan struct{})
+	server.lock.Lock()
+	server.hold = hold
+	server.lock.Unlock()
+	done := make(chan struct{})
+	go func() {
+		loader.Load(path)
+		close(done)
+	}()
+	defer func() {
+		close(hold)
+		<-done
+	}()
+	for server.requestCount() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	found := make(chan bool, 1)
+	go func() { found <- loader.HasZone("RPZ.example", net.ParseIP("127.0.0.1")) }()
+	select {
+	case ok := <-found:
+		if !ok {
+			t.Error("expected zone to be transferred from 127.0.0.1")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected HasZone not to wait for the transfer")
+	}
+	if loader.HasZone(testRPZZone, net.ParseIP("127.0.0.2")) {
+		t.Error("expected zone not to be transferred from 127.0.0.2")
+	}
+}
+
+func TestAXFRTransferUnsigned(t *testing.T) {
+	server := newTestRPZServer(t, "example.com.rpz.example. 300 IN CNAME .")
+	test := TestFilterBuild{
+		"check unsigned transfer refused",
+		`filter {
+			block list domain axfr://` + server.addr + `/` + testRPZZone + `
+		}`,
+		true,
+	}
+	RunFilterBuildTest(t, test)
+}
+
+func TestAXFRNotify(t *testing.T) {
+	server := newTestRPZServer(t, "example.com.rpz.example. 300 IN CNAME .")
+	var fetches atomic.Int32
+	lists := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Write([]byte("example.net\n"))
+	}))
+	defer lists.Close()
+	corefile := `filter {
+		listtsig ` + testTsigName + ` ` + testTsigSecret + `
+		block list domain axfr://` + server.addr + `/` + testRPZZone + `
+		block list domain ` + lists.URL + `/list.txt
+		update 0
+	}`
+	filter := NewTestFilter(t, corefile)
+	filter.notifyDelay = 100 * time.Millisecond
+	filter.Build()
+	if err := filter.InitUpdate(); err != nil {
+		t.Fatal(err)
+	}
+	defer filter.OnShutdown()
+	transfers := server.requestCount()
+
+	server.update(nil, []string{"example.org.rpz.example. 300 IN CNAME ."})
+
+	// Repeated notifications are coalesced into a single update
+	for range 3 {
+		notify := new(dns.Msg).SetNotify(testRPZZone)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: "127.0.0.1"})
+		filter.ServeDNS(context.Background(), rec, notify)
+		if rec.Msg == nil || !rec.Msg.Authoritative {
+			t.Fatal("expected authoritative notify response")
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		filter.RLock()
+		updated := filter.blockDomains["example.org"]
+		filter.RUnlock()
+		if updated {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	filter.RLock()
+	defer filter.RUnlock()
+	if !filter.blockDomains["example.org"] {
+		t.Fatal("expected notify to refresh transferred zone")
+	}
+	if !filter.blockDomains["example.net"] {
+		t.Error("expected lists of other sources to keep their rules")
+	}
+	if got := fetches.Load(); got != 1 {
+		t.Errorf("expected lists of other sources not to be fetched again; got %d fetches", got)
+	}
+	if got := server.requestCount() - transfers; got != 1 {
+		t.Errorf("expected 1 transfer for repeated notifications; got %d", got)
+	}
+}
+
+func TestAXFRNotifyUnknownSource(t *testing.T) {
+	server := newTestRPZServer(t, "example.com.rpz.example. 300 IN CNAME .")
+	corefile := `filter {
+		listtsig ` + testTsigName + ` ` + testTsigSecret + `
+		block list domain axfr://` + server.addr + `/` + testRPZZone + `
+	}`
+	filter := NewTestFilter(t, corefile)
+	filter.Build()
+
+	notify := new(dns.Msg).SetNotify(testRPZZone)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	filter.ServeDNS(context.Background(), rec, notify)
+	if rec.Rcode != dns.RcodeServerFailure {
+		t.Errorf("expected notify from unknown source to be passed on")
+	}
+}
+
+func TestAXFRTransferSecretFile(t *testing.T) {
+	server := newTestRPZServer(t, "example.com.rpz.example. 300 IN CNAME .")
+	secret := writeTestFile(t, "tsig.secret", []byte(testTsigSecret+"\n"))
+	filter := NewTestFilter(t, `filter {
+		listtsig `+testTsigName+` {
+			secret_file `+secret+`
+			algorithm hmac-sha256
+		}
+		block list domain axfr://`+server.addr+`/`+testRPZZone+`
+	}`)
+	filter.Build()
+	if !filter.blockDomains["example.com"] {
+		t.Error("expected domain from transfer signed with secret file")
+	}
+}
+
+func TestSetupListTsig(t *testing.T) {
+	secret := writeTestFile(t, "tsig.secret", []byte(testTsigSecret))
+	invalid := writeTestFile(t, "invalid.secret", []byte("not-base64!"))
+	tests := []TestSetup{
+		{
+			"listtsig secret file",
+			`filter {
+				listtsig transfer.key {
+					secret_file ` + secret + `
+				}
+			}`,
+			false,
+		},
+		{
+			"listtsig secret file missing",
+			`filter {
+				listtsig transfer.key {
+					secret_file /noop/tsig.secret
+				}
+			}`,
+			true,
+		},
+		{
+			"listtsig secret file invalid",
+			`filter {
+				listtsig transfer.key {
+					secret_file ` + invalid + `
+				}
+			}`,
+			true,
+		},
+		{
+			"listtsig block without secret file",
+			`filter {
+				listtsig transfer.key {
+					algorithm hmac-sha512
+				}
+			}`,
+			true,
+		},
+		{
+			"listtsig block unknown option",
+			`filter {
+				listtsig transfer.key {
+					secret ` + testTsigSecret + `
+				}
+			}`,
+			true,
+		},
+		{
+			"listtsig none specified",
+			`filter {
+				listtsig
+			}`,
+			true,
+		},
+		{
+			"listtsig no secret",
+			`filter {
+				listtsig transfer.key
+			}`,
+			true,
+		},
+		{
+			"listtsig invalid secret",
+			`filter {
+				listtsig transfer.key not-base64!
+			}`,
+			true,
+		},
+		{
+			"listtsig default algorithm",
+			`filter {
+				listtsig transfer.key ` + testTsigSecret + `
+			}`,
+			false,
+		},
+		{
+			"listtsig explicit algorithm",
+			`filter {
+				listtsig transfer.key ` + testTsigSecret + ` hmac-sha512
+			}`,
+			false,
+		},
+		{
+			"listtsig unsupported algorithm",
+			`filter {
+				listtsig transfer.key ` + testTsigSecret + ` hmac-md5
+			}`,
+			true,
+		},
+		{
+			"axfr list without zone",
+			`filter {
+				block list domain axfr://127.0.0.1
+			}`,
+			true,
+		},
+		{
+			"axfr list without host",
+			`filter {
+				block list domain axfr:///rpz.example
+			}`,
+			true,
+		},
+		{
+			"axfr list",
+			`filter {
+				block list domain axfr://127.0.0.1:5353/rpz.example
+			}`,
+			false,
+		},
+	}
+	for _, test := range tests {
+		RunSetupTest(t, test)
+	}
+}
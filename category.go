@@ -0,0 +1,207 @@
+package filter
+
+import (
+	"time"
+
+	"github.com/coredns/caddy"
+)
+
+// categoryBinding blocks the rules of categories for requests of clients in
+// its groups during its schedules. Requests of any client are blocked at any
+// time if it has no groups or schedules.
+type categoryBinding struct {
+	categories []string
+	groups     []string
+	schedules  []string
+}
+
+// active reports whether the binding applies to a request of a client at a
+// time
+func (b categoryBinding) active(f *Filter, client clientInfo, now time.Time) bool {
+	if len(b.groups) != 0 {
+		member := false
+		for _, name := range b.groups {
+			if f.groups[name].contains(client) {
+				member = true
+				break
+			}
+		}
+		if !member {
+			return false
+		}
+	}
+	if len(b.schedules) != 0 {
+		for _, name := range b.schedules {
+			if f.schedules[name].active(now) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// parseCategory parses the definition of a category of domains, expressions,
+// wildcards, and lists
+func parseCategory(c *caddy.Controller, f *Filter) error {
+	if !c.NextArg() {
+		return c.Err("no category name specified")
+	}
+	name := c.Val()
+	if _, ok := f.categories[name]; ok {
+		return c.Errf("category %q is already defined", name)
+	}
+	switch name {
+	case newDomainsCategory, dgaCategory, tunnelCategory:
+		return c.Errf("category %q is reserved", name)
+	}
+	config := NewActionConfig(ActionTypeBlock)
+	// Lists are fetched with the options and loaders of block lists
+	config.HTTPLoader.Defaults = f.blockConfig.HTTPLoader.Defaults
+	config.AXFRLoader = f.blockConfig.AXFRLoader
+	err := parseBlock(c, func(c *caddy.Controller) error {
+		switch c.Val() {
+		case "domain":
+			if !c.NextArg() {
+				return c.Errf("no domain specified for category %q", name)
+			}
+			config.AddDomain(c.Val())
+		case "regex":
+			if !c.NextArg() {
+				return c.Errf("no regex specified for category %q", name)
+			}
+			if err := config.AddRegex(c.Val()); err != nil {
+				return c.Errf("invalid regex of category %q; %s", name, err)
+			}
+		case "wildcard":
+			if !c.NextArg() {
+				return c.Errf("no wildcard specified for category %q", name)
+			}
+			if err := config.AddWildcard(c.Val()); err != nil {
+				return c.Errf("invalid wildcard of category %q; %s", name, err)
+			}
+		case "list":
+			kind, url, opts, err := parseList(c, ActionTypeBlock)
+			if err != nil {
+				return err
+			}
+			if opts.Audit {
+				return c.Errf("lists of category %q can't be audited", name)
+			}
+			if err := config.AddList(kind, url, opts); err != nil {
+				return c.Err(err.Error())
+			}
+			return nil
+		default:
+			return c.Errf(
+				"unknown category option %q; expected 'domain', 'regex', 'wildcard', or 'list'",
+				c.Val(),
+			)
+		}
+		return ensureEOL(c)
+	})
+	if err != nil {
+		return err
+	}
+	f.categories[name] = config
+	return nil
+}
+
+// parseActionCategory parses the categories blocked by a block directive, and
+// the groups and schedules they're blocked for
+func parseActionCategory(c *caddy.Controller, f *Filter, a ActionType) error {
+	if a != ActionTypeBlock {
+		return c.Errf("unexpected %s token %q; only categories may be blocked", a, c.Val())
+	}
+	binding := categoryBinding{categories: c.RemainingArgs()}
+	if len(binding.categories) == 0 {
+		return c.Err("no block categories specified")
+	}
+	err := parseBlock(c, func(c *caddy.Controller) error {
+		option := c.Val()
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.Errf("no value specified for category option %q", option)
+		}
+		switch option {
+		case "group":
+			binding.groups = append(binding.groups, args...)
+		case "schedule":
+			binding.schedules = append(binding.schedules, args...)
+		default:
+			return c.Errf("unknown category option %q; expected 'group' or 'schedule'", option)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	f.categoryBindings = append(f.categoryBindings, binding)
+	return nil
+}
+
+// validateCategories checks that the categories, groups, and schedules of
+// blocked categories are defined. They may be defined after they're used, so
+// they're checked once the configuration is parsed.
+func validateCategories(c *caddy.Controller, f *Filter) error {
+	for _, binding := range f.categoryBindings {
+		for _, name := range binding.categories {
+			if _, ok := f.categories[name]; !ok {
+				return c.Errf("category %q is not defined", name)
+			}
+		}
+		for _, name := range binding.groups {
+			if _, ok := f.groups[name]; !ok {
+				return c.Errf("group %q is not defined", name)
+			}
+		}
+		for _, name := range binding.schedules {
+			if _, ok := f.schedules[name]; !ok {
+				return c.Errf("schedule %q is not defined", name)
+			}
+		}
+	}
+	return nil
+}
+
+// activeCategories returns the rules of the categories blocked for a request
+// of a client at a time. The filter must be read locked.
+func (f *Filter) activeCategories(client clientInfo, now time.Time) []actionRules {
+	var active []actionRules
+	for _, binding := range f.categoryBindings {
+		if !binding.active(f, client, now) {
+			continue
+		}
+		for _, name := range binding.categories {
+			active = append(active, f.categoryRules[name])
+		}
+	}
+	return active
+}
+
+// buildCategories builds the rules of each category concurrently
+func (f *Filter) buildCategories(refresh listRefresh) map[string]actionRules {
+	sets := make(map[string]ruleSet, len(f.categories))
+	for name := range f.categories {
+		sets[name] = newRuleSet()
+	}
+	done := make(chan struct{})
+	for name, config := range f.categories {
+		// The list worker limit may be set after the category is defined
+		config.fetchSlots = f.blockConfig.fetchSlots
+		go func(config ActionConfig, rules ruleSet) {
+			defer func() { done <- struct{}{} }()
+			config.buildRules(rules, newRuleSet(), newRuleSet(), refresh)
+		}(config, sets[name])
+	}
+	for range f.categories {
+		<-done
+	}
+	rules := make(map[string]actionRules, len(sets))
+	for name, set := range sets {
+		category := f.newActionRules(ActionTypeBlock, set)
+		category.category = name
+		rules[name] = category
+	}
+	return rules
+}
@@ -0,0 +1,335 @@
+package filter
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCategory(t *testing.T) {
+	gambling := writeTestFile(t, "gambling", []byte(
+		"casino.example\n"+
+			"poker.example\n",
+	))
+	// Requests of test.ResponseWriter are from 10.240.0.1
+	corefile := `filter {
+		category ads {
+			domain ads.example
+			wildcard *.tracker.example
+		}
+		category gambling {
+			list domain file://` + gambling + `
+			regex ^bet[0-9]+\.example$
+		}
+		category adult {
+			domain adult.example
+		}
+		group lan {
+			net 10.240.0.0/16
+		}
+		group guests {
+			net 192.0.2.0/24
+		}
+		block category ads
+		block category gambling {
+			group lan
+		}
+		block category adult {
+			group guests
+		}
+		allow domain poker.example
+	}`
+	tests := []TestFilterRequest{
+		{"check category domain", "ads.example", true},
+		{"check category wildcard", "pixel.tracker.example", true},
+		{"check category list for group", "casino.example", true},
+		{"check category regex for group", "bet365.example", true},
+		{"check category allowed", "poker.example", false},
+		{"check category of other group", "adult.example", false},
+		{"check unlisted", "www.example", false},
+	}
+	RunFilterTests(t, corefile, tests)
+}
+
+func TestCategoryActive(t *testing.T) {
+	corefile := `filter {
+		category games {
+			domain games.example
+		}
+		category social {
+			domain social.example
+		}
+		group kids {
+			net 192.0.2.0/24
+		}
+		schedule school {
+			days mon tue wed thu fri
+			hours 08:00-15:00
+			timezone UTC
+		}
+		block category games social {
+			group kids
+			schedule school
+		}
+	}`
+	filter := NewTestFilter(t, corefile)
+	filter.Build()
+	kid := clientInfo{addr: netip.MustParseAddr("192.0.2.10")}
+	parent := clientInfo{addr: netip.MustParseAddr("198.51.100.10")}
+	monday := time.Date(2026, time.October, 12, 10, 0, 0, 0, time.UTC)
+	saturday := time.Date(2026, time.October, 17, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		client clientInfo
+		now    time.Time
+		want   []string
+	}{
+		{"group during schedule", kid, monday, []string{"games", "social"}},
+		{"group outside schedule", kid, saturday, nil},
+		{"other client during schedule", parent, monday, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, rules := range filter.activeCategories(tt.client, tt.now) {
+				got = append(got, rules.category)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("expected categories %q; got %q", tt.want, got)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("expected categories %q; got %q", tt.want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestCategoryReported(t *testing.T) {
+	corefile := `filter {
+		category malware {
+			domain malware.example
+		}
+		block category malware
+		block domain blocked.example
+	}`
+	filter := NewTestFilter(t, corefile)
+	filter.Build()
+	tests := []struct {
+		qname    string
+		category string
+		text     string
+	}{
+		{"malware.example.", "malware", "blocked; category malware"},
+		{"blocked.example.", "", "blocked"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.qname, func(t *testing.T) {
+			before := testutil.ToFloat64(blockedCount.WithLabelValues("", "block", tt.category))
+			req := new(dns.Msg).SetQuestion(tt.qname, dns.TypeA)
+			req.SetEdns0(4096, false)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			filter.ServeDNS(context.Background(), rec, req)
+			after := testutil.ToFloat64(blockedCount.WithLabelValues("", "block", tt.category))
+			if after-before != 1 {
+				t.Errorf("expected blocked count of category %q to increase by 1; got %v", tt.category, after-before)
+			}
+			opt := rec.Msg.IsEdns0()
+			if opt == nil {
+				t.Fatal("expected an OPT record")
+			}
+			var ede *dns.EDNS0_EDE
+			for _, option := range opt.Option {
+				if e, ok := option.(*dns.EDNS0_EDE); ok {
+					ede = e
+				}
+			}
+			if ede == nil {
+				t.Fatal("expected an extended DNS error")
+			}
+			if ede.InfoCode != dns.ExtendedErrorCodeBlocked || ede.ExtraText != tt.text {
+				t.Errorf("expected blocked error %q; got %d %q", tt.text, ede.InfoCode, ede.ExtraText)
+			}
+		})
+	}
+}
+
+func TestCategoryWithoutEDNS(t *testing.T) {
+	filter := NewTestFilter(t, `filter {
+		block domain blocked.example
+	}`)
+	filter.Build()
+	req := new(dns.Msg).SetQuestion("blocked.example.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	filter.ServeDNS(context.Background(), rec, req)
+	if rec.Msg.IsEdns0() != nil {
+		t.Error("expected no OPT record in the response to a request without one")
+	}
+}
+
+func TestSetupCategory(t *testing.T) {
+	tests := []TestSetup{
+		{
+			"category",
+			`filter {
+				block category ads malware
+				category ads {
+					domain ads.example
+					regex ^ads\.
+					wildcard *.ads.example
+					list domain https://example.com/ads.txt {
+						priority 5
+					}
+				}
+				category malware {
+					list hosts https://example.com/malware.txt
+				}
+			}`,
+			false,
+		},
+		{
+			"category groups and schedules",
+			`filter {
+				category ads {
+					domain ads.example
+				}
+				group lan {
+					net 192.168.0.0/16
+				}
+				schedule night {
+					hours 22:00-06:00
+				}
+				block category ads {
+					group lan
+					schedule night
+				}
+			}`,
+			false,
+		},
+		{
+			"category no name",
+			`filter {
+				category
+			}`,
+			true,
+		},
+		{
+			"category duplicate",
+			`filter {
+				category ads {
+					domain ads.example
+				}
+				category ads {
+					domain ads.example
+				}
+			}`,
+			true,
+		},
+		{
+			"category unknown option",
+			`filter {
+				category ads {
+					noop ads.example
+				}
+			}`,
+			true,
+		},
+		{
+			"category invalid regex",
+			`filter {
+				category ads {
+					regex (
+				}
+			}`,
+			true,
+		},
+		{
+			"category invalid wildcard",
+			`filter {
+				category ads {
+					wildcard *.bad..example
+				}
+			}`,
+			true,
+		},
+		{
+			"category audited list",
+			`filter {
+				category ads {
+					list domain https://example.com/ads.txt { mode audit }
+				}
+			}`,
+			true,
+		},
+		{
+			"block category undefined",
+			`filter {
+				block category ads
+			}`,
+			true,
+		},
+		{
+			"block category no names",
+			`filter {
+				block category
+			}`,
+			true,
+		},
+		{
+			"block category undefined group",
+			`filter {
+				category ads {
+					domain ads.example
+				}
+				block category ads {
+					group lan
+				}
+			}`,
+			true,
+		},
+		{
+			"block category undefined schedule",
+			`filter {
+				category ads {
+					domain ads.example
+				}
+				block category ads {
+					schedule night
+				}
+			}`,
+			true,
+		},
+		{
+			"block category unknown option",
+			`filter {
+				category ads {
+					domain ads.example
+				}
+				block category ads {
+					noop lan
+				}
+			}`,
+			true,
+		},
+		{
+			"allow category",
+			`filter {
+				category ads {
+					domain ads.example
+				}
+				allow category ads
+			}`,
+			true,
+		},
+	}
+	for _, test := range tests {
+		RunSetupTest(t, test)
+	}
+}
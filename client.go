@@ -0,0 +1,271 @@
+package filter
+
+import (
+	"context"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// clientInfo identifies the client of a request
+type clientInfo struct {
+	addr netip.Addr
+
+	// mac is the hardware address of the client, if a trusted forwarder
+	// added it to the request
+	mac string
+}
+
+// newClientInfo returns the client of a request as the peer it was received
+// from
+func newClientInfo(state request.Request) clientInfo {
+	addr, _ := netip.ParseAddr(state.IP())
+	return clientInfo{addr: addr.Unmap()}
+}
+
+// key identifies the client in the state of rate limits and detectors. Clients
+// with a hardware address are identified by it, since their address may
+// change.
+func (c clientInfo) key() string {
+	if c.mac != "" {
+		return c.mac
+	}
+	return c.addr.String()
+}
+
+// String returns the address of the client, and its hardware address if any
+func (c clientInfo) String() string {
+	if c.mac != "" {
+		return c.addr.String() + " (" + c.mac + ")"
+	}
+	return c.addr.String()
+}
+
+// clientIdentifier identifies the clients of requests received through
+// forwarders and proxies. Each method is only trusted from its own forwarders.
+type clientIdentifier struct {
+	// ecs are forwarders whose EDNS Client Subnet option is the client's
+	// address
+	ecs []netip.Prefix
+
+	// mac are forwarders whose EDNS option 65001, as added by dnsmasq's
+	// add-mac, is the client's hardware address
+	mac []netip.Prefix
+
+	// proxy are DNS-over-HTTPS proxies whose X-Forwarded-For or X-Real-IP
+	// header is the client's address
+	proxy []netip.Prefix
+}
+
+// ednsMACOption is the EDNS option code of the hardware address added by
+// dnsmasq
+const ednsMACOption = 65001
+
+func parseClientID(c *caddy.Controller, f *Filter) error {
+	err := parseBlock(c, func(c *caddy.Controller) error {
+		method := c.Val()
+		networks := c.RemainingArgs()
+		if len(networks) == 0 {
+			return c.Errf("no trusted forwarders specified for clientid method %q", method)
+		}
+		var trusted *[]netip.Prefix
+		switch method {
+		case "ecs":
+			trusted = &f.clientID.ecs
+		case "mac":
+			trusted = &f.clientID.mac
+		case "proxy":
+			trusted = &f.clientID.proxy
+		default:
+			return c.Errf("unknown clientid method %q; expected 'ecs', 'mac', or 'proxy'", method)
+		}
+		for _, network := range networks {
+			prefix, err := parseNetwork(network)
+			if err != nil {
+				return c.Errf("invalid forwarder %q of clientid method %q; %s", network, method, err)
+			}
+			*trusted = append(*trusted, prefix)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(f.clientID.ecs) == 0 && len(f.clientID.mac) == 0 && len(f.clientID.proxy) == 0 {
+		return c.Err("no clientid methods specified; expected 'ecs', 'mac', or 'proxy'")
+	}
+	return nil
+}
+
+// identify returns the client of a request. The client's address is taken
+// from the headers of a trusted proxy, or else the client subnet of a trusted
+// forwarder, or else the peer the request was received from. Its hardware
+// address is taken from a trusted forwarder.
+func (id clientIdentifier) identify(ctx context.Context, state request.Request) clientInfo {
+	client := newClientInfo(state)
+	peer := client.addr
+	if trusts(id.proxy, peer) {
+		if req, ok := ctx.Value(dnsserver.HTTPRequestKey{}).(*http.Request); ok {
+			if addr, ok := forwardedFor(req, id.proxy); ok {
+				client.addr = addr
+			}
+		}
+	}
+	opt := state.Req.IsEdns0()
+	if opt == nil {
+		return client
+	}
+	for _, option := range opt.Option {
+		switch option := option.(type) {
+		case *dns.EDNS0_SUBNET:
+			if client.addr != peer || !trusts(id.ecs, peer) {
+				continue
+			}
+			if addr, ok := netip.AddrFromSlice(option.Address); ok && !addr.IsUnspecified() {
+				client.addr = addr.Unmap()
+			}
+		case *dns.EDNS0_LOCAL:
+			if option.Code != ednsMACOption || !trusts(id.mac, peer) {
+				continue
+			}
+			if mac, ok := parseMACOption(option.Data); ok {
+				client.mac = mac
+			}
+		}
+	}
+	return client
+}
+
+// trusts reports whether a peer is in any of the trusted networks
+func trusts(trusted []netip.Prefix, peer netip.Addr) bool {
+	return slices.ContainsFunc(trusted, func(prefix netip.Prefix) bool {
+		return prefix.Contains(peer)
+	})
+}
+
+// forwardedFor returns the client address of a request received through
+// trusted proxies. X-Forwarded-For is read from the last address, skipping
+// those of trusted proxies, so that addresses added by the client are ignored.
+// X-Real-IP is used if there is no X-Forwarded-For header.
+func forwardedFor(req *http.Request, trusted []netip.Prefix) (netip.Addr, bool) {
+	var hops []string
+	for _, header := range req.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	if len(hops) == 0 {
+		hops = req.Header.Values("X-Real-IP")
+	}
+	for i := len(hops) - 1; 0 <= i; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		addr = addr.Unmap()
+		if i == 0 || !trusts(trusted, addr) {
+			return addr, true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// parseMACOption parses the hardware address added by dnsmasq's add-mac, which
+// is in binary by default, or in base64 or text if configured
+func parseMACOption(data []byte) (string, bool) {
+	if len(data) == 6 {
+		return net.HardwareAddr(data).String(), true
+	}
+	if mac, err := net.ParseMAC(string(data)); err == nil && len(mac) == 6 {
+		return mac.String(), true
+	}
+	if mac, err := base64.StdEncoding.DecodeString(string(data)); err == nil && len(mac) == 6 {
+		return net.HardwareAddr(mac).String(), true
+	}
+	return "", false
+}
+
+// clientGroup is a named set of clients
+type clientGroup struct {
+	prefixes []netip.Prefix
+	macs     map[string]bool
+}
+
+// contains reports whether a client is a member of the group
+func (g clientGroup) contains(client clientInfo) bool {
+	if client.mac != "" && g.macs[client.mac] {
+		return true
+	}
+	return slices.ContainsFunc(g.prefixes, func(prefix netip.Prefix) bool {
+		return prefix.Contains(client.addr)
+	})
+}
+
+func parseGroup(c *caddy.Controller, f *Filter) error {
+	if !c.NextArg() {
+		return c.Err("no group name specified")
+	}
+	name := c.Val()
+	if _, ok := f.groups[name]; ok {
+		return c.Errf("group %q is already defined", name)
+	}
+	group := clientGroup{macs: make(map[string]bool)}
+	err := parseBlock(c, func(c *caddy.Controller) error {
+		switch c.Val() {
+		case "net":
+			nets := c.RemainingArgs()
+			if len(nets) == 0 {
+				return c.Errf("no networks specified for group %q", name)
+			}
+			for _, network := range nets {
+				prefix, err := parseNetwork(network)
+				if err != nil {
+					return c.Errf("invalid network %q of group %q; %s", network, name, err)
+				}
+				group.prefixes = append(group.prefixes, prefix)
+			}
+		case "mac":
+			macs := c.RemainingArgs()
+			if len(macs) == 0 {
+				return c.Errf("no hardware addresses specified for group %q", name)
+			}
+			for _, addr := range macs {
+				mac, err := net.ParseMAC(addr)
+				if err != nil || len(mac) != 6 {
+					return c.Errf("invalid hardware address %q of group %q", addr, name)
+				}
+				group.macs[mac.String()] = true
+			}
+		default:
+			return c.Errf("unknown group option %q; expected 'net' or 'mac'", c.Val())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(group.prefixes) == 0 && len(group.macs) == 0 {
+		return c.Errf("group %q has no members", name)
+	}
+	f.groups[name] = group
+	return nil
+}
+
+// parseNetwork parses a network prefix or a single address
+func parseNetwork(network string) (netip.Prefix, error) {
+	if addr, err := netip.ParseAddr(network); err == nil {
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(network)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return prefix.Masked(), nil
+}
@@ -0,0 +1,458 @@
+package filter
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+func TestClientGroupContains(t *testing.T) {
+	group := clientGroup{
+		prefixes: []netip.Prefix{
+			netip.MustParsePrefix("192.0.2.0/24"),
+			netip.MustParsePrefix("2001:db8::/32"),
+		},
+		macs: map[string]bool{"02:00:5e:10:00:01": true},
+	}
+	tests := []struct {
+		addr string
+		mac  string
+		want bool
+	}{
+		{"192.0.2.1", "", true},
+		{"2001:db8::1", "", true},
+		{"198.51.100.1", "", false},
+		{"2001:db9::1", "", false},
+		{"198.51.100.1", "02:00:5e:10:00:01", true},
+		{"198.51.100.1", "02:00:5e:10:00:02", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr+tt.mac, func(t *testing.T) {
+			client := clientInfo{addr: netip.MustParseAddr(tt.addr), mac: tt.mac}
+			if got := group.contains(client); got != tt.want {
+				t.Errorf("expected %t; got %t", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseNetwork(t *testing.T) {
+	tests := []struct {
+		network string
+		want    string
+		wantErr bool
+	}{
+		{"192.0.2.1", "192.0.2.1/32", false},
+		{"::ffff:192.0.2.1", "192.0.2.1/32", false},
+		{"2001:db8::1", "2001:db8::1/128", false},
+		{"192.0.2.1/24", "192.0.2.0/24", false},
+		{"192.0.2.0/33", "", true},
+		{"noop", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.network, func(t *testing.T) {
+			got, err := parseNetwork(tt.network)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error: %v, wanterr: %t", err, tt.wantErr)
+			}
+			if err == nil && got.String() != tt.want {
+				t.Errorf("expected %s; got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSetupGroup(t *testing.T) {
+	tests := []TestSetup{
+		{
+			"group",
+			`filter {
+				group lan {
+					net 192.168.0.0/16 10.0.0.1
+					net 2001:db8::/32
+				}
+			}`,
+			false,
+		},
+		{
+			"group no name",
+			`filter {
+				group
+			}`,
+			true,
+		},
+		{
+			"group no members",
+			`filter {
+				group lan
+			}`,
+			true,
+		},
+		{
+			"group duplicate",
+			`filter {
+				group lan {
+					net 10.0.0.0/8
+				}
+				group lan {
+					net 10.0.0.0/8
+				}
+			}`,
+			true,
+		},
+		{
+			"group no networks",
+			`filter {
+				group lan {
+					net
+				}
+			}`,
+			true,
+		},
+		{
+			"group invalid network",
+			`filter {
+				group lan {
+					net 10.0.0.0/40
+				}
+			}`,
+			true,
+		},
+		{
+			"group mac",
+			`filter {
+				group phones {
+					mac 02:00:5E:10:00:01 02-00-5e-10-00-02
+				}
+			}`,
+			false,
+		},
+		{
+			"group invalid mac",
+			`filter {
+				group phones {
+					mac 02:00:5e:10:00
+				}
+			}`,
+			true,
+		},
+		{
+			"group no macs",
+			`filter {
+				group phones {
+					mac
+				}
+			}`,
+			true,
+		},
+		{
+			"group unknown option",
+			`filter {
+				group lan {
+					noop 10.0.0.0/8
+				}
+			}`,
+			true,
+		},
+	}
+	for _, test := range tests {
+		RunSetupTest(t, test)
+	}
+}
+
+func TestClientIdentify(t *testing.T) {
+	controller := caddy.NewTestController("dns", `filter {
+		clientid {
+			ecs 10.240.0.1
+			mac 10.240.0.0/24
+			proxy 10.240.0.1 192.0.2.1
+		}
+	}`)
+	filter := newFilter()
+	if err := Parse(controller, filter); err != nil {
+		t.Fatal(err)
+	}
+	subnet := func(addr string, bits uint8) dns.EDNS0 {
+		ip := net.ParseIP(addr)
+		family := uint16(1)
+		if ip.To4() == nil {
+			family = 2
+		}
+		return &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: family, SourceNetmask: bits, Address: ip}
+	}
+	mac := &dns.EDNS0_LOCAL{Code: ednsMACOption, Data: []byte{0x02, 0x00, 0x5e, 0x10, 0x00, 0x01}}
+	forwarded := func(headers ...string) context.Context {
+		req, _ := http.NewRequest(http.MethodPost, "https://dns.example/dns-query", nil)
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Add(headers[i], headers[i+1])
+		}
+		return context.WithValue(context.Background(), dnsserver.HTTPRequestKey{}, req)
+	}
+	tests := []struct {
+		name    string
+		peer    string
+		ctx     context.Context
+		options []dns.EDNS0
+		want    clientInfo
+	}{
+		{
+			"peer",
+			"10.240.0.1",
+			context.Background(),
+			nil,
+			clientInfo{addr: netip.MustParseAddr("10.240.0.1")},
+		},
+		{
+			"ecs",
+			"10.240.0.1",
+			context.Background(),
+			[]dns.EDNS0{subnet("192.168.1.20", 32)},
+			clientInfo{addr: netip.MustParseAddr("192.168.1.20")},
+		},
+		{
+			"ecs ipv6",
+			"10.240.0.1",
+			context.Background(),
+			[]dns.EDNS0{subnet("2001:db8::20", 128)},
+			clientInfo{addr: netip.MustParseAddr("2001:db8::20")},
+		},
+		{
+			"ecs untrusted",
+			"10.240.0.2",
+			context.Background(),
+			[]dns.EDNS0{subnet("192.168.1.20", 32)},
+			clientInfo{addr: netip.MustParseAddr("10.240.0.2")},
+		},
+		{
+			"mac",
+			"10.240.0.2",
+			context.Background(),
+			[]dns.EDNS0{mac},
+			clientInfo{addr: netip.MustParseAddr("10.240.0.2"), mac: "02:00:5e:10:00:01"},
+		},
+		{
+			"mac untrusted",
+			"198.51.100.1",
+			context.Background(),
+			[]dns.EDNS0{mac},
+			clientInfo{addr: netip.MustParseAddr("198.51.100.1")},
+		},
+		{
+			"ecs and mac",
+			"10.240.0.1",
+			context.Background(),
+			[]dns.EDNS0{subnet("192.168.1.20", 32), mac},
+			clientInfo{addr: netip.MustParseAddr("192.168.1.20"), mac: "02:00:5e:10:00:01"},
+		},
+		{
+			"proxy",
+			"10.240.0.1",
+			forwarded("X-Forwarded-For", "198.51.100.7"),
+			nil,
+			clientInfo{addr: netip.MustParseAddr("198.51.100.7")},
+		},
+		{
+			"proxy beats ecs",
+			"10.240.0.1",
+			forwarded("X-Forwarded-For", "198.51.100.7"),
+			[]dns.EDNS0{subnet("192.168.1.20", 32)},
+			clientInfo{addr: netip.MustParseAddr("198.51.100.7")},
+		},
+		{
+			"proxy untrusted",
+			"10.240.0.2",
+			forwarded("X-Forwarded-For", "198.51.100.7"),
+			nil,
+			clientInfo{addr: netip.MustParseAddr("10.240.0.2")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+			if tt.options != nil {
+				req.SetEdns0(4096, false)
+				opt := req.IsEdns0()
+				opt.Option = append(opt.Option, tt.options...)
+			}
+			state := request.Request{W: &test.ResponseWriter{RemoteIP: tt.peer}, Req: req}
+			if got := filter.clientID.identify(tt.ctx, state); got != tt.want {
+				t.Errorf("expected %s; got %s", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestForwardedFor(t *testing.T) {
+	trusted := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+	}
+	tests := []struct {
+		name    string
+		headers map[string][]string
+		want    string
+	}{
+		{"none", nil, ""},
+		{"single", map[string][]string{"X-Forwarded-For": {"198.51.100.7"}}, "198.51.100.7"},
+		{
+			"trusted hops skipped",
+			map[string][]string{"X-Forwarded-For": {"198.51.100.7, 10.0.0.2", "10.0.0.3"}},
+			"198.51.100.7",
+		},
+		{
+			"spoofed hop ignored",
+			map[string][]string{"X-Forwarded-For": {"203.0.113.9, 198.51.100.7"}},
+			"198.51.100.7",
+		},
+		{"all trusted", map[string][]string{"X-Forwarded-For": {"10.0.0.2, 10.0.0.3"}}, "10.0.0.2"},
+		{"invalid", map[string][]string{"X-Forwarded-For": {"noop"}}, ""},
+		{"real ip", map[string][]string{"X-Real-Ip": {"198.51.100.7"}}, "198.51.100.7"},
+		{"mapped", map[string][]string{"X-Forwarded-For": {"::ffff:198.51.100.7"}}, "198.51.100.7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{Header: http.Header(tt.headers)}
+			addr, ok := forwardedFor(req, trusted)
+			if ok != (tt.want != "") {
+				t.Fatalf("expected found %t; got %t", tt.want != "", ok)
+			}
+			if ok && addr.String() != tt.want {
+				t.Errorf("expected %s; got %s", tt.want, addr)
+			}
+		})
+	}
+}
+
+func TestParseMACOption(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"binary", []byte{0x02, 0x00, 0x5e, 0x10, 0x00, 0x01}, "02:00:5e:10:00:01"},
+		{"text", []byte("02:00:5E:10:00:01"), "02:00:5e:10:00:01"},
+		{"base64", []byte("AgBeEAAB"), "02:00:5e:10:00:01"},
+		{"short", []byte{0x02, 0x00}, ""},
+		{"invalid", []byte("noop"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseMACOption(tt.data)
+			if ok != (tt.want != "") || got != tt.want {
+				t.Errorf("expected %q; got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestClientIdentifiedPolicy(t *testing.T) {
+	filter := NewTestFilter(t, `filter {
+		clientid {
+			mac 10.240.0.1
+		}
+		category games {
+			domain games.example
+		}
+		group kids {
+			mac 02:00:5e:10:00:01
+		}
+		block category games {
+			group kids
+		}
+	}`)
+	filter.Build()
+	tests := []struct {
+		name string
+		mac  []byte
+		want bool
+	}{
+		{"member", []byte{0x02, 0x00, 0x5e, 0x10, 0x00, 0x01}, true},
+		{"other device", []byte{0x02, 0x00, 0x5e, 0x10, 0x00, 0x02}, false},
+		{"unidentified", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := new(dns.Msg).SetQuestion("games.example.", dns.TypeA)
+			if tt.mac != nil {
+				req.SetEdns0(4096, false)
+				opt := req.IsEdns0()
+				opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: ednsMACOption, Data: tt.mac})
+			}
+			// The option must survive a round trip through the wire format
+			wire, err := req.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			req = new(dns.Msg)
+			if err := req.Unpack(wire); err != nil {
+				t.Fatal(err)
+			}
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			filter.ServeDNS(context.Background(), rec, req)
+			if blocked := len(rec.Msg.Answer) != 0; blocked != tt.want {
+				t.Errorf("expected blocked %t; got %t", tt.want, blocked)
+			}
+		})
+	}
+}
+
+func TestSetupClientID(t *testing.T) {
+	tests := []TestSetup{
+		{
+			"clientid",
+			`filter {
+				clientid {
+					ecs 127.0.0.1 ::1
+					mac 192.168.1.1
+					proxy 10.0.0.0/8
+				}
+			}`,
+			false,
+		},
+		{
+			"clientid no methods",
+			`filter {
+				clientid
+			}`,
+			true,
+		},
+		{
+			"clientid no forwarders",
+			`filter {
+				clientid {
+					ecs
+				}
+			}`,
+			true,
+		},
+		{
+			"clientid invalid forwarder",
+			`filter {
+				clientid {
+					mac router.lan
+				}
+			}`,
+			true,
+		},
+		{
+			"clientid unknown method",
+			`filter {
+				clientid {
+					noop 127.0.0.1
+				}
+			}`,
+			true,
+		},
+	}
+	for _, test := range tests {
+		RunSetupTest(t, test)
+	}
+}
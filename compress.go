@@ -0,0 +1,177 @@
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// compression represents the compression format of a list
+type compression int
+
+const (
+	compressionNone compression = iota
+	compressionGzip
+	compressionZstd
+	compressionXZ
+)
+
+// String returns the compression format
+func (c compression) String() string {
+	compressions := map[compression]string{
+		compressionNone: "none",
+		compressionGzip: "gzip",
+		compressionZstd: "zstd",
+		compressionXZ:   "xz",
+	}
+	return compressions[c]
+}
+
+// maxCompressionLayers limits how many times a list is decompressed, such as a
+// .gz file of a compressed archive
+const maxCompressionLayers = 3
+
+var compressionMagic = map[compression][]byte{
+	compressionGzip: {0x1f, 0x8b},
+	compressionZstd: {0x28, 0xb5, 0x2f, 0xfd},
+	compressionXZ:   {0xfd, '7', 'z', 'X', 'Z', 0x00},
+}
+
+// compressionFromEncoding returns the compression of an HTTP Content-Encoding
+func compressionFromEncoding(encoding string) compression {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "gzip", "x-gzip":
+		return compressionGzip
+	case "zstd":
+		return compressionZstd
+	case "xz":
+		return compressionXZ
+	default:
+		return compressionNone
+	}
+}
+
+// compressionFromName returns the compression of a list from its file extension
+func compressionFromName(name string) compression {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".gz", ".gzip":
+		return compressionGzip
+	case ".zst", ".zstd":
+		return compressionZstd
+	case ".xz":
+		return compressionXZ
+	default:
+		return compressionNone
+	}
+}
+
+// decompress returns a reader of the decompressed contents of src. The leading
+// magic bytes of the content take precedence. The declared compression, from a
+// content encoding or file extension, is only used when the content has no
+// recognizable magic bytes. Closing the returned reader closes src.
+func decompress(src io.ReadCloser, declared compression) (io.ReadCloser, error) {
+	var reader io.Reader = src
+	closers := []io.Closer{src}
+	for layer := 0; layer < maxCompressionLayers; layer++ {
+		buffered := bufio.NewReader(reader)
+		format := sniffCompression(buffered)
+		if format == compressionNone && layer == 0 {
+			format = declared
+		}
+		if format == compressionNone {
+			reader = buffered
+			break
+		}
+		next, closer, err := newDecompressor(buffered, format)
+		if err != nil {
+			multiClose(closers)
+			return nil, fmt.Errorf("error decompressing %s list; %w", format, err)
+		}
+		reader = next
+		if closer != nil {
+			closers = append(closers, closer)
+		}
+	}
+	return &decompressedList{Reader: reader, closers: closers}, nil
+}
+
+// decodeContent undoes a single layer of HTTP content encoding, leaving any
+// compression of the list itself. Closing the returned reader closes src.
+func decodeContent(src io.ReadCloser, encoding compression) (io.ReadCloser, error) {
+	if encoding == compressionNone {
+		return src, nil
+	}
+	reader, closer, err := newDecompressor(src, encoding)
+	if err != nil {
+		src.Close()
+		return nil, fmt.Errorf("error decoding %s content; %w", encoding, err)
+	}
+	closers := []io.Closer{src}
+	if closer != nil {
+		closers = append(closers, closer)
+	}
+	return &decompressedList{Reader: reader, closers: closers}, nil
+}
+
+func sniffCompression(r *bufio.Reader) compression {
+	for c, magic := range compressionMagic {
+		peek, _ := r.Peek(len(magic))
+		if bytes.Equal(peek, magic) {
+			return c
+		}
+	}
+	return compressionNone
+}
+
+func newDecompressor(r io.Reader, c compression) (io.Reader, io.Closer, error) {
+	switch c {
+	case compressionGzip:
+		gz, err := gzip.NewReader(r)
+		return gz, gz, err
+	case compressionZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zr, closerFunc(zr.Close), nil
+	case compressionXZ:
+		xr, err := xz.NewReader(r)
+		return xr, nil, err
+	default:
+		return r, nil, nil
+	}
+}
+
+// decompressedList closes every decompression layer along with the source
+type decompressedList struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (d *decompressedList) Close() error {
+	return multiClose(d.closers)
+}
+
+func multiClose(closers []io.Closer) error {
+	var err error
+	for i := len(closers) - 1; 0 <= i; i-- {
+		if cerr := closers[i].Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+type closerFunc func()
+
+func (f closerFunc) Close() error {
+	f()
+	return nil
+}
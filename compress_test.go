@@ -0,0 +1,136 @@
+package filter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+const testCompressList = "# compressed list\nexample.com\nexample.net\n"
+
+func compressTestList(t *testing.T, format compression, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch format {
+	case compressionGzip:
+		w = gzip.NewWriter(&buf)
+	case compressionZstd:
+		w, err = zstd.NewWriter(&buf)
+	case compressionXZ:
+		w, err = xz.NewWriter(&buf)
+	default:
+		return data
+	}
+	if err != nil {
+		t.Fatalf("error creating %s writer: %v", format, err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("error compressing %s: %v", format, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("error compressing %s: %v", format, err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecompressFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		format compression
+	}{
+		{"list.txt", compressionNone},
+		{"list.txt.gz", compressionGzip},
+		{"list.txt.zst", compressionZstd},
+		{"list.txt.xz", compressionXZ},
+		// Magic bytes take precedence over a missing or wrong extension
+		{"list.txt", compressionGzip},
+		{"list.gz", compressionXZ},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format.String()+" "+tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, tt.name)
+			data := compressTestList(t, tt.format, []byte(testCompressList))
+			if err := os.WriteFile(path, data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			filter := NewTestFilter(t, `filter {
+				block list domain file://`+filepath.ToSlash(path)+`
+			}`)
+			filter.Build()
+			if len(filter.blockDomains) != 2 {
+				t.Errorf("expected 2 domains; got %d", len(filter.blockDomains))
+			}
+		})
+	}
+}
+
+func TestDecompressNested(t *testing.T) {
+	inner := compressTestList(t, compressionXZ, []byte(testCompressList))
+	outer := compressTestList(t, compressionGzip, inner)
+	list, err := decompress(io.NopCloser(bytes.NewReader(outer)), compressionNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer list.Close()
+	out, err := io.ReadAll(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != testCompressList {
+		t.Errorf("expected %q; got %q", testCompressList, out)
+	}
+}
+
+func TestDecompressInvalid(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "list.txt.gz")
+	if err := os.WriteFile(path, []byte(testCompressList), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	test := TestFilterBuild{
+		"check uncompressed list with compressed extension",
+		`filter {
+			block list domain file://` + filepath.ToSlash(path) + `
+		}`,
+		true,
+	}
+	RunFilterBuildTest(t, test)
+}
+
+func TestDecompressHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/encoded":
+			w.Header().Set("Content-Encoding", "zstd")
+			w.Write(compressTestList(t, compressionZstd, []byte(testCompressList)))
+		case "/list.gz":
+			w.Write(compressTestList(t, compressionGzip, []byte(testCompressList)))
+		default:
+			w.Write([]byte(testCompressList))
+		}
+	}))
+	defer server.Close()
+
+	for _, path := range []string{"/encoded", "/list.gz", "/plain"} {
+		t.Run(path, func(t *testing.T) {
+			filter := NewTestFilter(t, `filter {
+				block list domain `+server.URL+path+`
+			}`)
+			filter.Build()
+			if len(filter.blockDomains) != 2 {
+				t.Errorf("expected 2 domains; got %d", len(filter.blockDomains))
+			}
+		})
+	}
+}
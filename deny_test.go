@@ -0,0 +1,142 @@
+package filter
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestDeny(t *testing.T) {
+	vendors := writeTestFile(t, "vendors", []byte(
+		"vendor.example\n"+
+			"cdn.example\n",
+	))
+	incidents := writeTestFile(t, "incidents", []byte(
+		"compromised.cdn.example\n",
+	))
+	corefile := `filter {
+		precedence specific
+		allow list wildcard file://` + vendors + `
+		allow domain exact.vendor.example
+		deny domain exact.vendor.example
+		deny wildcard *.phish.vendor.example
+		deny regex ^c2-[0-9]+\.vendor\.example$
+		deny list domain file://` + incidents + `
+	}`
+	tests := []TestFilterRequest{
+		{"check deny domain beats exact allow", "exact.vendor.example", true},
+		{"check deny wildcard beats allow list", "login.phish.vendor.example", true},
+		{"check deny regex beats allow list", "c2-42.vendor.example", true},
+		{"check deny list beats allow list", "compromised.cdn.example", true},
+		{"check allow list", "www.vendor.example", false},
+		{"check allow list subdomain", "assets.cdn.example", false},
+	}
+	RunFilterTests(t, corefile, tests)
+}
+
+func TestDenyResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		corefile string
+		qname    string
+		rcode    int
+		answers  int
+	}{
+		{
+			"deny response",
+			`filter {
+				deny domain denied.example
+				deny response nxdomain
+				block domain blocked.example
+			}`,
+			"denied.example.",
+			dns.RcodeNameError,
+			1,
+		},
+		{
+			"block response",
+			`filter {
+				deny domain denied.example
+				deny response nxdomain
+				block domain blocked.example
+			}`,
+			"blocked.example.",
+			dns.RcodeSuccess,
+			1,
+		},
+		{
+			"default deny response",
+			`filter {
+				deny domain denied.example
+				response nodata
+			}`,
+			"denied.example.",
+			dns.RcodeSuccess,
+			0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := NewTestFilter(t, tt.corefile)
+			filter.Build()
+			req := new(dns.Msg).SetQuestion(tt.qname, dns.TypeA)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			rcode, _ := filter.ServeDNS(context.Background(), rec, req)
+			if rcode != tt.rcode {
+				t.Errorf("expected %s; got %s", dns.RcodeToString[tt.rcode], dns.RcodeToString[rcode])
+			}
+			if len(rec.Msg.Answer) != tt.answers {
+				t.Errorf("expected %d answers; got %d", tt.answers, len(rec.Msg.Answer))
+			}
+		})
+	}
+}
+
+func TestSetupDeny(t *testing.T) {
+	tests := []TestSetup{
+		{
+			"deny types",
+			`filter {
+				deny domain example.com
+				deny wildcard *.example.net
+				deny regex ^ads\.
+				deny list domain https://example.com/incidents.txt
+			}`,
+			false,
+		},
+		{
+			"deny response",
+			`filter {
+				deny response address a 192.0.2.1
+			}`,
+			false,
+		},
+		{
+			"deny response invalid",
+			`filter {
+				deny response noop
+			}`,
+			true,
+		},
+		{
+			"deny missing type",
+			`filter {
+				deny
+			}`,
+			true,
+		},
+		{
+			"block response",
+			`filter {
+				block response nxdomain
+			}`,
+			true,
+		},
+	}
+	for _, test := range tests {
+		RunSetupTest(t, test)
+	}
+}
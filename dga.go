@@ -0,0 +1,231 @@
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	_ "embed"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/coredns/caddy"
+)
+
+// dgaCategory is the category reported for names that look generated
+const dgaCategory = "dga"
+
+// dgaBigramTable are counts of the bigrams of words and domain names
+//
+//go:embed dga/bigrams.txt
+var dgaBigramTable []byte
+
+// dgaModel is the bigram model of dgaBigramTable
+var dgaModel = mustBigramModel(dgaBigramTable)
+
+// dgaDetector blocks names whose registered label looks like it was generated
+// by a domain generation algorithm
+type dgaDetector struct {
+	// threshold is the score from which labels are considered generated
+	threshold float64
+
+	// minLength is the length of the shortest label scored. Short labels are
+	// too easily mistaken for generated ones.
+	minLength int
+
+	// audit logs and counts requests for generated names instead of blocking
+	// them
+	audit bool
+}
+
+func parseDGA(c *caddy.Controller, f *Filter) error {
+	if f.dga != nil {
+		return c.Err("dga is already configured")
+	}
+	d := &dgaDetector{threshold: 0.7, minLength: 8}
+	err := parseBlock(c, func(c *caddy.Controller) error {
+		option := c.Val()
+		if !c.NextArg() {
+			return c.Errf("no value specified for dga option %q", option)
+		}
+		switch option {
+		case "threshold":
+			threshold, err := strconv.ParseFloat(c.Val(), 64)
+			if err != nil || threshold <= 0 || 1 < threshold {
+				return c.Errf("invalid dga threshold %q; expected a number from 0 to 1", c.Val())
+			}
+			d.threshold = threshold
+		case "minlength":
+			length, err := strconv.Atoi(c.Val())
+			if err != nil || length < 1 || 63 < length {
+				return c.Errf("invalid dga minlength %q; expected an integer from 1 to 63", c.Val())
+			}
+			d.minLength = length
+		case "mode":
+			switch c.Val() {
+			case "audit":
+				d.audit = true
+			case "enforce":
+				d.audit = false
+			default:
+				return c.Errf("invalid dga mode %q; expected 'audit' or 'enforce'", c.Val())
+			}
+		default:
+			return c.Errf("unknown dga option %q; expected 'threshold', 'minlength', or 'mode'", option)
+		}
+		return ensureEOL(c)
+	})
+	if err != nil {
+		return err
+	}
+	f.dga = d
+	return nil
+}
+
+// match returns a match if the registered label of a name scores at least the
+// threshold. Labels of names under unlisted suffixes, short labels, and
+// internationalized labels aren't scored.
+func (d *dgaDetector) match(qname string) (ruleMatch, bool) {
+	domain, ok := registrableDomain(qname)
+	if !ok {
+		return ruleMatch{}, false
+	}
+	label, _, _ := strings.Cut(domain, ".")
+	if len(label) < d.minLength || strings.HasPrefix(label, "xn--") {
+		return ruleMatch{}, false
+	}
+	score := dgaScore(label)
+	if score < d.threshold {
+		return ruleMatch{}, false
+	}
+	log.Infof("dga: request %q scored %.2f; threshold %.2f", qname, score, d.threshold)
+	return ruleMatch{
+		action:   ActionTypeBlock,
+		kind:     RuleSuffix,
+		value:    domain,
+		category: dgaCategory,
+	}, true
+}
+
+// dgaScore scores how likely a label is to be generated, from 0 to 1. It
+// weighs the unlikeliness of the label's bigrams, its character entropy, and
+// its longest run of consonants.
+func dgaScore(label string) float64 {
+	return 0.45*dgaModel.rarity(label) + 0.35*entropyScore(label) + 0.2*consonantScore(label)
+}
+
+// entropyScore returns the Shannon entropy of a label's characters, relative to
+// the highest entropy a label of its length could have
+func entropyScore(label string) float64 {
+	if len(label) < 2 {
+		return 0
+	}
+	// Labels have 37 characters, of which '-' is rarely repeated
+	return shannonEntropy(label) / math.Log2(float64(min(len(label), 36)))
+}
+
+// shannonEntropy returns the Shannon entropy of a string's characters in bits
+func shannonEntropy(s string) float64 {
+	counts := make(map[rune]int)
+	var total int
+	for _, r := range s {
+		counts[r]++
+		total++
+	}
+	var entropy float64
+	for _, count := range counts {
+		p := float64(count) / float64(total)
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// consonantScore scores the longest run of consonants in a label. Digits are
+// counted as consonants. Runs of two or fewer are common, and runs of six or
+// more are rare.
+func consonantScore(label string) float64 {
+	var run, longest int
+	for _, r := range label {
+		switch r {
+		case 'a', 'e', 'i', 'o', 'u', 'y', '-':
+			run = 0
+		default:
+			run++
+			longest = max(longest, run)
+		}
+	}
+	return clampScore(float64(longest-2) / 4)
+}
+
+func clampScore(score float64) float64 {
+	return math.Min(1, math.Max(0, score))
+}
+
+// bigramModel holds the log probability of each bigram of letters
+type bigramModel struct {
+	logProb map[string]float64
+
+	// unseen is the log probability of a bigram that wasn't counted
+	unseen float64
+}
+
+// rarity scores how unlikely the bigrams of letters in a label are, from 0 for
+// bigrams as common as those of words to 1 for rare bigrams. Labels without
+// bigrams of letters are rare.
+func (m bigramModel) rarity(label string) float64 {
+	var sum float64
+	var count int
+	for i := 0; i+1 < len(label); i++ {
+		if !isLetter(label[i]) || !isLetter(label[i+1]) {
+			continue
+		}
+		logProb, ok := m.logProb[label[i:i+2]]
+		if !ok {
+			logProb = m.unseen
+		}
+		sum += logProb
+		count++
+	}
+	if count == 0 {
+		return 1
+	}
+	// Words average about -2.3, and random letters about -3.2
+	return clampScore((-sum/float64(count) - 2.3) / 1.2)
+}
+
+func isLetter(b byte) bool {
+	return 'a' <= b && b <= 'z'
+}
+
+// mustBigramModel parses a table of bigram counts, with add-one smoothing
+func mustBigramModel(table []byte) bigramModel {
+	counts := make(map[string]int)
+	var total int
+	scanner := bufio.NewScanner(bytes.NewReader(table))
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || len(fields[0]) != 2 {
+			panic(fmt.Sprintf("dga bigram table line %d: expected BIGRAM COUNT", number))
+		}
+		count, err := strconv.Atoi(fields[1])
+		if err != nil || count < 0 {
+			panic(fmt.Sprintf("dga bigram table line %d: invalid count %q", number, fields[1]))
+		}
+		counts[fields[0]] = count
+		total += count
+	}
+	// Every pair of 26 letters is a possible bigram
+	denominator := float64(total + 26*26)
+	model := bigramModel{
+		logProb: make(map[string]float64, len(counts)),
+		unseen:  math.Log10(1 / denominator),
+	}
+	for bigram, count := range counts {
+		model.logProb[bigram] = math.Log10(float64(count+1) / denominator)
+	}
+	return model
+}
@@ -0,0 +1,219 @@
+package filter
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDGAScore(t *testing.T) {
+	legitimate := []string{
+		"archlinux",
+		"bankofamerica",
+		"duckduckgo",
+		"letsencrypt",
+		"microsoftonline",
+		"stackoverflow",
+		"thepiratebay",
+		"wikipedia",
+		"wolframalpha",
+		"wordpress",
+	}
+	generated := []string{
+		"bmbvnagtqhrnp",
+		"kvpgbfjwuofiy",
+		"lxjepnbvbbaqk",
+		"pjyhqvlxsdhdl",
+		"qgfyhiqd",
+		"tfxfmmqpbbsgw",
+		"wxyhuvlswfqcb",
+		"xjw3kq9zpl",
+		"ydqtkptuwsa",
+	}
+	for _, label := range legitimate {
+		if score := dgaScore(label); 0.6 <= score {
+			t.Errorf("expected %q to score below 0.6; got %.2f", label, score)
+		}
+	}
+	for _, label := range generated {
+		if score := dgaScore(label); score < 0.8 {
+			t.Errorf("expected %q to score at least 0.8; got %.2f", label, score)
+		}
+	}
+}
+
+func TestDGAScoreComponents(t *testing.T) {
+	tests := []struct {
+		name  string
+		score func(string) float64
+		label string
+		want  float64
+	}{
+		{"entropy repeated", entropyScore, "aaaaaaaa", 0},
+		{"entropy distinct", entropyScore, "abcdefgh", 1},
+		{"entropy single", entropyScore, "a", 0},
+		{"consonants short run", consonantScore, "banana", 0},
+		{"consonants long run", consonantScore, "abcdfghjk", 1},
+		{"consonants digits", consonantScore, "a1234", 0.5},
+		{"bigrams without letters", dgaModel.rarity, "12345678", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.score(tt.label); got != tt.want {
+				t.Errorf("expected %v; got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestBigramModel(t *testing.T) {
+	model := mustBigramModel([]byte("# comment\n\nab 3\ncd 1\n"))
+	if len(model.logProb) != 2 {
+		t.Fatalf("expected 2 bigrams; got %d", len(model.logProb))
+	}
+	if !(model.unseen < model.logProb["cd"] && model.logProb["cd"] < model.logProb["ab"]) {
+		t.Error("expected more frequent bigrams to be more probable")
+	}
+	for _, table := range []string{"abc 1\n", "ab\n", "ab -1\n", "ab noop\n"} {
+		t.Run(table, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("expected panic")
+				}
+			}()
+			mustBigramModel([]byte(table))
+		})
+	}
+}
+
+func TestDGA(t *testing.T) {
+	corefile := `filter {
+		dga {
+			threshold 0.7
+			minlength 8
+		}
+		allow domain www.kvpgbfjwuofiy.net
+	}`
+	tests := []TestFilterRequest{
+		{"check generated", "bmbvnagtqhrnp.com", true},
+		{"check generated subdomain", "www.lxjepnbvbbaqk.org", true},
+		{"check generated allowed", "www.kvpgbfjwuofiy.net", false},
+		{"check dictionary", "www.stackoverflow.com", false},
+		{"check short label", "bkrtx.com", false},
+		{"check internationalized label", "xn--80ak6aa92e.com", false},
+		{"check unlisted suffix", "bmbvnagtqhrnp.home", false},
+	}
+	RunFilterTests(t, corefile, tests)
+}
+
+func TestDGAAudit(t *testing.T) {
+	filter := NewTestFilter(t, `filter {
+		dga {
+			mode audit
+		}
+	}`)
+	filter.Build()
+	before := testutil.ToFloat64(wouldBlockCount.WithLabelValues("", "block", dgaCategory))
+	req := new(dns.Msg).SetQuestion("tfxfmmqpbbsgw.com.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	filter.ServeDNS(context.Background(), rec, req)
+	if len(rec.Msg.Answer) != 0 {
+		t.Error("expected audited generated name not to be blocked")
+	}
+	after := testutil.ToFloat64(wouldBlockCount.WithLabelValues("", "block", dgaCategory))
+	if after-before != 1 {
+		t.Errorf("expected would block count to increase by 1; got %v", after-before)
+	}
+}
+
+func TestSetupDGA(t *testing.T) {
+	tests := []TestSetup{
+		{
+			"dga",
+			`filter {
+				dga
+			}`,
+			false,
+		},
+		{
+			"dga options",
+			`filter {
+				dga {
+					threshold 0.8
+					minlength 10
+					mode audit
+				}
+			}`,
+			false,
+		},
+		{
+			"dga duplicate",
+			`filter {
+				dga
+				dga
+			}`,
+			true,
+		},
+		{
+			"dga invalid threshold",
+			`filter {
+				dga {
+					threshold 1.5
+				}
+			}`,
+			true,
+		},
+		{
+			"dga invalid minlength",
+			`filter {
+				dga {
+					minlength 0
+				}
+			}`,
+			true,
+		},
+		{
+			"dga invalid mode",
+			`filter {
+				dga {
+					mode noop
+				}
+			}`,
+			true,
+		},
+		{
+			"dga no value",
+			`filter {
+				dga {
+					threshold
+				}
+			}`,
+			true,
+		},
+		{
+			"dga unknown option",
+			`filter {
+				dga {
+					noop 1
+				}
+			}`,
+			true,
+		},
+		{
+			"dga reserved category",
+			`filter {
+				category dga {
+					domain example.com
+				}
+			}`,
+			true,
+		},
+	}
+	for _, test := range tests {
+		RunSetupTest(t, test)
+	}
+}
@@ -0,0 +1,266 @@
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"iter"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/coredns/caddy"
+)
+
+// DefaultListWorkers is the number of lists fetched concurrently if no limit
+// is configured
+const DefaultListWorkers = 4
+
+// parsedList is the rules of a single list
+type parsedList struct {
+	kind  string
+	url   string
+	rules []Rule
+}
+
+// maxListLineSize is the length of the longest line read from a list. Longer
+// lines are skipped.
+const maxListLineSize = 1 << 20
+
+// listRefresh selects the lists fetched by a build by their URL. A nil
+// listRefresh selects every list.
+type listRefresh func(url string) bool
+
+// fetchedLists are the rules of each list of an action as last fetched, which
+// are reused by builds that don't refresh the list
+type fetchedLists struct {
+	lock  sync.Mutex
+	rules map[listKey][]Rule
+}
+
+func newFetchedLists() *fetchedLists {
+	return &fetchedLists{rules: make(map[listKey][]Rule)}
+}
+
+func (l *fetchedLists) get(key listKey) ([]Rule, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	rules, ok := l.rules[key]
+	return rules, ok
+}
+
+// set the rules of a list, or forget them if the list couldn't be fetched
+func (l *fetchedLists) set(key listKey, rules []Rule, ok bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if ok {
+		l.rules[key] = rules
+	} else {
+		delete(l.rules, key)
+	}
+}
+
+// fetchLists loads and parses the lists of an action selected by refresh
+// concurrently, taking a slot from the action's fetch slots while each list is
+// fetched and parsed. Lists that aren't selected keep the rules they were last
+// fetched with.
+//
+// Each list is closed as soon as it is parsed. Lists that can't be loaded or
+// read are logged and omitted. Results are sorted by URL and type, so that
+// merging them is deterministic regardless of the order in which lists
+// complete.
+func (a ActionConfig) fetchLists(refresh listRefresh) []parsedList {
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var results []parsedList
+	for kind, lists := range a.lists {
+		for url, loader := range lists {
+			if refresh != nil && !refresh(url) {
+				if rules, ok := a.fetched.get(listKey{kind, url}); ok {
+					lock.Lock()
+					results = append(results, parsedList{kind: kind, url: url, rules: rules})
+					lock.Unlock()
+				}
+				continue
+			}
+			wg.Add(1)
+			go func(kind, url string, loader ListLoader) {
+				defer wg.Done()
+				a.fetchSlots <- struct{}{}
+				defer func() { <-a.fetchSlots }()
+
+				rules, err := a.ingestList(kind, url, loader)
+				a.fetched.set(listKey{kind, url}, rules, err == nil)
+				if err != nil {
+					log.Errorf(
+						"there was a problem fetching %s %s list %q; %s",
+						a.configType,
+						kind,
+						url,
+						err,
+					)
+					return
+				}
+
+				lock.Lock()
+				results = append(results, parsedList{kind: kind, url: url, rules: rules})
+				lock.Unlock()
+			}(kind, url, loader)
+		}
+	}
+	wg.Wait()
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].url != results[j].url {
+			return results[i].url < results[j].url
+		}
+		return results[i].kind < results[j].kind
+	})
+	return results
+}
+
+// ingestList loads, parses, then closes a single list. Lines which can't be
+// parsed are logged as diagnostics of the list.
+func (a ActionConfig) ingestList(kind, url string, loader ListLoader) ([]Rule, error) {
+	parser, ok := getListParser(kind)
+	if !ok {
+		return nil, fmt.Errorf("no parser registered for list type %q", kind)
+	}
+	src, err := loader.Load(url)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	var rules []Rule
+	var diagnostics []Diagnostic
+	var readErr error
+	for number, line := range a.listLines(url, bufio.NewReader(src), &readErr) {
+		lineRules, err := parser.ParseLine(line)
+		if err == nil {
+			lineRules, err = normalizeRules(lineRules)
+		}
+		if err == nil {
+			lineRules, err = compileRules(lineRules)
+		}
+		if err != nil {
+			diagnostics = append(diagnostics, Diagnostic{Line: number, Err: err})
+			continue
+		}
+		rules = append(rules, lineRules...)
+	}
+	if readErr != nil {
+		return nil, fmt.Errorf("error reading list; %w", readErr)
+	}
+
+	for _, diagnostic := range diagnostics {
+		log.Debugf("skipped entry of %s %s list %q; %s", a.configType, kind, url, diagnostic)
+	}
+	if len(diagnostics) != 0 {
+		log.Infof(
+			"skipped %d invalid entries of %s %s list %q",
+			len(diagnostics),
+			a.configType,
+			kind,
+			url,
+		)
+	}
+	return rules, nil
+}
+
+// compileRules compiles the expressions of regex rules without a compiled
+// expression
+func compileRules(rules []Rule) ([]Rule, error) {
+	for i, rule := range rules {
+		if rule.Kind != RuleRegex || rule.Regexp != nil {
+			continue
+		}
+		regex, err := regexp.Compile(rule.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression %q; %w", rule.Value, err)
+		}
+		rules[i].Regexp = regex
+	}
+	return rules, nil
+}
+
+// listLines returns the lines of a list which aren't skipped, along with their
+// line numbers. Iteration stops at the first read error, which is stored in
+// err.
+func (a ActionConfig) listLines(url string, r *bufio.Reader, err *error) iter.Seq2[int, []byte] {
+	return func(yield func(int, []byte) bool) {
+		for number := 1; ; number++ {
+			line, tooLong, readErr := readListLine(r)
+			if readErr == io.EOF {
+				return
+			}
+			if readErr != nil {
+				*err = readErr
+				return
+			}
+			if tooLong {
+				log.Warningf(
+					"skipping line %d of list %q; exceeds maximum length of %d bytes",
+					number,
+					url,
+					maxListLineSize,
+				)
+				continue
+			}
+			line = bytes.TrimSpace(line)
+			if a.shouldSkip(line) {
+				continue
+			}
+			if !yield(number, line) {
+				return
+			}
+		}
+	}
+}
+
+// readListLine reads a line of any length without its line ending. Lines
+// longer than maxListLineSize are consumed but not returned, and tooLong is
+// set.
+func readListLine(r *bufio.Reader) (line []byte, tooLong bool, err error) {
+	fragment, isPrefix, err := r.ReadLine()
+	if err != nil || !isPrefix {
+		return fragment, false, err
+	}
+	line = append(line, fragment...)
+	for isPrefix {
+		fragment, isPrefix, err = r.ReadLine()
+		if err != nil {
+			return nil, false, err
+		}
+		if len(line) <= maxListLineSize {
+			line = append(line, fragment...)
+		}
+	}
+	if maxListLineSize < len(line) {
+		return nil, true, nil
+	}
+	return line, false, nil
+}
+
+// newFetchSlots returns a semaphore limiting concurrent list fetches to
+// workers
+func newFetchSlots(workers int) chan struct{} {
+	return make(chan struct{}, workers)
+}
+
+func parseListWorkers(c *caddy.Controller, f *Filter) error {
+	if !c.NextArg() {
+		return c.Err("no list worker limit specified")
+	}
+	workers, err := strconv.Atoi(c.Val())
+	if err != nil || workers < 1 {
+		return c.Errf("invalid list worker limit %q; expected a positive integer", c.Val())
+	}
+	slots := newFetchSlots(workers)
+	f.allowConfig.fetchSlots = slots
+	f.blockConfig.fetchSlots = slots
+	f.denyConfig.fetchSlots = slots
+	f.overrideConfig.fetchSlots = slots
+	return ensureEOL(c)
+}
@@ -0,0 +1,247 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFetchListsConcurrency(t *testing.T) {
+	var lock sync.Mutex
+	var inflight, peak int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		inflight++
+		if peak < inflight {
+			peak = inflight
+		}
+		lock.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		lock.Lock()
+		inflight--
+		lock.Unlock()
+		fmt.Fprintf(w, "%s.example.com\n", r.URL.Path[1:])
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		workers string
+		want    int
+	}{
+		{"one worker", "listworkers 1", 1},
+		{"three workers", "listworkers 3", 3},
+		{"default workers", "", DefaultListWorkers},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peak = 0
+			filter := NewTestFilter(t, `filter {
+				`+tt.workers+`
+				allow list domain `+server.URL+`/allow1
+				allow list wildcard `+server.URL+`/allow2
+				block list domain `+server.URL+`/block1
+				block list domain `+server.URL+`/block2
+				block list hosts `+server.URL+`/block3
+				block list regex `+server.URL+`/block4
+				block list wildcard `+server.URL+`/block5
+				block list wildcard `+server.URL+`/block6
+			}`)
+			filter.Build()
+			if len(filter.blockDomains) != 2 {
+				t.Errorf("expected 2 blocked domains; got %d", len(filter.blockDomains))
+			}
+			if len(filter.blockWildcards) != 2 {
+				t.Errorf("expected 2 blocked wildcards; got %d", len(filter.blockWildcards))
+			}
+			if len(filter.allowDomains) != 1 || len(filter.allowWildcards) != 1 {
+				t.Errorf("expected 1 allowed domain and wildcard")
+			}
+			if tt.want < peak {
+				t.Errorf("expected at most %d concurrent fetches; got %d", tt.want, peak)
+			}
+			if tt.want != 1 && peak < 2 {
+				t.Errorf("expected concurrent fetches; got %d", peak)
+			}
+		})
+	}
+}
+
+func TestFetchListsDeterministic(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/first":
+			time.Sleep(20 * time.Millisecond)
+			w.Write([]byte("^ads\\.\nexample\\.com$\n^tracker\\.\n"))
+		case "/second":
+			w.Write([]byte("^tracker\\.\n^metrics\\.\n(invalid\n"))
+		}
+	}))
+	defer server.Close()
+
+	corefile := `filter {
+		block list regex ` + server.URL + `/first
+		block list regex ` + server.URL + `/second
+	}`
+	var first []string
+	for i := 0; i < 5; i++ {
+		filter := NewTestFilter(t, corefile)
+		filter.Build()
+		var got []string
+		for _, regex := range filter.blockRegex {
+			got = append(got, regex.String())
+		}
+		if i == 0 {
+			first = got
+			if len(first) != 4 {
+				t.Fatalf("expected 4 expressions; got %q", first)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(first, got) {
+			t.Errorf("expected %q; got %q", first, got)
+		}
+	}
+}
+
+func TestSetupListWorkers(t *testing.T) {
+	tests := []TestSetup{
+		{
+			"listworkers",
+			`filter {
+				listworkers 8
+			}`,
+			false,
+		},
+		{
+			"listworkers missing",
+			`filter {
+				listworkers
+			}`,
+			true,
+		},
+		{
+			"listworkers zero",
+			`filter {
+				listworkers 0
+			}`,
+			true,
+		},
+		{
+			"listworkers invalid",
+			`filter {
+				listworkers many
+			}`,
+			true,
+		},
+		{
+			"listworkers extra argument",
+			`filter {
+				listworkers 8 16
+			}`,
+			true,
+		},
+	}
+	for _, test := range tests {
+		RunSetupTest(t, test)
+	}
+}
+
+// testListSource is a list which records whether it was closed, and fails
+// with err once its content is read
+type testListSource struct {
+	io.Reader
+	err    error
+	closed *atomic.Bool
+}
+
+func (s testListSource) Read(p []byte) (int, error) {
+	n, err := s.Reader.Read(p)
+	if err == io.EOF && s.err != nil {
+		return n, s.err
+	}
+	return n, err
+}
+
+func (s testListSource) Close() error {
+	s.closed.Store(true)
+	return nil
+}
+
+// testListLoader loads a testListSource of content
+type testListLoader struct {
+	content string
+	err     error
+	closed  *atomic.Bool
+}
+
+func (l testListLoader) Load(string) (io.ReadCloser, error) {
+	return testListSource{strings.NewReader(l.content), l.err, l.closed}, nil
+}
+
+func TestFetchListsIngest(t *testing.T) {
+	longLine := "||" + strings.Repeat("a", 100*1024) + ".example.com^"
+	tooLong := strings.Repeat("b", maxListLineSize+1)
+	tests := []struct {
+		name    string
+		content string
+		err     error
+		want    []string
+	}{
+		{
+			"crlf",
+			"# comment\r\nexample.com\r\n\r\nexample.net\r\n",
+			nil,
+			[]string{"example.com", "example.net"},
+		},
+		{
+			"line over 64KiB",
+			"example.com\n" + longLine + "\nexample.net",
+			nil,
+			[]string{"example.com", longLine, "example.net"},
+		},
+		{
+			"line over maximum length",
+			"example.com\n" + tooLong + "\nexample.net\n",
+			nil,
+			[]string{"example.com", "example.net"},
+		},
+		{
+			"read error",
+			"example.com\nexample.net\n",
+			errors.New("connection reset"),
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var closed atomic.Bool
+			config := NewActionConfig(ActionTypeBlock)
+			config.lists["domain"] = ActionList{
+				"test://list": testListLoader{tt.content, tt.err, &closed},
+			}
+			rules := newRuleSet()
+			config.buildRules(rules, newRuleSet(), newRuleSet(), nil)
+			domains := rules.domains
+			if !closed.Load() {
+				t.Error("expected list to be closed")
+			}
+			if len(domains) != len(tt.want) {
+				t.Errorf("expected %d domains; got %d", len(tt.want), len(domains))
+			}
+			for _, domain := range tt.want {
+				if !domains[domain] {
+					t.Errorf("expected domain %.32q", domain)
+				}
+			}
+		})
+	}
+}
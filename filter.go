@@ -2,13 +2,16 @@ package filter
 
 import (
 	"context"
+	"net"
 	"net/netip"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/metrics"
 	clog "github.com/coredns/coredns/plugin/pkg/log"
 	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
@@ -23,38 +26,136 @@ type Filter struct {
 
 	sync.RWMutex
 
-	allowConfig    ActionConfig
-	allowDomains   map[string]bool
-	allowRegex     []*regexp.Regexp
-	allowWildcards map[string]bool
-
-	blockConfig    ActionConfig
-	blockDomains   map[string]bool
-	blockRegex     []*regexp.Regexp
-	blockWildcards map[string]bool
-
-	response Response
-
+	allowConfig     ActionConfig
+	allowDomains    map[string]bool
+	allowRegex      []*regexp.Regexp
+	allowWildcards  map[string]bool
+	allowPriorities map[ruleKey]int
+
+	blockConfig     ActionConfig
+	blockDomains    map[string]bool
+	blockRegex      []*regexp.Regexp
+	blockWildcards  map[string]bool
+	blockPriorities map[ruleKey]int
+	blockAnswers    map[string]RespListed
+
+	denyConfig    ActionConfig
+	denyDomains   map[string]bool
+	denyRegex     []*regexp.Regexp
+	denyWildcards map[string]bool
+
+	// auditBlockRules and auditDenyRules are the rules of audited lists
+	auditBlockRules actionRules
+	auditDenyRules  actionRules
+
+	overrideConfig    ActionConfig
+	overrideDomains   map[string]RespListed
+	overrideWildcards map[string]RespListed
+
+	// categories are the named categories of block rules, which are blocked
+	// by categoryBindings. Their compiled rules are categoryRules.
+	categories       map[string]ActionConfig
+	categoryBindings []categoryBinding
+	categoryRules    map[string]actionRules
+
+	// clientID identifies the clients of requests received through trusted
+	// forwarders and proxies
+	clientID clientIdentifier
+
+	// groups and schedules are the named client groups and schedules
+	// categories may be blocked for
+	groups    map[string]clientGroup
+	schedules map[string]schedule
+
+	// newDomains blocks domains first seen recently, if configured
+	newDomains *newDomains
+
+	// dga blocks names that look generated, if configured
+	dga *dgaDetector
+
+	// tunnel blocks the requests of clients tunneling through a domain, if
+	// configured
+	tunnel *tunnelDetector
+
+	// rateLimit limits the rate of responses to blocked requests, if
+	// configured
+	rateLimit *rateLimiter
+
+	precedence Precedence
+	response   Response
+
+	// audit passes requests which would be blocked or denied to the next
+	// plugin
+	audit bool
+
+	// denyResponse is the response to denied domains. The response to blocked
+	// domains is used if it is nil.
+	denyResponse Response
+
+	buildLock      sync.Mutex
 	startupOnce    sync.Once
 	updateInterval time.Duration
+	updateNotify   chan struct{}
 	updateShutdown chan bool
+
+	// notifiedZones are the zones notified since the last update they
+	// triggered. Updates wait notifyDelay after a notification, so that
+	// repeated notifications are refreshed together.
+	notifyLock    sync.Mutex
+	notifiedZones map[string]bool
+	notifyDelay   time.Duration
 }
 
 func newFilter() *Filter {
+	allowConfig := NewActionConfig(ActionTypeAllow)
+	blockConfig := NewActionConfig(ActionTypeBlock)
+	denyConfig := NewActionConfig(ActionTypeDeny)
+	overrideConfig := NewActionConfig(ActionTypeOverride)
+	blockConfig.fetchSlots = allowConfig.fetchSlots
+	denyConfig.fetchSlots = allowConfig.fetchSlots
+	overrideConfig.fetchSlots = allowConfig.fetchSlots
+	// Denials and overrides don't have their own http or listresolver
+	// directives
+	denyConfig.HTTPLoader.Defaults = allowConfig.HTTPLoader.Defaults
+	overrideConfig.HTTPLoader.Defaults = allowConfig.HTTPLoader.Defaults
 	return &Filter{
-		allowConfig:    NewActionConfig(ActionTypeAllow),
-		allowDomains:   make(map[string]bool),
-		allowRegex:     make([]*regexp.Regexp, 0),
-		allowWildcards: make(map[string]bool),
-		blockConfig:    NewActionConfig(ActionTypeBlock),
-		blockDomains:   make(map[string]bool),
-		blockRegex:     make([]*regexp.Regexp, 0),
-		blockWildcards: make(map[string]bool),
+		allowConfig:     allowConfig,
+		allowDomains:    make(map[string]bool),
+		allowRegex:      make([]*regexp.Regexp, 0),
+		allowWildcards:  make(map[string]bool),
+		allowPriorities: make(map[ruleKey]int),
+		blockConfig:     blockConfig,
+		blockDomains:    make(map[string]bool),
+		blockRegex:      make([]*regexp.Regexp, 0),
+		blockWildcards:  make(map[string]bool),
+		blockPriorities: make(map[ruleKey]int),
+		blockAnswers:    make(map[string]RespListed),
+
+		denyConfig:    denyConfig,
+		denyDomains:   make(map[string]bool),
+		denyRegex:     make([]*regexp.Regexp, 0),
+		denyWildcards: make(map[string]bool),
+
+		auditBlockRules: actionRules{action: ActionTypeBlock},
+		auditDenyRules:  actionRules{action: ActionTypeDeny},
+
+		overrideConfig:    overrideConfig,
+		overrideDomains:   make(map[string]RespListed),
+		overrideWildcards: make(map[string]RespListed),
+
+		categories:    make(map[string]ActionConfig),
+		categoryRules: make(map[string]actionRules),
+		groups:        make(map[string]clientGroup),
+		schedules:     make(map[string]schedule),
+
 		response: RespAddress{
 			IP4: netip.IPv4Unspecified(),
 			IP6: netip.IPv6Unspecified(),
 		},
 		updateInterval: 24 * time.Hour,
+		updateNotify:   make(chan struct{}, 1),
+		notifiedZones:  make(map[string]bool),
+		notifyDelay:    5 * time.Second,
 		updateShutdown: make(chan bool),
 	}
 }
@@ -66,29 +167,115 @@ func (f *Filter) Name() string {
 }
 
 // ServeDNS implements the plugin.Handler inteface
-// Checks whether or not the requested domain is allowed or blocked.
-// Allowed domains are passed to the next plugin in the Corefile. Blocked
-// domains return the configured response.
+// Checks whether or not the requested domain is overridden, denied, allowed, or
+// blocked. Overridden domains return their local records. Allowed domains are
+// passed to the next plugin in the Corefile. Denied and blocked domains return
+// their configured responses, unless they're audited, in which case they're
+// logged and passed to the next plugin.
 func (f *Filter) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
 	state := request.Request{W: w, Req: r}
 	qname := strings.TrimSuffix(state.Name(), ".")
 
-	var allowed, blocked bool
+	if r.Opcode == dns.OpcodeNotify && f.isTransferredZone(state) {
+		return f.serveNotify(w, r, qname)
+	}
+
+	client := f.clientID.identify(ctx, state)
+	var winner ruleMatch
+	var matched, audited bool
+	var listed RespListed
 	f.RLock()
-	allowed = f.isAllowed(qname)
-	if !allowed {
-		blocked = f.isBlocked(qname)
+	override, overridden := f.overridden(qname)
+	if !overridden {
+		winner, matched = f.evaluate(qname, client)
+	}
+	if !overridden && (!matched || winner.action == ActionTypeAllow) {
+		if audit, ok := f.evaluateAudit(qname); ok {
+			winner, matched, audited = audit, true, true
+		}
+	}
+	if matched && winner.action == ActionTypeBlock {
+		listed = f.blockAnswers[qname]
 	}
 	f.RUnlock()
 
-	if !allowed && blocked {
-		log.Debugf("blocking %q", qname)
+	if overridden {
+		return f.serveOverride(ctx, state, override)
+	}
+
+	if f.newDomains != nil {
+		// Every request is recorded, though only those which match no other
+		// rule may be blocked as new
+		if match, ok := f.newDomains.match(qname, time.Now()); ok && !matched {
+			winner, matched, audited = match, true, f.newDomains.audit
+		}
+	}
+	if !matched && f.dga != nil {
+		if match, ok := f.dga.match(qname); ok {
+			winner, matched, audited = match, true, f.dga.audit
+		}
+	}
+	if !matched && f.tunnel != nil {
+		match, ok, tripped := f.tunnel.match(qname, client, time.Now())
+		if tripped {
+			log.Warningf(
+				"tunnel: client %s requested %d suspicious subdomains of %q within %s; "+
+					"blocking its requests to %q for %s",
+				client, f.tunnel.subdomains, match.value, f.tunnel.window,
+				match.value, f.tunnel.cooldown,
+			)
+			tunnelCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+		}
+		if ok {
+			winner, matched, audited = match, true, f.tunnel.audit
+		}
+	}
+
+	blocked := matched && winner.action != ActionTypeAllow
+	enforced := blocked && !audited && !f.audit
+	if enforced && f.rateLimit != nil && !f.rateLimit.allow(client, qname, time.Now()) {
+		// Requests over the limit are dropped without a response or logging
+		suppressedCount.WithLabelValues(metrics.WithServer(ctx)).Inc()
+		return dns.RcodeSuccess, nil
+	}
+
+	if matched {
+		log.Debugf("request %q of client %s matched %s", qname, client, winner)
+	}
+	if blocked && !enforced {
+		f.reportWouldBlock(ctx, qname, client, winner)
+		return plugin.NextOrFailure(state.Name(), f.Next, ctx, w, r)
+	}
+	if enforced {
+		log.Debugf("blocking %q of client %s", qname, client)
+		blockedCount.WithLabelValues(
+			metrics.WithServer(ctx),
+			winner.action.String(),
+			winner.category,
+		).Inc()
 		msg := new(dns.Msg)
 		msg.SetReply(r)
 		msg.RecursionAvailable = false
-		response := f.response.Render(state.Name(), state.QType())
+		responder := f.response
+		switch {
+		case winner.action == ActionTypeDeny && f.denyResponse != nil:
+			responder = f.denyResponse
+		case winner.category == tunnelCategory && f.tunnel.refuse:
+			responder = RespRefused{}
+		case len(listed.Addrs) != 0 || listed.Target != "":
+			responder = listed
+		}
+		response := responder.Render(state.Name(), state.QType())
+		if _, ok := responder.(RespRefused); ok {
+			// Other responses are sent with the NOERROR code of SetReply
+			msg.Rcode = response.RCode
+		}
 		msg.Authoritative = response.Authoritative
 		msg.Answer = response.Answer
+		if r.IsEdns0() != nil {
+			msg.SetEdns0(uint16(state.Size()), state.Do())
+			msg.IsEdns0().Option = append(msg.IsEdns0().Option, blockedError(winner))
+		}
 		w.WriteMsg(msg)
 		return response.RCode, nil
 	}
@@ -96,52 +283,47 @@ func (f *Filter) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg)
 	return plugin.NextOrFailure(state.Name(), f.Next, ctx, w, r)
 }
 
-func (f *Filter) isAllowed(qname string) bool {
-	if _, ok := f.allowDomains[qname]; ok {
-		log.Debugf("request %q matched allowed domain", qname)
-		return true
-	}
-
-	if wildcard, ok := matchesAnyWildcard(qname, f.allowWildcards); ok {
-		log.Debugf("request %q matched allow wildcard %q", qname, wildcard)
-		return true
-	}
-
-	// Evaluate regular expressions last, as they're the most expensive
-	for _, exp := range f.allowRegex {
-		if exp.MatchString(qname) {
-			log.Debugf("request %q mached allow regex", qname)
-			return true
-		}
+// blockedError returns the extended DNS error of a blocked or denied request,
+// which names the category of the matched rule
+func blockedError(winner ruleMatch) *dns.EDNS0_EDE {
+	text := winner.action.verb()
+	if winner.category != "" {
+		text += "; category " + winner.category
 	}
-
-	return false
+	return &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeBlocked, ExtraText: text}
 }
 
-func (f *Filter) isBlocked(qname string) bool {
-	if _, ok := f.blockDomains[qname]; ok {
-		log.Debugf("request %q matched blocked domain", qname)
-		return true
-	}
-
-	if wildcard, ok := matchesAnyWildcard(qname, f.blockWildcards); ok {
-		log.Debugf("request %q matched block wildcard %q", qname, wildcard)
-		return true
-	}
+// isTransferredZone reports whether a request is for a zone loaded by zone
+// transfer, sent by the server it is transferred from
+func (f *Filter) isTransferredZone(state request.Request) bool {
+	ip := net.ParseIP(state.IP())
+	return f.allowConfig.AXFRLoader.HasZone(state.Name(), ip) ||
+		f.blockConfig.AXFRLoader.HasZone(state.Name(), ip) ||
+		f.denyConfig.AXFRLoader.HasZone(state.Name(), ip) ||
+		f.overrideConfig.AXFRLoader.HasZone(state.Name(), ip)
+}
 
-	// Evaluate regular expressions last, as they're the most expensive
-	for _, exp := range f.blockRegex {
-		if exp.MatchString(qname) {
-			log.Debugf("request %q matched block regex", qname)
-			return true
-		}
+// serveNotify acknowledges a zone change notification and schedules an update
+// of the zone's lists. Notifications received while an update is already
+// pending are coalesced.
+func (f *Filter) serveNotify(w dns.ResponseWriter, r *dns.Msg, zone string) (int, error) {
+	log.Infof("received notify for zone %q; scheduling update", zone)
+	f.notifyLock.Lock()
+	f.notifiedZones[strings.ToLower(dns.Fqdn(zone))] = true
+	f.notifyLock.Unlock()
+	select {
+	case f.updateNotify <- struct{}{}:
+	default:
 	}
-
-	return false
+	msg := new(dns.Msg)
+	msg.SetReply(r)
+	msg.Authoritative = true
+	w.WriteMsg(msg)
+	return dns.RcodeSuccess, nil
 }
 
-func matchesAnyWildcard(qname string, wildcards map[string]bool) (string, bool) {
-	if wildcards[qname] {
+func matchesAnyWildcard[V any](qname string, wildcards map[string]V) (string, bool) {
+	if _, ok := wildcards[qname]; ok {
 		return qname, true
 	}
 
@@ -150,7 +332,7 @@ func matchesAnyWildcard(qname string, wildcards map[string]bool) (string, bool)
 	for i, c := range qname {
 		if c == '.' {
 			wildcard := qname[i+1:]
-			if wildcards[wildcard] {
+			if _, ok := wildcards[wildcard]; ok {
 				return wildcard, true
 			}
 		}
@@ -160,8 +342,9 @@ func matchesAnyWildcard(qname string, wildcards map[string]bool) (string, bool)
 
 // OnShutdown cleans up the filter and prepares it for removal
 func (f *Filter) OnShutdown() error {
-	if 0 < f.updateInterval {
-		f.updateShutdown <- true
+	close(f.updateShutdown)
+	if f.newDomains != nil {
+		return f.newDomains.stop()
 	}
 	return nil
 }
@@ -169,73 +352,180 @@ func (f *Filter) OnShutdown() error {
 // Build the domain and regular expression lists used to determine how domains
 // are handled
 func (f *Filter) Build() {
-	var allowDomains = make(map[string]bool)
-	f.allowConfig.BuildDomains(allowDomains)
-	f.allowConfig.BuildHosts(allowDomains)
-
-	var blockDomains = make(map[string]bool)
-	f.blockConfig.BuildDomains(blockDomains)
-	f.blockConfig.BuildHosts(blockDomains)
-
-	var allowRegexBuilder = make(map[string]*regexp.Regexp)
-	f.allowConfig.BuildRegExps(allowRegexBuilder)
-	allowRegex := f.consolidateRegex(allowRegexBuilder)
-
-	var blockRegexBuilder = make(map[string]*regexp.Regexp)
-	f.blockConfig.BuildRegExps(blockRegexBuilder)
-	blockRegex := f.consolidateRegex(blockRegexBuilder)
+	f.build(nil)
+}
 
-	var allowWildcards = make(map[string]bool)
-	f.allowConfig.BuildWildcards(allowWildcards)
+// buildNotified rebuilds the filter with the lists transferred from the zones
+// notified since it was last called. Other lists keep their last fetched rules.
+func (f *Filter) buildNotified() {
+	f.notifyLock.Lock()
+	zones := f.notifiedZones
+	f.notifiedZones = make(map[string]bool)
+	f.notifyLock.Unlock()
+	if len(zones) == 0 {
+		return
+	}
+	f.build(func(url string) bool {
+		if !strings.HasPrefix(url, "axfr://") {
+			return false
+		}
+		_, zone, err := parseAXFRURL(url)
+		return err == nil && zones[strings.ToLower(zone)]
+	})
+}
 
-	var blockWildcards = make(map[string]bool)
-	f.blockConfig.BuildWildcards(blockWildcards)
+// build the filter, fetching the lists selected by refresh
+func (f *Filter) build(refresh listRefresh) {
+	f.buildLock.Lock()
+	defer f.buildLock.Unlock()
+
+	allowRules, allowExceptions := newRuleSet(), newRuleSet()
+	blockRules, blockExceptions := newRuleSet(), newRuleSet()
+	denyRules, overrideRules := newRuleSet(), newRuleSet()
+	auditBlock, auditDeny := newRuleSet(), newRuleSet()
+	var categoryRules map[string]actionRules
+
+	// Each action populates its own sets, so they may be built concurrently.
+	// The number of lists fetched at once is limited by the actions' fetch
+	// slots.
+	var wg sync.WaitGroup
+	wg.Add(5)
+	go func() {
+		defer wg.Done()
+		f.allowConfig.buildRules(allowRules, newRuleSet(), allowExceptions, refresh)
+	}()
+	go func() {
+		defer wg.Done()
+		f.blockConfig.buildRules(blockRules, auditBlock, blockExceptions, refresh)
+	}()
+	go func() {
+		defer wg.Done()
+		// Denials and overrides ignore exceptions
+		f.denyConfig.buildRules(denyRules, auditDeny, newRuleSet(), refresh)
+	}()
+	go func() {
+		defer wg.Done()
+		f.overrideConfig.buildRules(overrideRules, newRuleSet(), newRuleSet(), refresh)
+	}()
+	go func() {
+		defer wg.Done()
+		categoryRules = f.buildCategories(refresh)
+	}()
+	wg.Wait()
+
+	// Exceptions of each action's lists are applied by the other action
+	allowRules.merge(blockExceptions)
+	blockRules.merge(allowExceptions)
+
+	allowDomains := allowRules.domains
+	allowRegex := f.consolidateRegex(allowRules.regex)
+	allowWildcards := allowRules.wildcards
+	allowPriorities := allowRules.priorities
+	blockDomains := blockRules.domains
+	blockRegex := f.consolidateRegex(blockRules.regex)
+	blockWildcards := blockRules.wildcards
+	blockPriorities := blockRules.priorities
+	blockAnswers := blockRules.answers
+	denyDomains := denyRules.domains
+	denyRegex := f.consolidateRegex(denyRules.regex)
+	denyWildcards := denyRules.wildcards
+	auditBlockRules := f.newActionRules(ActionTypeBlock, auditBlock)
+	auditDenyRules := f.newActionRules(ActionTypeDeny, auditDeny)
+	overrideDomains := overrideRules.answers
+	overrideWildcards := overrideRules.wildcardAnswers
 
 	f.Lock()
 	f.allowDomains = allowDomains
 	f.allowRegex = allowRegex
 	f.allowWildcards = allowWildcards
+	f.allowPriorities = allowPriorities
 	f.blockDomains = blockDomains
 	f.blockRegex = blockRegex
 	f.blockWildcards = blockWildcards
+	f.blockPriorities = blockPriorities
+	f.blockAnswers = blockAnswers
+	f.denyDomains = denyDomains
+	f.denyRegex = denyRegex
+	f.denyWildcards = denyWildcards
+	f.auditBlockRules = auditBlockRules
+	f.auditDenyRules = auditDenyRules
+	f.overrideDomains = overrideDomains
+	f.overrideWildcards = overrideWildcards
+	f.categoryRules = categoryRules
 	f.Unlock()
 
+	categorySizes := 0
+	for _, rules := range categoryRules {
+		categorySizes += rules.size()
+	}
+
 	log.Infof(
 		"Successfully updated filter; "+
 			"%d allowed domains, %d allowed regular expressions, %d allowed wildcards; "+
-			"%d blocked domains, %d blocked regular expressions, %d blocked wildcards",
+			"%d blocked domains, %d blocked regular expressions, %d blocked wildcards; "+
+			"%d denied domains, %d denied regular expressions, %d denied wildcards; "+
+			"%d audited block rules, %d audited deny rules; "+
+			"%d category rules in %d categories; "+
+			"%d overridden domains, %d overridden wildcards",
 		len(f.allowDomains),
 		len(f.allowRegex),
 		len(f.allowWildcards),
 		len(f.blockDomains),
 		len(f.blockRegex),
 		len(f.blockWildcards),
+		len(f.denyDomains),
+		len(f.denyRegex),
+		len(f.denyWildcards),
+		auditBlockRules.size(),
+		auditDenyRules.size(),
+		categorySizes,
+		len(categoryRules),
+		len(f.overrideDomains),
+		len(f.overrideWildcards),
 	)
 }
 
 func (f *Filter) consolidateRegex(regexes map[string]*regexp.Regexp) []*regexp.Regexp {
+	// Expressions are ordered so that the result doesn't depend on map order
+	expressions := make([]string, 0, len(regexes))
+	for expression := range regexes {
+		expressions = append(expressions, expression)
+	}
+	sort.Strings(expressions)
 	out := make([]*regexp.Regexp, 0, len(regexes))
-	for _, expr := range regexes {
-		out = append(out, expr)
+	for _, expression := range expressions {
+		out = append(out, regexes[expression])
 	}
 	return out
 }
 
-// InitUpdate starts the update timer. This should only be run once on startup.
+// InitUpdate starts the update timer and listens for zone change
+// notifications. This should only be run once on startup.
 func (f *Filter) InitUpdate() error {
-	if f.updateInterval == 0 {
-		return nil
+	var tick <-chan time.Time
+	var ticker *time.Ticker
+	if 0 < f.updateInterval {
+		ticker = time.NewTicker(f.updateInterval)
+		tick = ticker.C
 	}
 
-	tick := time.NewTicker(f.updateInterval)
-
 	go func() {
+		if ticker != nil {
+			defer ticker.Stop()
+		}
 		for {
 			select {
-			case <-tick.C:
+			case <-tick:
 				f.Build()
+			case <-f.updateNotify:
+				// Notifications received while waiting are updated together
+				select {
+				case <-time.After(f.notifyDelay):
+				case <-f.updateShutdown:
+					return
+				}
+				f.buildNotified()
 			case <-f.updateShutdown:
-				tick.Stop()
 				return
 			}
 		}
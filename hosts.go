@@ -1,69 +1,55 @@
 package filter
 
 import (
-	"bufio"
 	"bytes"
+	"fmt"
+	"net/netip"
 	"strings"
-
-	"github.com/coredns/caddy"
 )
 
-func parseActionListHosts(c *caddy.Controller, f *Filter, a ActionType) error {
-	if !c.NextArg() {
-		return c.Errf("no %s hosts list specified", a)
-	}
-	switch a {
-	case ActionTypeAllow:
-		if err := f.allowConfig.AddHostsList(c.Val()); err != nil {
-			return err
-		}
-	case ActionTypeBlock:
-		if err := f.blockConfig.AddHostsList(c.Val()); err != nil {
-			return err
-		}
-	}
-	return ensureEOL(c)
+func init() {
+	RegisterListParser("hosts", ListParserFunc(parseHostsLine))
 }
 
-// AddHostsList to match contents
-func (a ActionConfig) AddHostsList(url string) error {
-	if _, ok := a.hostsLists[url]; !ok {
-		loadFunc, err := a.GetListLoader(url)
-		if err != nil {
-			return err
-		}
-		a.hostsLists[url] = loadFunc
-	}
-	return nil
+// hostsBoilerplate are the names of the local host and network found in most
+// hosts files, which are never filtered
+var hostsBoilerplate = map[string]bool{
+	"0.0.0.0":               true,
+	"broadcasthost":         true,
+	"ip6-allhosts":          true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-localhost":         true,
+	"ip6-localnet":          true,
+	"ip6-loopback":          true,
+	"ip6-mcastprefix":       true,
+	"local":                 true,
+	"localhost":             true,
+	"localhost.localdomain": true,
 }
 
-func (a ActionConfig) BuildHosts(domains map[string]bool) {
-	for domain, loader := range a.hostsLists {
-		file, err := loader.Load(domain)
-		if err != nil {
-			log.Errorf(
-				"there was a problem fetching %s hosts list %q; %s",
-				a.configType,
-				domain,
-				err,
-			)
+// parseHostsLine parses a line of a hosts file, which is an IPv4 or IPv6
+// address followed by one or more names and an optional comment
+func parseHostsLine(line []byte) ([]Rule, error) {
+	if i := bytes.IndexByte(line, '#'); 0 <= i {
+		line = line[:i]
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("expected an address and at least one name; got %q", line)
+	}
+	addr, err := netip.ParseAddr(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q", fields[0])
+	}
+	// Zones such as in 'fe80::1%lo0' are local to the host
+	addr = addr.WithZone("")
+	var rules []Rule
+	for _, name := range fields[1:] {
+		if hostsBoilerplate[strings.ToLower(name)] {
 			continue
 		}
-		defer file.Close()
-		scanner := bufio.NewScanner(file)
-		scanner.Split(bufio.ScanLines)
-		for scanner.Scan() {
-			line := scanner.Bytes()
-			line = bytes.TrimSpace(line)
-			if a.shouldSkip(line) {
-				continue
-			}
-			line = HostsRegexp.ReplaceAll(line, []byte(" "))
-			hostsLine := strings.Split(string(line), " ")
-			if len(hostsLine) != 2 {
-				continue
-			}
-			domains[hostsLine[1]] = true
-		}
+		rules = append(rules, Rule{Kind: RuleExact, Value: name, Address: addr})
 	}
+	return rules, nil
 }
@@ -1,6 +1,15 @@
 package filter
 
-import "testing"
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
 
 func TestHostsListNotProvided(t *testing.T) {
 	test := TestSetup{
@@ -96,3 +105,125 @@ func TestHostsListInvalidScheme(t *testing.T) {
 		RunSetupTest(t, test)
 	}
 }
+
+func TestHostsParseLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    []string
+		addr    string
+		wantErr bool
+	}{
+		{"0.0.0.0 example.com", []string{"example.com"}, "0.0.0.0", false},
+		{"0.0.0.0 example.com example.net", []string{"example.com", "example.net"}, "0.0.0.0", false},
+		{"0.0.0.0\texample.com  # tracker", []string{"example.com"}, "0.0.0.0", false},
+		{"0.0.0.0 example.com#tracker", []string{"example.com"}, "0.0.0.0", false},
+		{":: tracker.example.net", []string{"tracker.example.net"}, "::", false},
+		{"::1 localhost ip6-localhost ip6-loopback", nil, "", false},
+		{"127.0.0.1 localhost localhost.localdomain local", nil, "", false},
+		{"255.255.255.255 broadcasthost", nil, "", false},
+		{"fe80::1%lo0 localhost", nil, "", false},
+		{"0.0.0.0 0.0.0.0", nil, "", false},
+		{"192.0.2.1 LocalHost intranet.example.com", []string{"intranet.example.com"}, "192.0.2.1", false},
+		{"example.com", nil, "", true},
+		{"0.0.0.0 # only a comment", nil, "", true},
+		{"example.com 0.0.0.0", nil, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			rules, err := parseHostsLine([]byte(tt.line))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error: %v, wanterr: %t", err, tt.wantErr)
+			}
+			if len(rules) != len(tt.want) {
+				t.Fatalf("expected %d rules; got %d", len(tt.want), len(rules))
+			}
+			for i, rule := range rules {
+				if rule.Kind != RuleExact || rule.Value != tt.want[i] {
+					t.Errorf("expected exact rule %q; got %s rule %q", tt.want[i], rule.Kind, rule.Value)
+				}
+				if rule.Address != netip.MustParseAddr(tt.addr) {
+					t.Errorf("expected address %s; got %s", tt.addr, rule.Address)
+				}
+			}
+		})
+	}
+}
+
+func TestHostsListedAnswer(t *testing.T) {
+	list := writeTestFile(t, "hosts", []byte(
+		"127.0.0.1 localhost\n"+
+			"::1 localhost\n"+
+			"192.0.2.1 intranet.example.com wiki.example.com # internal\n"+
+			"2001:db8::1 intranet.example.com\n"+
+			"0.0.0.0 tracker.example.net\n",
+	))
+	tests := []struct {
+		name    string
+		options string
+		qname   string
+		qtype   uint16
+		want    []string
+	}{
+		{"listed A", "answer listed", "intranet.example.com.", dns.TypeA, []string{"192.0.2.1"}},
+		{"listed AAAA", "answer listed", "intranet.example.com.", dns.TypeAAAA, []string{"2001:db8::1"}},
+		{"listed second name", "answer listed", "wiki.example.com.", dns.TypeA, []string{"192.0.2.1"}},
+		{"listed without AAAA", "answer listed", "wiki.example.com.", dns.TypeAAAA, nil},
+		{"listed unspecified", "answer listed", "tracker.example.net.", dns.TypeA, []string{"0.0.0.0"}},
+		{"response", "answer response", "intranet.example.com.", dns.TypeA, []string{"0.0.0.0"}},
+		{"default response", "", "intranet.example.com.", dns.TypeAAAA, []string{"::"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := NewTestFilter(t, `filter {
+				block list hosts file://`+list+` {
+					`+tt.options+`
+				}
+			}`)
+			filter.Build()
+			if _, ok := filter.blockDomains["localhost"]; ok {
+				t.Error("expected localhost not to be blocked")
+			}
+			req := new(dns.Msg).SetQuestion(tt.qname, tt.qtype)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			filter.ServeDNS(context.Background(), rec, req)
+			var got []string
+			for _, rr := range rec.Msg.Answer {
+				switch rr := rr.(type) {
+				case *dns.A:
+					got = append(got, rr.A.String())
+				case *dns.AAAA:
+					got = append(got, rr.AAAA.String())
+				}
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("expected answers %v; got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSetupHostsListedAnswer(t *testing.T) {
+	tests := []TestSetup{
+		{
+			"list answer listed",
+			`filter {
+				block list hosts https://example.com/hosts {
+					answer listed
+				}
+			}`,
+			false,
+		},
+		{
+			"list answer invalid",
+			`filter {
+				block list hosts https://example.com/hosts {
+					answer noop
+				}
+			}`,
+			true,
+		},
+	}
+	for _, test := range tests {
+		RunSetupTest(t, test)
+	}
+}
@@ -0,0 +1,229 @@
+package filter
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/coredns/caddy"
+)
+
+// HTTPOptions configure the requests made by an HTTPListLoader. Secrets and
+// certificates are read from files each time a list is fetched, so they may be
+// rotated without reloading CoreDNS.
+type HTTPOptions struct {
+	// Header fields added to every request
+	Header http.Header
+
+	// BearerFile is the path of a file containing a bearer token
+	BearerFile string
+
+	// BasicUser and BasicPasswordFile are the basic authentication user and
+	// the path of a file containing its password
+	BasicUser         string
+	BasicPasswordFile string
+
+	// TLSCert and TLSKey are the paths of a PEM encoded client certificate and
+	// private key
+	TLSCert string
+	TLSKey  string
+
+	// TLSCA is the path of a PEM encoded bundle of certificate authorities
+	// trusted in addition to the system's
+	TLSCA string
+
+	// Proxy is the URL of the proxy used for requests. The proxy environment
+	// variables are used if nil.
+	Proxy *url.URL
+
+	// Resolver resolves the host names of lists and proxies. The system's
+	// resolver is used if nil. Set by the listresolver directive.
+	Resolver ListResolver
+}
+
+// parseHTTPOptions parses an http options block
+func parseHTTPOptions(c *caddy.Controller) (HTTPOptions, error) {
+	opts := HTTPOptions{Header: make(http.Header)}
+	err := parseBlock(c, func(c *caddy.Controller) error {
+		option := c.Val()
+		args := c.RemainingArgs()
+		expected := map[string]int{
+			"header":      2,
+			"bearer_file": 1,
+			"basic_auth":  2,
+			"tls_cert":    2,
+			"tls_ca":      1,
+			"proxy":       1,
+		}
+		count, ok := expected[option]
+		if !ok {
+			return c.Errf(
+				"unknown http option %q; "+
+					"expected 'header', 'bearer_file', 'basic_auth', "+
+					"'tls_cert', 'tls_ca', or 'proxy'",
+				option,
+			)
+		}
+		if len(args) != count {
+			return c.Errf(
+				"unexpected number of http %s arguments %q; expected %d",
+				option,
+				args,
+				count,
+			)
+		}
+		switch option {
+		case "header":
+			opts.Header.Add(args[0], args[1])
+		case "bearer_file":
+			opts.BearerFile = args[0]
+		case "basic_auth":
+			opts.BasicUser = args[0]
+			opts.BasicPasswordFile = args[1]
+		case "tls_cert":
+			opts.TLSCert = args[0]
+			opts.TLSKey = args[1]
+		case "tls_ca":
+			opts.TLSCA = args[0]
+		case "proxy":
+			proxy, err := url.Parse(args[0])
+			if err != nil || len(proxy.Scheme) == 0 || len(proxy.Host) == 0 {
+				return c.Errf("invalid http proxy URL %q", args[0])
+			}
+			opts.Proxy = proxy
+		}
+		return nil
+	})
+	if err != nil {
+		return opts, err
+	}
+	// Read every file once so that configuration errors are reported on setup
+	// rather than on each update
+	if _, err := opts.authorization(); err != nil {
+		return opts, c.Err(err.Error())
+	}
+	if _, err := opts.tlsConfig(); err != nil {
+		return opts, c.Err(err.Error())
+	}
+	return opts, nil
+}
+
+// merge returns the options with the settings of o overriding defaults. Header
+// fields set by o replace fields of the same name in defaults.
+func (o HTTPOptions) merge(defaults *HTTPOptions) HTTPOptions {
+	if defaults == nil {
+		return o
+	}
+	merged := *defaults
+	merged.Header = make(http.Header)
+	for name, values := range defaults.Header {
+		merged.Header[name] = values
+	}
+	for name, values := range o.Header {
+		merged.Header[name] = values
+	}
+	if len(o.BearerFile) != 0 || len(o.BasicUser) != 0 {
+		merged.BearerFile = o.BearerFile
+		merged.BasicUser = o.BasicUser
+		merged.BasicPasswordFile = o.BasicPasswordFile
+	}
+	if len(o.TLSCert) != 0 {
+		merged.TLSCert = o.TLSCert
+		merged.TLSKey = o.TLSKey
+	}
+	if len(o.TLSCA) != 0 {
+		merged.TLSCA = o.TLSCA
+	}
+	if o.Proxy != nil {
+		merged.Proxy = o.Proxy
+	}
+	if o.Resolver != nil {
+		merged.Resolver = o.Resolver
+	}
+	return merged
+}
+
+// apply the header fields and authorization to a request
+func (o HTTPOptions) apply(req *http.Request) error {
+	for name, values := range o.Header {
+		req.Header[textproto.CanonicalMIMEHeaderKey(name)] = values
+	}
+	auth, err := o.authorization()
+	if err != nil {
+		return err
+	}
+	if len(auth) != 0 {
+		req.Header.Set("Authorization", auth)
+	}
+	return nil
+}
+
+// authorization returns the value of the Authorization header, if any
+func (o HTTPOptions) authorization() (string, error) {
+	if len(o.BearerFile) != 0 {
+		token, err := readSecret(o.BearerFile)
+		if err != nil {
+			return "", fmt.Errorf("error reading http bearer token; %w", err)
+		}
+		return "Bearer " + token, nil
+	}
+	if len(o.BasicUser) != 0 {
+		password, err := readSecret(o.BasicPasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("error reading http basic auth password; %w", err)
+		}
+		req := http.Request{Header: make(http.Header)}
+		req.SetBasicAuth(o.BasicUser, password)
+		return req.Header.Get("Authorization"), nil
+	}
+	return "", nil
+}
+
+// tlsConfig returns the TLS client configuration, or nil if the defaults
+// should be used
+func (o HTTPOptions) tlsConfig() (*tls.Config, error) {
+	if len(o.TLSCert) == 0 && len(o.TLSCA) == 0 {
+		return nil, nil
+	}
+	config := &tls.Config{}
+	if len(o.TLSCert) != 0 {
+		cert, err := tls.LoadX509KeyPair(o.TLSCert, o.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("error loading http client certificate; %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if len(o.TLSCA) != 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		bundle, err := os.ReadFile(o.TLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("error reading http certificate authorities; %w", err)
+		}
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf(
+				"error reading http certificate authorities; "+
+					"no certificates found in %q",
+				o.TLSCA,
+			)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// readSecret returns the contents of a file without surrounding whitespace
+func readSecret(path string) (string, error) {
+	secret, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(secret)), nil
+}
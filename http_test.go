@@ -0,0 +1,348 @@
+package filter
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestFile(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return filepath.ToSlash(path)
+}
+
+func TestHTTPOptionsAuthorization(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, basic := r.BasicAuth()
+		switch {
+		case r.Header.Get("Authorization") == "Bearer s3cret":
+		case basic && user == "coredns" && password == "hunter2":
+		case r.Header.Get("X-Api-Key") == "key":
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("example.com\n"))
+	}))
+	defer server.Close()
+
+	bearer := writeTestFile(t, "bearer", []byte("s3cret\n"))
+	password := writeTestFile(t, "password", []byte("hunter2"))
+	tests := []TestFilterBuild{
+		{
+			"check unauthorized",
+			`filter {
+				block list domain ` + server.URL + `
+			}`,
+			true,
+		},
+		{
+			"check global bearer token",
+			`filter {
+				block list domain ` + server.URL + `
+				http {
+					bearer_file ` + bearer + `
+				}
+			}`,
+			false,
+		},
+		{
+			"check list basic auth",
+			`filter {
+				block list domain ` + server.URL + ` {
+					http {
+						basic_auth coredns ` + password + `
+					}
+				}
+			}`,
+			false,
+		},
+		{
+			"check list header",
+			`filter {
+				block list domain ` + server.URL + ` {
+					http {
+						header X-Api-Key key
+					}
+				}
+			}`,
+			false,
+		},
+		{
+			"check list auth overrides global",
+			`filter {
+				http {
+					basic_auth coredns ` + bearer + `
+				}
+				block list domain ` + server.URL + ` {
+					http {
+						bearer_file ` + bearer + `
+					}
+				}
+			}`,
+			false,
+		},
+	}
+	for _, test := range tests {
+		RunFilterBuildTest(t, test)
+	}
+}
+
+// testCertificate returns a PEM encoded certificate and key signed by parent,
+// or self-signed if parent is nil
+func testCertificate(t *testing.T, template *x509.Certificate, parent *tls.Certificate) ([]byte, []byte, tls.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parentCert, parentKey := template, any(key)
+	if parent != nil {
+		parentCert = parent.Leaf
+		parentKey = parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parentCert, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert.Leaf, _ = x509.ParseCertificate(der)
+	return certPEM, keyPEM, cert
+}
+
+func TestHTTPOptionsClientCertificate(t *testing.T) {
+	caPEM, _, ca := testCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test client ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil)
+	clientPEM, clientKeyPEM, _ := testCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "coredns"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}, &ca)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(caPEM)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("example.com\n"))
+	}))
+	server.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	serverCA := writeTestFile(t, "server-ca.pem", pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: server.Certificate().Raw,
+	}))
+	clientCert := writeTestFile(t, "client.pem", clientPEM)
+	clientKey := writeTestFile(t, "client.key", clientKeyPEM)
+
+	tests := []TestFilterBuild{
+		{
+			"check untrusted server",
+			`filter {
+				block list domain ` + server.URL + `
+			}`,
+			true,
+		},
+		{
+			"check missing client certificate",
+			`filter {
+				block list domain ` + server.URL + ` {
+					http {
+						tls_ca ` + serverCA + `
+					}
+				}
+			}`,
+			true,
+		},
+		{
+			"check client certificate",
+			`filter {
+				http {
+					tls_ca ` + serverCA + `
+				}
+				block list domain ` + server.URL + ` {
+					http {
+						tls_cert ` + clientCert + ` ` + clientKey + `
+					}
+				}
+			}`,
+			false,
+		},
+	}
+	for _, test := range tests {
+		RunFilterBuildTest(t, test)
+	}
+}
+
+func TestHTTPOptionsProxy(t *testing.T) {
+	proxied := make(chan string, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied <- r.URL.String()
+		w.Write([]byte("example.com\n"))
+	}))
+	defer proxy.Close()
+
+	filter := NewTestFilter(t, `filter {
+		block list domain http://lists.example/list.txt
+		http {
+			proxy `+proxy.URL+`
+		}
+	}`)
+	filter.Build()
+	if len(filter.blockDomains) != 1 {
+		t.Errorf("expected 1 domain through proxy; got %d", len(filter.blockDomains))
+	}
+	select {
+	case url := <-proxied:
+		if url != "http://lists.example/list.txt" {
+			t.Errorf("expected proxied request for list; got %q", url)
+		}
+	default:
+		t.Error("expected request through proxy")
+	}
+}
+
+func TestHTTPOptionsProxyClosesConnections(t *testing.T) {
+	closed := make(chan struct{}, 1)
+	proxy := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("example.com\n"))
+	}))
+	proxy.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	proxy.Start()
+	defer proxy.Close()
+
+	filter := NewTestFilter(t, `filter {
+		block list domain http://lists.example/list.txt
+		http {
+			proxy `+proxy.URL+`
+		}
+	}`)
+	filter.Build()
+	if len(filter.blockDomains) != 1 {
+		t.Errorf("expected 1 domain through proxy; got %d", len(filter.blockDomains))
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Error("expected the connection to the proxy to be closed after the fetch")
+	}
+}
+
+func TestSetupHTTPOptions(t *testing.T) {
+	secret := writeTestFile(t, "secret", []byte("s3cret"))
+	tests := []TestSetup{
+		{
+			"http options",
+			`filter {
+				http {
+					header User-Agent coredns-filter
+					header X-Api-Key key
+					bearer_file ` + secret + `
+					proxy http://proxy.example:3128
+				}
+			}`,
+			false,
+		},
+		{
+			"http options unknown",
+			`filter {
+				http {
+					noop
+				}
+			}`,
+			true,
+		},
+		{
+			"http options header missing value",
+			`filter {
+				http {
+					header X-Api-Key
+				}
+			}`,
+			true,
+		},
+		{
+			"http options missing bearer file",
+			`filter {
+				http {
+					bearer_file /noop/bearer
+				}
+			}`,
+			true,
+		},
+		{
+			"http options missing client certificate",
+			`filter {
+				block list domain https://example.com/list.txt {
+					http {
+						tls_cert /noop/client.pem /noop/client.key
+					}
+				}
+			}`,
+			true,
+		},
+		{
+			"http options invalid certificate authorities",
+			`filter {
+				http {
+					tls_ca ` + secret + `
+				}
+			}`,
+			true,
+		},
+		{
+			"http options invalid proxy",
+			`filter {
+				http {
+					proxy proxy.example
+				}
+			}`,
+			true,
+		},
+	}
+	for _, test := range tests {
+		RunSetupTest(t, test)
+	}
+}
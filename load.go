@@ -2,18 +2,14 @@ package filter
 
 import (
 	"context"
-	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
-	"net/netip"
 	"net/url"
 	"os"
 	"strings"
 	"time"
-
-	"github.com/coredns/coredns/plugin/pkg/transport"
 )
 
 // ListLoader contains the means to retrieve a list
@@ -21,6 +17,14 @@ type ListLoader interface {
 	Load(string) (io.ReadCloser, error)
 }
 
+// rawListLoader is implemented by loaders of lists that may be compressed.
+// loadRaw returns the list as it was published, without any HTTP content
+// encoding, along with the compression declared by its name, so that it may be
+// verified before decompression.
+type rawListLoader interface {
+	loadRaw(string) (io.ReadCloser, compression, error)
+}
+
 // GetListLoader returns the ListLoader associated with the list's URL scheme
 func (a ActionConfig) GetListLoader(uri string) (ListLoader, error) {
 	listUrl, err := url.Parse(uri)
@@ -44,99 +48,178 @@ func (a ActionConfig) GetListLoader(uri string) (ListLoader, error) {
 			return nil, fmt.Errorf("invalid list URL %q; host empty", uri)
 		}
 		return a.HTTPLoader, nil
+	case "axfr":
+		if _, _, err := parseAXFRURL(uri); err != nil {
+			return nil, err
+		}
+		return a.AXFRLoader, nil
 	default:
 		return nil, fmt.Errorf(
 			"unsupported list URL scheme %q; "+
-				"expected 'file', 'http', or 'https'",
+				"expected 'file', 'http', 'https', or 'axfr'",
 			listUrl.Scheme,
 		)
 	}
 }
 
+// addList with the loader for its URL scheme, wrapped with any list options.
+// Zone transfers of rpz lists include their passthru triggers.
+func (a ActionConfig) addList(lists ActionList, kind, url string, opts ListOptions) error {
+	if _, ok := lists[url]; ok {
+		return nil
+	}
+	loader, err := a.GetListLoader(url)
+	if err != nil {
+		return err
+	}
+	if axfr, ok := loader.(*AXFRListLoader); ok && kind == "rpz" {
+		loader = axfr.rpzLoader()
+	}
+	loader, err = opts.wrap(a, loader)
+	if err != nil {
+		return err
+	}
+	lists[url] = loader
+	return nil
+}
+
 // FileListLoader retrieves lists from the local filesystem
 type FileListLoader struct{}
 
 // Load implements ListLoader
-func (FileListLoader) Load(path string) (io.ReadCloser, error) {
+func (f FileListLoader) Load(path string) (io.ReadCloser, error) {
+	file, declared, err := f.loadRaw(path)
+	if err != nil {
+		return nil, err
+	}
+	list, err := decompress(file, declared)
+	if err != nil {
+		return nil, fmt.Errorf("error opening list %q; %w", path, err)
+	}
+	return list, nil
+}
+
+func (FileListLoader) loadRaw(path string) (io.ReadCloser, compression, error) {
 	trimmedPath := strings.TrimPrefix(path, "file://")
 	file, err := os.Open(trimmedPath)
 	if err != nil {
-		return nil, fmt.Errorf("error opening list %q; %w", path, err)
+		return nil, compressionNone, fmt.Errorf("error opening list %q; %w", path, err)
 	}
-	return file, nil
+	return file, compressionFromName(trimmedPath), nil
 }
 
+// DefaultListTimeout is the maximum time to fetch a remote list if no timeout
+// is configured
+const DefaultListTimeout = 5 * time.Minute
+
+// listTransport is the transport of list requests. It is copied from the
+// default transport, so that lists are fetched even if http.DefaultTransport is
+// replaced.
+var listTransport = http.DefaultTransport.(*http.Transport).Clone()
+
 // HTTPListLoader retrieves lists from remote sources using HTTP/HTTPS
 type HTTPListLoader struct {
-	Network    string
-	ServerName string
-	ResolverIP netip.AddrPort
+	// Timeout is the maximum time to fetch a list, including reading the
+	// response body. Zero uses DefaultListTimeout.
+	Timeout time.Duration
+
+	// HTTP are the request options of a single list, which override Defaults
+	HTTP HTTPOptions
+
+	// Defaults are the request options shared by all lists
+	Defaults *HTTPOptions
 }
 
 // Load implements ListLoader
 func (h HTTPListLoader) Load(path string) (io.ReadCloser, error) {
-	client := &http.Client{}
-	if h.ResolverIP.IsValid() {
-		dialFunc := func(ctx context.Context, network, address string) (net.Conn, error) {
-			d := net.Dialer{
-				Timeout: time.Second * 5,
-			}
-			net, err := h.transportToNetwork(h.Network)
-			if err != nil {
-				// This shouldn't be reached. See default return in
-				// HTTPListLoader.transportToNetwork
-				return nil, err
-			}
-			conn, err := d.DialContext(ctx, net, h.ResolverIP.String())
-			if net == "tcp" {
-				tlsConfig := &tls.Config{
-					ServerName: h.ServerName,
-				}
-				return tls.Client(conn, tlsConfig), err
-			}
-			return conn, err
-		}
-		dialerResolver := &net.Resolver{
-			PreferGo:     true,
-			StrictErrors: true,
-			Dial:         dialFunc,
-		}
-		dialer := &net.Dialer{
-			Resolver: dialerResolver,
+	body, declared, err := h.loadRaw(path)
+	if err != nil {
+		return nil, err
+	}
+	list, err := decompress(body, declared)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching list %q; %w", path, err)
+	}
+	return list, nil
+}
+
+func (h HTTPListLoader) loadRaw(path string) (io.ReadCloser, compression, error) {
+	client := &http.Client{
+		Timeout: h.Timeout,
+	}
+	if client.Timeout == 0 {
+		client.Timeout = DefaultListTimeout
+	}
+	opts := h.HTTP.merge(h.Defaults)
+	tlsConfig, err := opts.tlsConfig()
+	if err != nil {
+		return nil, compressionNone, fmt.Errorf("error fetching list %q; %w", path, err)
+	}
+	var dialCtx func(ctx context.Context, network, addr string) (net.Conn, error)
+	if opts.Resolver != nil {
+		dialCtx = resolverDialer(opts.Resolver)
+	}
+	client.Transport = listTransport
+	// A transport made for a single fetch closes its idle connections once
+	// the fetch is done, since it isn't reused
+	var transport *http.Transport
+	if dialCtx != nil || tlsConfig != nil || opts.Proxy != nil {
+		transport = listTransport.Clone()
+		if dialCtx != nil {
+			transport.DialContext = dialCtx
 		}
-		dialCtx := func(ctx context.Context, network, addr string) (net.Conn, error) {
-			return dialer.DialContext(ctx, network, addr)
+		if tlsConfig != nil {
+			transport.TLSClientConfig = tlsConfig
 		}
-		client.Transport = &http.Transport{
-			DialContext: dialCtx,
+		if opts.Proxy != nil {
+			transport.Proxy = http.ProxyURL(opts.Proxy)
 		}
+		client.Transport = transport
 	}
-	resp, err := client.Get(path)
+	req, err := http.NewRequest(http.MethodGet, path, nil)
 	if err != nil {
-		return nil, fmt.Errorf("error fetching list %q; %w", path, err)
+		return nil, compressionNone, fmt.Errorf("error fetching list %q; %w", path, err)
+	}
+	if err := opts.apply(req); err != nil {
+		return nil, compressionNone, fmt.Errorf("error fetching list %q; %w", path, err)
+	}
+	// Setting Accept-Encoding disables the transport's transparent gzip
+	// decoding, so the content encoding is undone below
+	req.Header.Set("Accept-Encoding", "gzip, zstd")
+	resp, err := client.Do(req)
+	if err != nil {
+		if transport != nil {
+			transport.CloseIdleConnections()
+		}
+		return nil, compressionNone, fmt.Errorf("error fetching list %q; %w", path, err)
+	}
+	if transport != nil {
+		resp.Body = transportBody{ReadCloser: resp.Body, transport: transport}
 	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf(
+		resp.Body.Close()
+		return nil, compressionNone, fmt.Errorf(
 			"an error occurred fetching list %q; %s",
 			path,
 			resp.Status,
 		)
 	}
-	return resp.Body, nil
+	body, err := decodeContent(resp.Body, compressionFromEncoding(resp.Header.Get("Content-Encoding")))
+	if err != nil {
+		return nil, compressionNone, fmt.Errorf("error fetching list %q; %w", path, err)
+	}
+	return body, compressionFromName(resp.Request.URL.Path), nil
 }
 
-// convert the dns transport type to the corresponding network used by a dialer.
-// loadTransport is expected to be a constant from
-// github.com/coredns/coredns/plugin/pkg/transport
-func (h HTTPListLoader) transportToNetwork(loadTransport string) (string, error) {
-	switch loadTransport {
-	case transport.DNS:
-		return "udp", nil
-	case transport.TLS:
-		return "tcp", nil
-	default:
-		// This error shouldn't be reached in normal circumstances since the
-		// Corefile parser only sets DNS or TLS transport
-		return "", fmt.Errorf("unknown listresolver transport %q", loadTransport)
-	}
+// transportBody is a response body that closes the idle connections of its
+// transport when it is closed
+type transportBody struct {
+	io.ReadCloser
+	transport *http.Transport
+}
+
+func (b transportBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.transport.CloseIdleConnections()
+	return err
 }
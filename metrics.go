@@ -0,0 +1,45 @@
+package filter
+
+import (
+	"github.com/coredns/coredns/plugin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// blockedCount is the number of requests blocked or denied. The category
+	// label is empty unless a rule of a category matched.
+	blockedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "filter",
+		Name:      "blocked_requests_total",
+		Help:      "Counter of requests blocked or denied by filter.",
+	}, []string{"server", "action", "category"})
+
+	// wouldBlockCount is the number of audited requests which would have been
+	// blocked or denied
+	wouldBlockCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "filter",
+		Name:      "would_block_requests_total",
+		Help:      "Counter of audited requests which would have been blocked or denied by filter.",
+	}, []string{"server", "action", "category"})
+
+	// tunnelCount is the number of times clients were detected tunneling
+	// through a domain
+	tunnelCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "filter",
+		Name:      "tunnel_detections_total",
+		Help:      "Counter of clients detected tunneling through a domain by filter.",
+	}, []string{"server"})
+
+	// suppressedCount is the number of blocked requests dropped by the rate
+	// limit
+	suppressedCount = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "filter",
+		Name:      "suppressed_requests_total",
+		Help:      "Counter of blocked requests dropped without a response by the filter rate limit.",
+	}, []string{"server"})
+)
@@ -0,0 +1,113 @@
+package filter
+
+import (
+	"fmt"
+	"regexp/syntax"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// idnaProfile converts internationalized names to their ASCII form. Unlike
+// idna.Lookup, underscores and hyphens in any position are accepted, since
+// they're common in lists.
+var idnaProfile = idna.New(
+	idna.MapForLookup(),
+	idna.BidiRule(),
+	idna.Transitional(false),
+	idna.StrictDomainName(false),
+	idna.CheckHyphens(false),
+)
+
+// normalizeName returns a name in the form requests are matched in: lowercase,
+// without a trailing dot, and with internationalized labels in their ASCII
+// (xn--) form
+func normalizeName(name string) (string, error) {
+	name = strings.TrimSuffix(name, ".")
+	for i := 0; i < len(name); i++ {
+		if name[i] >= utf8.RuneSelf {
+			ascii, err := idnaProfile.ToASCII(name)
+			if err != nil {
+				return "", fmt.Errorf("invalid internationalized name %q; %w", name, err)
+			}
+			return ascii, nil
+		}
+	}
+	return strings.ToLower(name), nil
+}
+
+// normalizeRule normalizes the domain and canonical name of an exact or suffix
+// rule. Regex rules are returned unchanged, and rejected if they can't match a
+// normalized name.
+func normalizeRule(rule Rule) (Rule, error) {
+	if rule.Kind == RuleRegex {
+		return rule, checkRegexLiterals(rule.Value)
+	}
+	value, err := normalizeName(rule.Value)
+	if err != nil {
+		return rule, err
+	}
+	rule.Value = value
+	if rule.Target != "" {
+		target, err := normalizeName(rule.Target)
+		if err != nil {
+			return rule, err
+		}
+		rule.Target = target
+	}
+	return rule, nil
+}
+
+// normalizeRules normalizes each rule of a line of a list
+func normalizeRules(rules []Rule) ([]Rule, error) {
+	for i, rule := range rules {
+		normal, err := normalizeRule(rule)
+		if err != nil {
+			return nil, err
+		}
+		rules[i] = normal
+	}
+	return rules, nil
+}
+
+// checkRegexLiterals returns an error if a regular expression has a literal
+// character that never appears in a normalized name: an uppercase letter that
+// isn't matched case-insensitively, or a non-ASCII character. Character classes
+// aren't checked.
+func checkRegexLiterals(expr string) error {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return err
+	}
+	return checkLiterals(re)
+}
+
+func checkLiterals(re *syntax.Regexp) error {
+	if re.Op == syntax.OpLiteral {
+		for _, r := range re.Rune {
+			if r >= utf8.RuneSelf {
+				return fmt.Errorf(
+					"regular expression has non-ASCII character %q; names are matched in their ASCII (xn--) form",
+					r,
+				)
+			}
+			if unicode.IsUpper(r) && re.Flags&syntax.FoldCase == 0 {
+				return fmt.Errorf("regular expression has uppercase character %q; names are matched in lowercase", r)
+			}
+		}
+	}
+	for _, sub := range re.Sub {
+		if err := checkLiterals(sub); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validName reports whether a name is a valid domain once normalized
+func validName(name string) bool {
+	normal, err := normalizeName(name)
+	return err == nil && DNSNameRegexp.MatchString(normal)
+}
@@ -0,0 +1,115 @@
+package filter
+
+import "testing"
+
+func TestNormalizeName(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{"example.com", "example.com", false},
+		{"Example.COM", "example.com", false},
+		{"example.com.", "example.com", false},
+		{"_dmarc.example.com", "_dmarc.example.com", false},
+		{"r3---sn-abc.googlevideo.com", "r3---sn-abc.googlevideo.com", false},
+		{"xn--bcher-kva.example", "xn--bcher-kva.example", false},
+		{"bücher.example", "xn--bcher-kva.example", false},
+		{"BÜCHER.Example", "xn--bcher-kva.example", false},
+		{"münchen.de.", "xn--mnchen-3ya.de", false},
+		{"faß.de", "xn--fa-hia.de", false},
+		{"пример.рф", "xn--e1afmkfd.xn--p1ai", false},
+		{"١٢a.example", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := normalizeName(tt.name)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error: %v, wanterr: %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("expected %q; got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestNormalizeRule(t *testing.T) {
+	rule, err := normalizeRule(Rule{Kind: RuleExact, Value: "Media.Home", Target: "NAS.home."})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.Value != "media.home" || rule.Target != "nas.home" {
+		t.Errorf("expected media.home CNAME nas.home; got %s CNAME %s", rule.Value, rule.Target)
+	}
+	rule, err = normalizeRule(Rule{Kind: RuleRegex, Value: `^ads\.`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule.Value != `^ads\.` {
+		t.Errorf("expected regex rule to be unchanged; got %q", rule.Value)
+	}
+}
+
+func TestCheckRegexLiterals(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr bool
+	}{
+		{`^ads\.example\.com$`, false},
+		{`^xn--bcher-kva\.`, false},
+		{`^[A-Za-z0-9]+\.example$`, false},
+		{`\S+\.example\W`, false},
+		{`(?i)^Ads\.`, false},
+		{`^Ads\.`, true},
+		{`tracker\.Example`, true},
+		{`^bücher\.`, true},
+		{`(?i)^bücher\.`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			err := checkRegexLiterals(tt.expr)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error: %v, wanterr: %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNormalizeListEntries(t *testing.T) {
+	domains := writeTestFile(t, "domains", []byte(
+		"Example.COM\n"+
+			"bücher.example\n"+
+			"Tracker.Example.NET.\n",
+	))
+	hosts := writeTestFile(t, "hosts", []byte(
+		"0.0.0.0 ADS.example.org Пример.рф\n",
+	))
+	wildcards := writeTestFile(t, "wildcards", []byte(
+		"||Metrics.Example.IO^\n"+
+			"*.münchen.de\n",
+	))
+	corefile := `filter {
+		block domain Inline.Example.com
+		block wildcard *.Straße.example
+		allow domain SAFE.münchen.de
+		block list domain file://` + domains + `
+		block list hosts file://` + hosts + `
+		block list wildcard file://` + wildcards + `
+	}`
+	tests := []TestFilterRequest{
+		{"check mixed case inline", "inline.example.com", true},
+		{"check unicode inline wildcard", "www.xn--strae-oqa.example", true},
+		{"check mixed case list", "example.com", true},
+		{"check mixed case query", "EXAMPLE.com", true},
+		{"check unicode list", "xn--bcher-kva.example", true},
+		{"check trailing dot list", "tracker.example.net", true},
+		{"check mixed case hosts", "ads.example.org", true},
+		{"check unicode hosts", "xn--e1afmkfd.xn--p1ai", true},
+		{"check mixed case wildcard", "a.metrics.example.io", true},
+		{"check unicode wildcard", "www.xn--mnchen-3ya.de", true},
+		{"check unicode allow", "safe.xn--mnchen-3ya.de", false},
+		{"check unlisted", "example.net", false},
+	}
+	RunFilterTests(t, corefile, tests)
+}
@@ -0,0 +1,361 @@
+package filter
+
+import (
+	"bufio"
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/caddy"
+	"golang.org/x/net/publicsuffix"
+)
+
+// newDomainsCategory is the category reported for newly seen domains
+const newDomainsCategory = "newdomains"
+
+// newDomains blocks registrable domains first seen by the filter recently
+type newDomains struct {
+	// window is how long a domain is new after it is first seen
+	window time.Duration
+
+	// learn is how long domains are recorded by a new store before any are
+	// considered new, since every domain is new to an empty store
+	learn time.Duration
+
+	// audit logs and counts requests for new domains instead of blocking them
+	audit bool
+
+	store        *domainStore
+	path         string
+	saveInterval time.Duration
+}
+
+func parseNewDomains(c *caddy.Controller, f *Filter) error {
+	if f.newDomains != nil {
+		return c.Err("newdomains is already configured")
+	}
+	nd := &newDomains{
+		window:       24 * time.Hour,
+		learn:        -1,
+		saveInterval: time.Hour,
+	}
+	capacity := 50000
+	err := parseBlock(c, func(c *caddy.Controller) error {
+		option := c.Val()
+		if !c.NextArg() {
+			return c.Errf("no value specified for newdomains option %q", option)
+		}
+		switch option {
+		case "window", "learn", "save":
+			duration, err := time.ParseDuration(c.Val())
+			// Only learning may be skipped
+			if err != nil || duration < 0 || (duration == 0 && option != "learn") {
+				return c.Errf("invalid newdomains %s %q; expected a positive duration", option, c.Val())
+			}
+			switch option {
+			case "window":
+				nd.window = duration
+			case "learn":
+				nd.learn = duration
+			case "save":
+				nd.saveInterval = duration
+			}
+		case "store":
+			nd.path = c.Val()
+		case "capacity":
+			count, err := strconv.Atoi(c.Val())
+			if err != nil || count < 1 {
+				return c.Errf("invalid newdomains capacity %q; expected a positive integer", c.Val())
+			}
+			capacity = count
+		case "mode":
+			switch c.Val() {
+			case "audit":
+				nd.audit = true
+			case "enforce":
+				nd.audit = false
+			default:
+				return c.Errf("invalid newdomains mode %q; expected 'audit' or 'enforce'", c.Val())
+			}
+		default:
+			return c.Errf(
+				"unknown newdomains option %q; "+
+					"expected 'window', 'learn', 'store', 'capacity', 'save', or 'mode'",
+				option,
+			)
+		}
+		return ensureEOL(c)
+	})
+	if err != nil {
+		return err
+	}
+	if nd.learn < 0 {
+		nd.learn = nd.window
+	}
+	nd.store = newDomainStore(capacity, time.Now())
+	f.newDomains = nd
+	return nil
+}
+
+// registrableDomain returns the domain of a name registered under a public
+// suffix, such as 'example.co.uk' for 'www.example.co.uk'. Names under suffixes
+// which aren't in the public suffix list, such as 'nas.home', and reverse
+// lookups aren't registered, so they aren't tracked.
+func registrableDomain(qname string) (string, bool) {
+	suffix, icann := publicsuffix.PublicSuffix(qname)
+	// Suffixes which aren't listed are returned as the last label
+	if !icann && !strings.Contains(suffix, ".") {
+		return "", false
+	}
+	if suffix == "arpa" || strings.HasSuffix(suffix, ".arpa") {
+		return "", false
+	}
+	domain, err := publicsuffix.EffectiveTLDPlusOne(qname)
+	if err != nil {
+		return "", false
+	}
+	return domain, true
+}
+
+// match records a request and returns a match if its registrable domain was
+// first seen within the window
+func (nd *newDomains) match(qname string, now time.Time) (ruleMatch, bool) {
+	domain, ok := registrableDomain(qname)
+	if !ok {
+		return ruleMatch{}, false
+	}
+	first, learning := nd.store.observe(domain, now, nd.learn, nd.window)
+	if learning || nd.window <= now.Sub(first) {
+		return ruleMatch{}, false
+	}
+	return ruleMatch{
+		action:   ActionTypeBlock,
+		kind:     RuleSuffix,
+		value:    domain,
+		category: newDomainsCategory,
+	}, true
+}
+
+// start loads the store and saves it periodically until shutdown
+func (nd *newDomains) start(shutdown <-chan bool) {
+	if nd.path == "" {
+		return
+	}
+	if err := nd.store.load(nd.path); err != nil {
+		log.Warningf("error loading newdomains store %q; starting a new store; %s", nd.path, err)
+	} else {
+		log.Infof("loaded %d domains from newdomains store %q", nd.store.len(), nd.path)
+	}
+	go func() {
+		ticker := time.NewTicker(nd.saveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := nd.store.save(nd.path); err != nil {
+					log.Errorf("error saving newdomains store %q; %s", nd.path, err)
+				}
+			case <-shutdown:
+				return
+			}
+		}
+	}()
+}
+
+// stop saves the store
+func (nd *newDomains) stop() error {
+	if nd.path == "" {
+		return nil
+	}
+	return nd.store.save(nd.path)
+}
+
+// domainStore records when domains were first seen. It holds at most capacity
+// domains. When it's full, the domain seen least recently is only evicted if
+// it wasn't seen within the window; otherwise new domains aren't recorded, so a
+// flood of new names can't make the domains in use new again.
+type domainStore struct {
+	lock     sync.Mutex
+	capacity int
+
+	// created is when the store began recording domains
+	created time.Time
+
+	// order holds *seenDomain, from the most recently seen
+	order   *list.List
+	domains map[string]*list.Element
+}
+
+type seenDomain struct {
+	name        string
+	first, last time.Time
+}
+
+func newDomainStore(capacity int, created time.Time) *domainStore {
+	return &domainStore{
+		capacity: capacity,
+		created:  created,
+		order:    list.New(),
+		domains:  make(map[string]*list.Element),
+	}
+}
+
+// observe records that a domain was seen and returns when it was first seen.
+// A domain that isn't recorded because the store is full is first seen now.
+// The store is learning if it was created less than learn ago.
+func (s *domainStore) observe(name string, now time.Time, learn, window time.Duration) (time.Time, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	learning := now.Sub(s.created) < learn
+	if elem, ok := s.domains[name]; ok {
+		seen := elem.Value.(*seenDomain)
+		if seen.last.Before(now) {
+			seen.last = now
+		}
+		s.order.MoveToFront(elem)
+		return seen.first, learning
+	}
+	if s.capacity <= s.order.Len() {
+		oldest := s.order.Back().Value.(*seenDomain)
+		if now.Sub(oldest.last) < window {
+			return now, learning
+		}
+	}
+	s.add(&seenDomain{name: name, first: now, last: now})
+	return now, learning
+}
+
+// add inserts a domain as the most recently seen, evicting the least recently
+// seen domain if the store is full. The store must be locked.
+func (s *domainStore) add(seen *seenDomain) {
+	if elem, ok := s.domains[seen.name]; ok {
+		s.order.Remove(elem)
+	}
+	s.domains[seen.name] = s.order.PushFront(seen)
+	for s.capacity < s.order.Len() {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.domains, oldest.Value.(*seenDomain).name)
+	}
+}
+
+// len returns the number of domains in the store
+func (s *domainStore) len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.order.Len()
+}
+
+// domainStoreHeader begins a store file, followed by the version of its format
+// and when the store was created
+const domainStoreHeader = "filter-newdomains"
+
+// write writes the store as text. The first line is the header, and each
+// following line is a domain and the Unix times it was first and last seen,
+// from the least recently seen.
+func (s *domainStore) write(w io.Writer) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	buf := bufio.NewWriter(w)
+	fmt.Fprintf(buf, "%s 1 %d\n", domainStoreHeader, s.created.Unix())
+	for elem := s.order.Back(); elem != nil; elem = elem.Prev() {
+		seen := elem.Value.(*seenDomain)
+		fmt.Fprintf(buf, "%s %d %d\n", seen.name, seen.first.Unix(), seen.last.Unix())
+	}
+	return buf.Flush()
+}
+
+// read replaces the store's domains with those written by write. If the file
+// holds more domains than the store's capacity, the most recently seen are
+// kept.
+func (s *domainStore) read(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+		return errors.New("missing header")
+	}
+	header := strings.Fields(scanner.Text())
+	if len(header) != 3 || header[0] != domainStoreHeader {
+		return errors.New("invalid header")
+	}
+	if header[1] != "1" {
+		return fmt.Errorf("unsupported version %q", header[1])
+	}
+	created, err := strconv.ParseInt(header[2], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid creation time %q", header[2])
+	}
+
+	loaded := newDomainStore(s.capacity, time.Unix(created, 0))
+	for number := 2; scanner.Scan(); number++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 {
+			return fmt.Errorf("line %d: expected DOMAIN FIRST LAST", number)
+		}
+		first, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("line %d: invalid first seen time %q", number, fields[1])
+		}
+		last, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("line %d: invalid last seen time %q", number, fields[2])
+		}
+		loaded.add(&seenDomain{
+			name:  fields[0],
+			first: time.Unix(first, 0),
+			last:  time.Unix(last, 0),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.created = loaded.created
+	s.order = loaded.order
+	s.domains = loaded.domains
+	return nil
+}
+
+// load reads the store from a file. A store that hasn't been saved yet is
+// left empty.
+func (s *domainStore) load(path string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return s.read(file)
+}
+
+// save writes the store to a temporary file which replaces the file at path,
+// so that an interrupted save doesn't corrupt the store
+func (s *domainStore) save(path string) error {
+	temp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if err := s.write(temp); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
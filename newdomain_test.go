@@ -0,0 +1,407 @@
+package filter
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRegistrableDomain(t *testing.T) {
+	tests := []struct {
+		qname  string
+		want   string
+		wantOk bool
+	}{
+		{"www.example.com", "example.com", true},
+		{"example.com", "example.com", true},
+		{"a.b.example.co.uk", "example.co.uk", true},
+		{"user.github.io", "user.github.io", true},
+		{"com", "", false},
+		{"nas.home", "", false},
+		{"printer.lan", "", false},
+		{"1.2.0.192.in-addr.arpa", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.qname, func(t *testing.T) {
+			got, ok := registrableDomain(tt.qname)
+			if ok != tt.wantOk || got != tt.want {
+				t.Errorf("expected %q, %t; got %q, %t", tt.want, tt.wantOk, got, ok)
+			}
+		})
+	}
+}
+
+func TestDomainStoreObserve(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	window := time.Hour
+	store := newDomainStore(2, start)
+	store.observe("a.example", start, 0, window)
+	store.observe("b.example", start.Add(time.Minute), 0, window)
+	first, _ := store.observe("a.example", start.Add(2*time.Minute), 0, window)
+	if !first.Equal(start) {
+		t.Errorf("expected a.example first seen at %s; got %s", start, first)
+	}
+	// b.example was seen within the window, so c.example isn't recorded
+	now := start.Add(3 * time.Minute)
+	if first, _ := store.observe("c.example", now, 0, window); !first.Equal(now) {
+		t.Errorf("expected c.example first seen at %s; got %s", now, first)
+	}
+	if _, ok := store.domains["c.example"]; ok {
+		t.Error("expected c.example not to be recorded")
+	}
+	// b.example is the least recently seen and wasn't seen within the window,
+	// so it is evicted
+	store.observe("a.example", start.Add(time.Hour), 0, window)
+	store.observe("c.example", start.Add(2*time.Hour), 0, window)
+	if store.len() != 2 {
+		t.Fatalf("expected 2 domains; got %d", store.len())
+	}
+	later := start.Add(3 * time.Hour)
+	if first, _ := store.observe("b.example", later, 0, window); !first.Equal(later) {
+		t.Errorf("expected evicted b.example to be first seen again at %s; got %s", later, first)
+	}
+
+	if _, learning := store.observe("a.example", start.Add(time.Hour), 2*time.Hour, window); !learning {
+		t.Error("expected store to be learning")
+	}
+	if _, learning := store.observe("a.example", start.Add(2*time.Hour), 2*time.Hour, window); learning {
+		t.Error("expected store to have finished learning")
+	}
+}
+
+func TestDomainStoreFull(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	nd := &newDomains{window: 24 * time.Hour, store: newDomainStore(3, start)}
+	known := []string{"a.com", "b.com", "c.com"}
+	for _, name := range known {
+		nd.match(name, start)
+	}
+	now := start.Add(2 * nd.window)
+	for _, name := range known {
+		if _, ok := nd.match(name, now); ok {
+			t.Fatalf("expected %s not to be new", name)
+		}
+	}
+	// a flood of new domains must not evict the known domains in use
+	for i := 0; i < 100; i++ {
+		now = now.Add(time.Second)
+		if _, ok := nd.match(fmt.Sprintf("new%d.com", i), now); !ok {
+			t.Errorf("expected new%d.com to be new", i)
+		}
+	}
+	for _, name := range known {
+		if _, ok := nd.match(name, now); ok {
+			t.Errorf("expected known %s not to be blocked", name)
+		}
+	}
+}
+
+func TestDomainStoreReadWrite(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	store := newDomainStore(10, start)
+	store.observe("a.example", start, 0, time.Hour)
+	store.observe("b.example", start.Add(time.Minute), 0, time.Hour)
+	store.observe("c.example", start.Add(2*time.Minute), 0, time.Hour)
+	var buf bytes.Buffer
+	if err := store.write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := "filter-newdomains 1 1700000000\n" +
+		"a.example 1700000000 1700000000\n" +
+		"b.example 1700000060 1700000060\n" +
+		"c.example 1700000120 1700000120\n"
+	if buf.String() != want {
+		t.Fatalf("expected:\n%s\ngot:\n%s", want, buf.String())
+	}
+
+	// A smaller store keeps the most recently seen domains
+	loaded := newDomainStore(2, time.Now())
+	if err := loaded.read(strings.NewReader(want)); err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.created.Equal(start) {
+		t.Errorf("expected store created at %s; got %s", start, loaded.created)
+	}
+	if loaded.len() != 2 {
+		t.Fatalf("expected 2 domains; got %d", loaded.len())
+	}
+	if _, ok := loaded.domains["a.example"]; ok {
+		t.Error("expected a.example to be evicted")
+	}
+	first, _ := loaded.observe("c.example", time.Now(), 0, time.Hour)
+	if !first.Equal(start.Add(2 * time.Minute)) {
+		t.Errorf("expected c.example first seen at %s; got %s", start.Add(2*time.Minute), first)
+	}
+}
+
+func TestDomainStoreReadInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"empty", ""},
+		{"header", "noop 1 1700000000\n"},
+		{"version", "filter-newdomains 2 1700000000\n"},
+		{"created", "filter-newdomains 1 noop\n"},
+		{"fields", "filter-newdomains 1 1700000000\na.example 1700000000\n"},
+		{"first", "filter-newdomains 1 1700000000\na.example noop 1700000000\n"},
+		{"last", "filter-newdomains 1 1700000000\na.example 1700000000 noop\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newDomainStore(10, time.Now())
+			store.observe("kept.example", time.Now(), 0, time.Hour)
+			if err := store.read(strings.NewReader(tt.data)); err == nil {
+				t.Error("expected error")
+			}
+			if store.len() != 1 {
+				t.Error("expected store to be unchanged")
+			}
+		})
+	}
+}
+
+func TestDomainStoreSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "newdomains")
+	start := time.Unix(1700000000, 0)
+
+	missing := newDomainStore(10, start)
+	if err := missing.load(path); err != nil {
+		t.Errorf("expected missing store to be empty; got %s", err)
+	}
+
+	store := newDomainStore(10, start)
+	store.observe("a.example", start, 0, time.Hour)
+	if err := store.save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded := newDomainStore(10, time.Now())
+	if err := loaded.load(path); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.len() != 1 || !loaded.created.Equal(start) {
+		t.Errorf("expected saved store; got %d domains created at %s", loaded.len(), loaded.created)
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only the store file; got %d files", len(entries))
+	}
+}
+
+func TestNewDomains(t *testing.T) {
+	corefile := `filter {
+		newdomains {
+			window 24h
+			learn 0s
+		}
+		allow domain www.allowed.com
+		block domain www.blocked.net
+	}`
+	filter := NewTestFilter(t, corefile)
+	filter.Build()
+	// Domains seen before the window aren't new
+	old := time.Now().Add(-48 * time.Hour)
+	filter.newDomains.store.observe("old.com", old, 0, time.Hour)
+	tests := []TestFilterRequest{
+		{"check new domain", "www.new.com", true},
+		{"check new domain allowed", "www.allowed.com", false},
+		{"check old domain", "www.old.com", false},
+		{"check unregistered name", "nas.home", false},
+		{"check blocked domain", "www.blocked.net", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.Name, func(t *testing.T) {
+			req := new(dns.Msg).SetQuestion(dns.Fqdn(tt.QName), dns.TypeA)
+			req.SetEdns0(4096, false)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			filter.ServeDNS(context.Background(), rec, req)
+			if blocked := len(rec.Msg.Answer) != 0; blocked != tt.WantBlock {
+				t.Errorf("expected blocked %t; got %t", tt.WantBlock, blocked)
+			}
+		})
+	}
+
+	// Requests which match other rules are still recorded
+	if _, ok := filter.newDomains.store.domains["blocked.net"]; !ok {
+		t.Error("expected blocked request to be recorded")
+	}
+}
+
+func TestNewDomainsLearning(t *testing.T) {
+	filter := NewTestFilter(t, `filter {
+		newdomains
+	}`)
+	filter.Build()
+	req := new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	filter.ServeDNS(context.Background(), rec, req)
+	if len(rec.Msg.Answer) != 0 {
+		t.Error("expected new domains not to be blocked while learning")
+	}
+}
+
+func TestNewDomainsAudit(t *testing.T) {
+	filter := NewTestFilter(t, `filter {
+		newdomains {
+			learn 0s
+			mode audit
+		}
+	}`)
+	filter.Build()
+	before := testutil.ToFloat64(wouldBlockCount.WithLabelValues("", "block", newDomainsCategory))
+	req := new(dns.Msg).SetQuestion("www.audit.example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	filter.ServeDNS(context.Background(), rec, req)
+	if len(rec.Msg.Answer) != 0 {
+		t.Error("expected audited new domain not to be blocked")
+	}
+	after := testutil.ToFloat64(wouldBlockCount.WithLabelValues("", "block", newDomainsCategory))
+	if after-before != 1 {
+		t.Errorf("expected would block count to increase by 1; got %v", after-before)
+	}
+}
+
+func TestNewDomainsPersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "newdomains")
+	corefile := `filter {
+		newdomains {
+			store ` + path + `
+			save 1h
+		}
+	}`
+	filter := NewTestFilter(t, corefile)
+	filter.newDomains.start(filter.updateShutdown)
+	filter.newDomains.store.observe("example.com", time.Now(), 0, time.Hour)
+	if err := filter.OnShutdown(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := NewTestFilter(t, corefile)
+	restarted.newDomains.start(restarted.updateShutdown)
+	defer restarted.OnShutdown()
+	if restarted.newDomains.store.len() != 1 {
+		t.Errorf("expected 1 persisted domain; got %d", restarted.newDomains.store.len())
+	}
+}
+
+func TestSetupNewDomains(t *testing.T) {
+	tests := []TestSetup{
+		{
+			"newdomains",
+			`filter {
+				newdomains
+			}`,
+			false,
+		},
+		{
+			"newdomains invalid learn",
+			`filter {
+				newdomains {
+					learn 7d
+				}
+			}`,
+			true,
+		},
+		{
+			"newdomains options",
+			`filter {
+				newdomains {
+					window 12h
+					learn 168h
+					store /var/lib/coredns/newdomains
+					capacity 10000
+					save 30m
+					mode audit
+				}
+			}`,
+			false,
+		},
+		{
+			"newdomains duplicate",
+			`filter {
+				newdomains
+				newdomains
+			}`,
+			true,
+		},
+		{
+			"newdomains no value",
+			`filter {
+				newdomains {
+					window
+				}
+			}`,
+			true,
+		},
+		{
+			"newdomains zero window",
+			`filter {
+				newdomains {
+					window 0s
+				}
+			}`,
+			true,
+		},
+		{
+			"newdomains invalid capacity",
+			`filter {
+				newdomains {
+					capacity 0
+				}
+			}`,
+			true,
+		},
+		{
+			"newdomains invalid mode",
+			`filter {
+				newdomains {
+					mode noop
+				}
+			}`,
+			true,
+		},
+		{
+			"newdomains unknown option",
+			`filter {
+				newdomains {
+					noop 1
+				}
+			}`,
+			true,
+		},
+		{
+			"newdomains extra argument",
+			`filter {
+				newdomains {
+					window 1h 2h
+				}
+			}`,
+			true,
+		},
+		{
+			"newdomains reserved category",
+			`filter {
+				category newdomains {
+					domain example.com
+				}
+			}`,
+			true,
+		},
+	}
+	for _, test := range tests {
+		RunSetupTest(t, test)
+	}
+}
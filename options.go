@@ -0,0 +1,419 @@
+package filter
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/caddy"
+)
+
+// maxSignatureSize limits how much of a detached signature is read
+const maxSignatureSize = 64 * 1024
+
+// ListOptions are the per-list settings declared in a list's options block
+type ListOptions struct {
+	// SignatureURL is the location of a detached signature of the list
+	SignatureURL string
+
+	// Verifier verifies the list's signature using the configured public key
+	Verifier SignatureVerifier
+
+	// MaxSize is the maximum size of the list in bytes, both as published and
+	// after decompression. Zero is unlimited.
+	MaxSize int64
+
+	// MaxEntries is the maximum number of entries in the list, excluding
+	// comments and empty lines. Zero is unlimited.
+	MaxEntries int
+
+	// Timeout is the maximum time to fetch a remote list, including reading
+	// the response body. Zero uses DefaultListTimeout.
+	Timeout time.Duration
+
+	// SHA256 is the expected digest of the list file as published, without
+	// any HTTP content encoding
+	SHA256 []byte
+
+	// HTTP are the request options of an http or https list
+	HTTP *HTTPOptions
+
+	// ListedAnswer answers blocked requests with the addresses listed for
+	// their domains, such as in a hosts file, instead of the filter's response
+	ListedAnswer bool
+
+	// Priority of the list's rules when the filter's precedence is 'priority'.
+	// Rules of higher priority win.
+	Priority int
+
+	// Audit logs and counts requests the list's rules would block or deny,
+	// but passes them to the next plugin
+	Audit bool
+}
+
+// parseBlock calls fn for each directive of an options block opened at the end
+// of the current line. fn is called with the directive as the current token
+// and must consume the directive's arguments. Lines without a block must end
+// after the current token.
+func parseBlock(c *caddy.Controller, fn func(c *caddy.Controller) error) error {
+	if !c.NextArg() {
+		return nil
+	}
+	if c.Val() != "{" {
+		return errorExpectedEOL{data: append([]string{c.Val()}, c.RemainingArgs()...)}
+	}
+	for c.Next() {
+		if c.Val() == "}" {
+			return nil
+		}
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+	return c.Err("unexpected end of options block; expected '}'")
+}
+
+// parseListOptions parses the optional block following a list URL
+func parseListOptions(c *caddy.Controller) (ListOptions, error) {
+	var opts ListOptions
+	var publicKey string
+	err := parseBlock(c, func(c *caddy.Controller) error {
+		option := c.Val()
+		if option == "http" {
+			httpOpts, err := parseHTTPOptions(c)
+			if err != nil {
+				return err
+			}
+			opts.HTTP = &httpOpts
+			return nil
+		}
+		if !c.NextArg() {
+			return c.Errf("no value specified for list option %q", option)
+		}
+		switch option {
+		case "signature":
+			opts.SignatureURL = c.Val()
+		case "pubkey":
+			publicKey = c.Val()
+		case "maxsize":
+			size, err := parseByteSize(c.Val())
+			if err != nil {
+				return c.Errf("invalid list maxsize %q; %s", c.Val(), err)
+			}
+			opts.MaxSize = size
+		case "maxentries":
+			entries, err := strconv.Atoi(c.Val())
+			if err != nil || entries < 1 {
+				return c.Errf("invalid list maxentries %q; expected a positive integer", c.Val())
+			}
+			opts.MaxEntries = entries
+		case "timeout":
+			timeout, err := time.ParseDuration(c.Val())
+			if err != nil || timeout <= 0 {
+				return c.Errf("invalid list timeout %q; expected a positive duration", c.Val())
+			}
+			opts.Timeout = timeout
+		case "answer":
+			switch c.Val() {
+			case "listed":
+				opts.ListedAnswer = true
+			case "response":
+				opts.ListedAnswer = false
+			default:
+				return c.Errf(
+					"invalid list answer %q; expected 'listed' or 'response'",
+					c.Val(),
+				)
+			}
+		case "mode":
+			switch c.Val() {
+			case "audit":
+				opts.Audit = true
+			case "enforce":
+				opts.Audit = false
+			default:
+				return c.Errf(
+					"invalid list mode %q; expected 'audit' or 'enforce'",
+					c.Val(),
+				)
+			}
+		case "priority":
+			priority, err := strconv.Atoi(c.Val())
+			if err != nil || priority < 0 {
+				return c.Errf("invalid list priority %q; expected a non-negative integer", c.Val())
+			}
+			opts.Priority = priority
+		case "sha256":
+			digest, err := hex.DecodeString(c.Val())
+			if err != nil || len(digest) != sha256.Size {
+				return c.Errf("invalid list sha256 %q; expected 64 hexadecimal characters", c.Val())
+			}
+			opts.SHA256 = digest
+		default:
+			return c.Errf(
+				"unknown list option %q; "+
+					"expected 'signature', 'pubkey', 'maxsize', 'maxentries', "+
+					"'timeout', 'sha256', 'answer', 'mode', 'priority', or 'http'",
+				option,
+			)
+		}
+		return ensureEOL(c)
+	})
+	if err != nil {
+		return opts, err
+	}
+
+	if (len(opts.SignatureURL) == 0) != (len(publicKey) == 0) {
+		return opts, c.Err("list signature and pubkey must be specified together")
+	}
+	if len(publicKey) != 0 {
+		data, err := os.ReadFile(publicKey)
+		if err != nil {
+			return opts, c.Errf("error reading list public key; %s", err)
+		}
+		opts.Verifier, err = ParsePublicKey(data)
+		if err != nil {
+			return opts, c.Errf("error parsing list public key %q; %s", publicKey, err)
+		}
+	}
+	return opts, nil
+}
+
+// parseByteSize parses a size in bytes with an optional decimal (KB, MB, GB)
+// or binary (KiB, MiB, GiB) unit suffix
+func parseByteSize(size string) (int64, error) {
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"KIB", 1 << 10},
+		{"MIB", 1 << 20},
+		{"GIB", 1 << 30},
+		{"KB", 1000},
+		{"MB", 1000 * 1000},
+		{"GB", 1000 * 1000 * 1000},
+		{"B", 1},
+	}
+	upper := strings.ToUpper(size)
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(upper, unit.suffix) {
+			upper = strings.TrimSuffix(upper, unit.suffix)
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	value, err := strconv.ParseInt(upper, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if value < 1 {
+		return 0, fmt.Errorf("size must be positive")
+	}
+	return value * multiplier, nil
+}
+
+// wrap returns the loader with the list options applied
+func (o ListOptions) wrap(a ActionConfig, loader ListLoader) (ListLoader, error) {
+	loader = o.applyHTTP(loader)
+	if o.MaxSize == 0 && o.MaxEntries == 0 && o.SHA256 == nil && len(o.SignatureURL) == 0 {
+		return loader, nil
+	}
+	checked := &CheckedListLoader{
+		Loader:  loader,
+		Options: o,
+	}
+	if len(o.SignatureURL) != 0 {
+		sigLoader, err := a.GetListLoader(o.SignatureURL)
+		if err != nil {
+			return nil, err
+		}
+		// The signature is fetched with the same request options as the list
+		checked.SignatureLoader = o.applyHTTP(sigLoader)
+	}
+	return checked, nil
+}
+
+// applyHTTP sets the list's timeout and HTTP options on an HTTP loader
+func (o ListOptions) applyHTTP(loader ListLoader) ListLoader {
+	httpLoader, ok := loader.(HTTPListLoader)
+	if !ok {
+		return loader
+	}
+	if o.Timeout != 0 {
+		httpLoader.Timeout = o.Timeout
+	}
+	if o.HTTP != nil {
+		httpLoader.HTTP = *o.HTTP
+	}
+	return httpLoader
+}
+
+// CheckedListLoader retrieves a list using another loader, then checks it
+// against the list's options before it is used. The list is read into memory,
+// so that its size, digest, and signature are checked before any entries are.
+//
+// If a signature is configured and the list or its signature cannot be
+// retrieved or verified, the last verified copy of the list is used instead.
+type CheckedListLoader struct {
+	Loader          ListLoader
+	Options         ListOptions
+	SignatureLoader ListLoader
+
+	lock sync.Mutex
+	last *checkedList
+}
+
+// checkedList is the content of a list as it was retrieved and verified
+type checkedList struct {
+	content  []byte
+	declared compression
+}
+
+// Load implements ListLoader
+func (l *CheckedListLoader) Load(path string) (io.ReadCloser, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	list, err := l.loadVerified(path)
+	if err == nil {
+		var content []byte
+		content, err = l.decompress(path, list)
+		if err == nil {
+			if l.Options.Verifier != nil {
+				l.last = list
+			}
+			return io.NopCloser(bytes.NewReader(content)), nil
+		}
+	}
+
+	if l.last == nil {
+		return nil, err
+	}
+	log.Errorf("%s; using last verified copy", err)
+	content, err := l.decompress(path, l.last)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(content)), nil
+}
+
+// loadVerified retrieves the list as published, without any HTTP content
+// encoding, then checks its size, digest,
+// and signature
+func (l *CheckedListLoader) loadVerified(path string) (*checkedList, error) {
+	var src io.ReadCloser
+	var declared compression
+	var err error
+	if raw, ok := l.Loader.(rawListLoader); ok {
+		src, declared, err = raw.loadRaw(path)
+	} else {
+		src, err = l.Loader.Load(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	content, err := l.readLimited(path, src)
+	if err != nil {
+		return nil, err
+	}
+
+	if l.Options.SHA256 != nil {
+		digest := sha256.Sum256(content)
+		if !bytes.Equal(digest[:], l.Options.SHA256) {
+			return nil, fmt.Errorf(
+				"list %q sha256 digest %x does not match expected %x",
+				path,
+				digest,
+				l.Options.SHA256,
+			)
+		}
+	}
+
+	if l.Options.Verifier != nil {
+		sigSrc, err := l.SignatureLoader.Load(l.Options.SignatureURL)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching signature of list %q; %w", path, err)
+		}
+		signature, err := io.ReadAll(io.LimitReader(sigSrc, maxSignatureSize))
+		sigSrc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading signature of list %q; %w", path, err)
+		}
+		if err := l.Options.Verifier.Verify(content, signature); err != nil {
+			return nil, fmt.Errorf("signature verification of list %q failed; %w", path, err)
+		}
+	}
+
+	return &checkedList{content: content, declared: declared}, nil
+}
+
+// decompress the list, then check its decompressed size and number of entries
+func (l *CheckedListLoader) decompress(path string, list *checkedList) ([]byte, error) {
+	src, err := decompress(io.NopCloser(bytes.NewReader(list.content)), list.declared)
+	if err != nil {
+		return nil, fmt.Errorf("error reading list %q; %w", path, err)
+	}
+	content, err := l.readLimited(path, src)
+	if err != nil {
+		return nil, err
+	}
+	if l.Options.MaxEntries != 0 {
+		if entries := countEntries(content); l.Options.MaxEntries < entries {
+			return nil, fmt.Errorf(
+				"list %q has %d entries; exceeds maximum of %d",
+				path,
+				entries,
+				l.Options.MaxEntries,
+			)
+		}
+	}
+	return content, nil
+}
+
+// readLimited reads and closes src, failing if it is larger than the maximum
+// list size
+func (l *CheckedListLoader) readLimited(path string, src io.ReadCloser) ([]byte, error) {
+	defer src.Close()
+	var reader io.Reader = src
+	if l.Options.MaxSize != 0 {
+		reader = io.LimitReader(src, l.Options.MaxSize+1)
+	}
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("error reading list %q; %w", path, err)
+	}
+	if l.Options.MaxSize != 0 && l.Options.MaxSize < int64(len(content)) {
+		return nil, fmt.Errorf(
+			"list %q exceeds maximum size of %d bytes",
+			path,
+			l.Options.MaxSize,
+		)
+	}
+	return content, nil
+}
+
+// countEntries returns the number of lines in a list that are not skipped as
+// comments or empty lines
+func countEntries(content []byte) int {
+	var entries int
+	for len(content) != 0 {
+		line := content
+		if i := bytes.IndexByte(content, '\n'); 0 <= i {
+			line, content = content[:i], content[i+1:]
+		} else {
+			content = nil
+		}
+		if !(ActionConfig{}).shouldSkip(bytes.TrimSpace(line)) {
+			entries++
+		}
+	}
+	return entries
+}
@@ -0,0 +1,175 @@
+package filter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const testLimitsList = "# limited list\nexample.com\nexample.net\nexample.org\n"
+
+func newTestLimitsServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/list.txt":
+			w.Write([]byte(testLimitsList))
+		case "/encoded.txt":
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			gz.Write([]byte(testLimitsList))
+			gz.Close()
+		case "/bomb.gz":
+			var buf bytes.Buffer
+			gz := gzip.NewWriter(&buf)
+			gz.Write(bytes.Repeat([]byte("example.com\n"), 100000))
+			gz.Close()
+			w.Write(buf.Bytes())
+		case "/slow.txt":
+			time.Sleep(500 * time.Millisecond)
+			w.Write([]byte(testLimitsList))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestListOptionsLimits(t *testing.T) {
+	server := newTestLimitsServer(t)
+	digest := sha256.Sum256([]byte(testLimitsList))
+	tests := []struct {
+		name    string
+		path    string
+		options string
+		want    int
+	}{
+		{"within maxsize", "/list.txt", "maxsize 1KiB", 3},
+		{"exceeds maxsize", "/list.txt", "maxsize 16", 0},
+		{"decompressed exceeds maxsize", "/bomb.gz", "maxsize 64KB", 0},
+		{"within maxentries", "/list.txt", "maxentries 3", 3},
+		{"exceeds maxentries", "/list.txt", "maxentries 2", 0},
+		{"sha256 match", "/list.txt", "sha256 " + hex.EncodeToString(digest[:]), 3},
+		{"sha256 match encoded", "/encoded.txt", "sha256 " + hex.EncodeToString(digest[:]), 3},
+		{"sha256 mismatch", "/list.txt", "sha256 " + hex.EncodeToString(make([]byte, 32)), 0},
+		{"within timeout", "/list.txt", "timeout 5s", 3},
+		{"exceeds timeout", "/slow.txt", "timeout 50ms", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			corefile := `filter {
+				block list domain ` + server.URL + tt.path + ` {
+					` + tt.options + `
+				}
+			}`
+			RunFilterBuildTest(t, TestFilterBuild{tt.name, corefile, tt.want == 0})
+			filter := NewTestFilter(t, corefile)
+			filter.Build()
+			if len(filter.blockDomains) != tt.want {
+				t.Errorf("expected %d domains; got %d", tt.want, len(filter.blockDomains))
+			}
+		})
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		size    string
+		want    int64
+		wantErr bool
+	}{
+		{"512", 512, false},
+		{"512B", 512, false},
+		{"2KB", 2000, false},
+		{"2kib", 2048, false},
+		{"10MB", 10000000, false},
+		{"10MiB", 10485760, false},
+		{"1GiB", 1073741824, false},
+		{"0", 0, true},
+		{"-1KB", 0, true},
+		{"KB", 0, true},
+		{"1TB", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.size, func(t *testing.T) {
+			got, err := parseByteSize(tt.size)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error: %v, wanterr: %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("expected %d; got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSetupListLimits(t *testing.T) {
+	tests := []TestSetup{
+		{
+			"list limits",
+			`filter {
+				block list domain https://example.com/list.txt {
+					maxsize 10MB
+					maxentries 100000
+					timeout 30s
+					sha256 e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855
+				}
+			}`,
+			false,
+		},
+		{
+			"list maxsize invalid",
+			`filter {
+				block list domain https://example.com/list.txt {
+					maxsize lots
+				}
+			}`,
+			true,
+		},
+		{
+			"list maxentries invalid",
+			`filter {
+				block list domain https://example.com/list.txt {
+					maxentries 0
+				}
+			}`,
+			true,
+		},
+		{
+			"list timeout invalid",
+			`filter {
+				block list domain https://example.com/list.txt {
+					timeout soon
+				}
+			}`,
+			true,
+		},
+		{
+			"list sha256 invalid",
+			`filter {
+				block list domain https://example.com/list.txt {
+					sha256 e3b0c442
+				}
+			}`,
+			true,
+		},
+		{
+			"list option without value",
+			`filter {
+				block list domain https://example.com/list.txt {
+					maxsize
+				}
+			}`,
+			true,
+		},
+	}
+	for _, test := range tests {
+		RunSetupTest(t, test)
+	}
+}
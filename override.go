@@ -0,0 +1,174 @@
+package filter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// maxOverrideChain is the number of canonical names followed when answering
+// an overridden request
+const maxOverrideChain = 8
+
+func parseOverride(c *caddy.Controller, f *Filter) error {
+	if !c.NextArg() {
+		return c.Err(
+			"no override type specified; " +
+				"expected 'domain', 'wildcard', or 'list'",
+		)
+	}
+	kind := RuleExact
+	switch c.Val() {
+	case "domain":
+	case "wildcard":
+		kind = RuleSuffix
+	case "list":
+		return parseActionList(c, f, ActionTypeOverride)
+	default:
+		return c.Errf("unexpected override token %q", c.Val())
+	}
+	args := c.RemainingArgs()
+	if len(args) != 3 {
+		return c.Errf(
+			"expected override %s NAME TYPE VALUE; got %q",
+			c.Val(),
+			args,
+		)
+	}
+	rule, err := parseRecord(kind, args[0], args[1], args[2])
+	if err != nil {
+		return c.Errf("invalid override; %s", err)
+	}
+	f.overrideConfig.AddAnswer(rule)
+	return nil
+}
+
+// AddAnswer of an exact or suffix rule to answer requests with
+func (a ActionConfig) AddAnswer(rule Rule) {
+	domains, answers := a.domains, a.answers
+	if rule.Kind == RuleSuffix {
+		domains, answers = a.wildcards, a.wildcardAnswers
+	}
+	domains[rule.Value] = true
+	answers[rule.Value] = answers[rule.Value].with(rule.Address, rule.Target)
+}
+
+func init() {
+	RegisterListParser("records", ListParserFunc(parseRecordsLine))
+}
+
+// parseRecordsLine parses a line of a list of local records, in the form
+// 'NAME TYPE VALUE'. Names prefixed with '*.' are wildcards.
+func parseRecordsLine(line []byte) ([]Rule, error) {
+	fields := strings.Fields(string(line))
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("expected NAME TYPE VALUE; got %q", line)
+	}
+	kind := RuleExact
+	name := fields[0]
+	if strings.HasPrefix(name, "*.") {
+		kind = RuleSuffix
+		name = name[2:]
+	}
+	rule, err := parseRecord(kind, name, fields[1], fields[2])
+	if err != nil {
+		return nil, err
+	}
+	return []Rule{rule}, nil
+}
+
+// parseRecord parses an A, AAAA, or CNAME record of a domain into a rule
+func parseRecord(kind RuleKind, name, rrtype, value string) (Rule, error) {
+	if kind == RuleSuffix {
+		name = ActionConfig{}.cleanWildcardListLine(name)
+	}
+	name = strings.TrimSuffix(name, ".")
+	if !validName(name) {
+		return Rule{}, fmt.Errorf("name %q is invalid", name)
+	}
+	rule := Rule{Kind: kind, Value: name}
+	switch strings.ToUpper(rrtype) {
+	case "A", "AAAA":
+		_, addr, err := parseAddress(rrtype, value)
+		if err != nil {
+			return Rule{}, err
+		}
+		rule.Address = addr
+	case "CNAME":
+		target := strings.TrimSuffix(value, ".")
+		if !validName(target) {
+			return Rule{}, fmt.Errorf("CNAME record %q is invalid", value)
+		}
+		rule.Target = target
+	default:
+		return Rule{}, fmt.Errorf(
+			"unsupported record type %q; expected 'A', 'AAAA', or 'CNAME'",
+			rrtype,
+		)
+	}
+	return rule, nil
+}
+
+// overridden returns the answer of an overridden domain. The filter must be
+// read locked.
+func (f *Filter) overridden(qname string) (RespListed, bool) {
+	if answer, ok := f.overrideDomains[qname]; ok {
+		log.Debugf("request %q matched overridden domain", qname)
+		return answer, true
+	}
+	if wildcard, ok := matchesAnyWildcard(qname, f.overrideWildcards); ok {
+		log.Debugf("request %q matched override wildcard %q", qname, wildcard)
+		return f.overrideWildcards[wildcard], true
+	}
+	return RespListed{}, false
+}
+
+// serveOverride answers a request with the records of an overridden domain.
+// Canonical names are followed, using further overrides or the plugins which
+// follow filter, so that clients receive a complete answer.
+func (f *Filter) serveOverride(ctx context.Context, state request.Request, answer RespListed) (int, error) {
+	msg := new(dns.Msg)
+	msg.SetReply(state.Req)
+	msg.Authoritative = true
+	msg.RecursionAvailable = false
+
+	qtype := state.QType()
+	response := answer.Render(state.Name(), qtype)
+	msg.Answer = response.Answer
+	for i := 0; i < maxOverrideChain && answer.Target != "" && qtype != dns.TypeCNAME; i++ {
+		target := dns.Fqdn(answer.Target)
+		var ok bool
+		f.RLock()
+		answer, ok = f.overridden(strings.TrimSuffix(target, "."))
+		f.RUnlock()
+		if ok {
+			msg.Answer = append(msg.Answer, answer.Render(target, qtype).Answer...)
+			continue
+		}
+		reply, err := f.resolveTarget(ctx, target, qtype)
+		if err != nil {
+			// The canonical name is still a valid answer, which the client
+			// may follow itself
+			log.Warningf("failed to resolve %q of overridden %q; %s", target, state.Name(), err)
+			break
+		}
+		msg.Answer = append(msg.Answer, reply.Answer...)
+		msg.Rcode = reply.Rcode
+		break
+	}
+	state.W.WriteMsg(msg)
+	return dns.RcodeSuccess, nil
+}
+
+// resolveTarget resolves the canonical name of an overridden domain using the
+// plugins which follow filter
+func (f *Filter) resolveTarget(ctx context.Context, target string, qtype uint16) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(target, qtype)
+	msg.RecursionDesired = true
+	return (&NextListResolver{Filter: f}).exchange(ctx, msg)
+}
@@ -0,0 +1,253 @@
+package filter
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+// overrideAnswers returns the answers of a request as "NAME TYPE DATA" strings
+func overrideAnswers(t *testing.T, filter *Filter, qname string, qtype uint16) (*dns.Msg, []string) {
+	t.Helper()
+	req := new(dns.Msg).SetQuestion(dns.Fqdn(qname), qtype)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	filter.ServeDNS(context.Background(), rec, req)
+	if rec.Msg == nil {
+		t.Fatal("expected a response")
+	}
+	var got []string
+	for _, rr := range rec.Msg.Answer {
+		data := strings.TrimPrefix(rr.String(), rr.Header().String())
+		got = append(got, rr.Header().Name+" "+dns.TypeToString[rr.Header().Rrtype]+" "+data)
+	}
+	return rec.Msg, got
+}
+
+func TestOverride(t *testing.T) {
+	list := writeTestFile(t, "records", []byte(
+		"# local records\n"+
+			"printer.home A 192.168.1.20\n"+
+			"*.lab.home A 192.168.1.30\n"+
+			"*.lab.home AAAA 2001:db8::30\n"+
+			"media.home CNAME nas.home\n"+
+			"invalid.home MX mail.home\n",
+	))
+	hosts := writeTestFile(t, "hosts", []byte(
+		"127.0.0.1 localhost\n"+
+			"192.168.1.40 router.home\n",
+	))
+	filter := NewTestFilter(t, `filter {
+		override domain nas.home A 192.168.1.10
+		override domain nas.home AAAA 2001:db8::10
+		override domain www.home CNAME nas.home
+		override domain external.home CNAME example.com
+		override domain loop.home CNAME loop.home
+		override list records file://`+list+`
+		override list hosts file://`+hosts+`
+		block domain nas.home
+		block domain blocked.home
+		block wildcard lab.home
+	}`)
+	filter.Next = plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		msg := new(dns.Msg).SetReply(r)
+		if r.Question[0].Name == "example.com." && r.Question[0].Qtype == dns.TypeA {
+			msg.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("192.0.2.1"),
+			}}
+		}
+		w.WriteMsg(msg)
+		return dns.RcodeSuccess, nil
+	})
+	filter.Build()
+
+	tests := []struct {
+		name  string
+		qname string
+		qtype uint16
+		want  []string
+	}{
+		{"domain A", "nas.home", dns.TypeA, []string{"nas.home. A 192.168.1.10"}},
+		{"domain AAAA", "nas.home", dns.TypeAAAA, []string{"nas.home. AAAA 2001:db8::10"}},
+		{"domain other type", "nas.home", dns.TypeMX, nil},
+		{"cname followed", "www.home", dns.TypeA, []string{
+			"www.home. CNAME nas.home.",
+			"nas.home. A 192.168.1.10",
+		}},
+		{"cname requested", "www.home", dns.TypeCNAME, []string{"www.home. CNAME nas.home."}},
+		{"cname resolved by next", "external.home", dns.TypeA, []string{
+			"external.home. CNAME example.com.",
+			"example.com. A 192.0.2.1",
+		}},
+		{"cname loop", "loop.home", dns.TypeA, []string{
+			"loop.home. CNAME loop.home.",
+			"loop.home. CNAME loop.home.",
+			"loop.home. CNAME loop.home.",
+			"loop.home. CNAME loop.home.",
+			"loop.home. CNAME loop.home.",
+			"loop.home. CNAME loop.home.",
+			"loop.home. CNAME loop.home.",
+			"loop.home. CNAME loop.home.",
+			"loop.home. CNAME loop.home.",
+		}},
+		{"list domain", "printer.home", dns.TypeA, []string{"printer.home. A 192.168.1.20"}},
+		{"list wildcard", "server.lab.home", dns.TypeAAAA, []string{"server.lab.home. AAAA 2001:db8::30"}},
+		{"list wildcard parent", "lab.home", dns.TypeA, []string{"lab.home. A 192.168.1.30"}},
+		{"list cname", "media.home", dns.TypeAAAA, []string{
+			"media.home. CNAME nas.home.",
+			"nas.home. AAAA 2001:db8::10",
+		}},
+		{"hosts", "router.home", dns.TypeA, []string{"router.home. A 192.168.1.40"}},
+		{"blocked", "blocked.home", dns.TypeA, []string{"blocked.home. A 0.0.0.0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, got := overrideAnswers(t, filter, tt.qname, tt.qtype)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("expected answers %q; got %q", tt.want, got)
+			}
+			if msg.Rcode != dns.RcodeSuccess {
+				t.Errorf("expected success; got %s", dns.RcodeToString[msg.Rcode])
+			}
+		})
+	}
+
+	if _, ok := filter.overrideDomains["invalid.home"]; ok {
+		t.Error("expected unsupported record to be skipped")
+	}
+	if _, ok := filter.overrideDomains["localhost"]; ok {
+		t.Error("expected localhost not to be overridden")
+	}
+}
+
+func TestOverrideUnlisted(t *testing.T) {
+	filter := NewTestFilter(t, `filter {
+		override domain nas.home A 192.168.1.10
+	}`)
+	filter.Build()
+	req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	rcode, _ := filter.ServeDNS(context.Background(), rec, req)
+	if rcode != dns.RcodeServerFailure {
+		t.Errorf("expected request to be passed to the next plugin; got %s", dns.RcodeToString[rcode])
+	}
+}
+
+func TestOverrideParseRecordsLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    Rule
+		wantErr bool
+	}{
+		{"nas.home A 192.168.1.10", Rule{Kind: RuleExact, Value: "nas.home"}, false},
+		{"nas.home. aaaa 2001:db8::10", Rule{Kind: RuleExact, Value: "nas.home"}, false},
+		{"*.lab.home A 192.168.1.30", Rule{Kind: RuleSuffix, Value: "lab.home"}, false},
+		{"www.home CNAME nas.home.", Rule{Kind: RuleExact, Value: "www.home", Target: "nas.home"}, false},
+		{"nas.home A 2001:db8::10", Rule{}, true},
+		{"nas.home AAAA 192.168.1.10", Rule{}, true},
+		{"nas.home A nas", Rule{}, true},
+		{"nas.home TXT hello", Rule{}, true},
+		{"nas.home CNAME in valid", Rule{}, true},
+		{"nas.home 192.168.1.10", Rule{}, true},
+		{"in$valid A 192.168.1.10", Rule{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			rules, err := parseRecordsLine([]byte(tt.line))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error: %v, wanterr: %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(rules) != 1 {
+				t.Fatalf("expected 1 rule; got %d", len(rules))
+			}
+			rule := rules[0]
+			if rule.Kind != tt.want.Kind || rule.Value != tt.want.Value || rule.Target != tt.want.Target {
+				t.Errorf("expected %s rule %q; got %s rule %q", tt.want.Kind, tt.want.Value, rule.Kind, rule.Value)
+			}
+			if !rule.listsAnswer() {
+				t.Error("expected rule to list an answer")
+			}
+		})
+	}
+}
+
+func TestSetupOverride(t *testing.T) {
+	tests := []TestSetup{
+		{
+			"override domain",
+			`filter {
+				override domain nas.home A 192.168.1.10
+			}`,
+			false,
+		},
+		{
+			"override wildcard",
+			`filter {
+				override wildcard *.lab.home CNAME nas.home
+			}`,
+			false,
+		},
+		{
+			"override list",
+			`filter {
+				override list records https://example.com/records.txt
+				override list hosts https://example.com/hosts
+			}`,
+			false,
+		},
+		{
+			"override missing type",
+			`filter {
+				override
+			}`,
+			true,
+		},
+		{
+			"override regex",
+			`filter {
+				override regex ^nas\. A 192.168.1.10
+			}`,
+			true,
+		},
+		{
+			"override missing value",
+			`filter {
+				override domain nas.home A
+			}`,
+			true,
+		},
+		{
+			"override extra argument",
+			`filter {
+				override domain nas.home A 192.168.1.10 192.168.1.11
+			}`,
+			true,
+		},
+		{
+			"override invalid address",
+			`filter {
+				override domain nas.home AAAA 192.168.1.10
+			}`,
+			true,
+		},
+		{
+			"override unknown list type",
+			`filter {
+				override list noop https://example.com/records.txt
+			}`,
+			true,
+		},
+	}
+	for _, test := range tests {
+		RunSetupTest(t, test)
+	}
+}
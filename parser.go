@@ -0,0 +1,234 @@
+package filter
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+// RuleKind is how a rule matches requested names
+type RuleKind int
+
+const (
+	// RuleExact matches a domain only
+	RuleExact RuleKind = iota
+
+	// RuleSuffix matches a domain and all of its subdomains
+	RuleSuffix
+
+	// RuleRegex matches names using a regular expression
+	RuleRegex
+)
+
+// String returns the rule kind
+func (k RuleKind) String() string {
+	kinds := map[RuleKind]string{
+		RuleExact:  "exact",
+		RuleSuffix: "suffix",
+		RuleRegex:  "regex",
+	}
+	return kinds[k]
+}
+
+// Rule is an entry parsed from a list
+type Rule struct {
+	Kind RuleKind
+
+	// Value is the domain of exact and suffix rules, or the expression of
+	// regex rules
+	Value string
+
+	// Regexp is the compiled expression of a regex rule. Value is compiled
+	// when the list is loaded if Regexp is nil.
+	Regexp *regexp.Regexp
+
+	// Exception rules are applied by the action opposite to their list's, such
+	// as the '@@' entries of an Adblock Plus block list, which are allowed
+	Exception bool
+
+	// Address is the address listed for the domain of an exact or suffix rule,
+	// such as in a hosts file. It answers overridden requests, and blocked
+	// requests if the list's answer option is 'listed'.
+	Address netip.Addr
+
+	// Target is the canonical name listed for the domain of an exact or suffix
+	// rule. It answers overridden requests with a CNAME record.
+	Target string
+}
+
+// listsAnswer reports whether the rule lists an answer for its domain
+func (r Rule) listsAnswer() bool {
+	return r.Kind != RuleRegex && (r.Address.IsValid() || r.Target != "")
+}
+
+// ListParser parses the entries of a type of list
+type ListParser interface {
+	// ParseLine returns the rules of a single line of a list. Lines have
+	// surrounding whitespace removed, and comments and empty lines are
+	// skipped. The line is only valid until ParseLine returns.
+	//
+	// An error is reported as a diagnostic of the list, and the line is
+	// skipped. Lines without rules may return neither rules nor an error.
+	ParseLine(line []byte) ([]Rule, error)
+}
+
+// ListParserFunc adapts a function to a ListParser
+type ListParserFunc func(line []byte) ([]Rule, error)
+
+// ParseLine implements ListParser
+func (fn ListParserFunc) ParseLine(line []byte) ([]Rule, error) {
+	return fn(line)
+}
+
+// Diagnostic is a problem with a line of a list, which was skipped
+type Diagnostic struct {
+	Line int
+	Err  error
+}
+
+// Error implements error
+func (d Diagnostic) Error() string {
+	return fmt.Sprintf("line %d: %s", d.Line, d.Err)
+}
+
+var listParsers = struct {
+	sync.RWMutex
+	parsers map[string]ListParser
+}{parsers: make(map[string]ListParser)}
+
+// RegisterListParser makes a parser available as a type of list, used in the
+// Corefile as 'allow list NAME URL' or 'block list NAME URL'. It is intended to
+// be called from the init function of the package providing the parser, and
+// panics if a parser of the same name is already registered.
+func RegisterListParser(name string, parser ListParser) {
+	listParsers.Lock()
+	defer listParsers.Unlock()
+	if parser == nil {
+		panic("filter: RegisterListParser parser is nil")
+	}
+	if _, ok := listParsers.parsers[name]; ok {
+		panic(fmt.Sprintf("filter: RegisterListParser called twice for list type %q", name))
+	}
+	listParsers.parsers[name] = parser
+}
+
+// getListParser returns the parser registered for a type of list
+func getListParser(name string) (ListParser, bool) {
+	listParsers.RLock()
+	defer listParsers.RUnlock()
+	parser, ok := listParsers.parsers[name]
+	return parser, ok
+}
+
+// listParserNames returns the sorted names of the registered types of lists
+func listParserNames() []string {
+	listParsers.RLock()
+	defer listParsers.RUnlock()
+	names := make([]string, 0, len(listParsers.parsers))
+	for name := range listParsers.parsers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ruleSet is the compiled rules of an action
+type ruleSet struct {
+	domains   map[string]bool
+	regex     map[string]*regexp.Regexp
+	wildcards map[string]bool
+
+	// answers and wildcardAnswers are the records listed for the domains of
+	// exact and suffix rules. Addresses are in the order they were listed.
+	answers         map[string]RespListed
+	wildcardAnswers map[string]RespListed
+
+	// priorities are the priorities of rules other than zero
+	priorities map[ruleKey]int
+}
+
+// ruleKey identifies a rule of a set
+type ruleKey struct {
+	kind  RuleKind
+	value string
+}
+
+func newRuleSet() ruleSet {
+	return ruleSet{
+		domains:         make(map[string]bool),
+		regex:           make(map[string]*regexp.Regexp),
+		wildcards:       make(map[string]bool),
+		answers:         make(map[string]RespListed),
+		wildcardAnswers: make(map[string]RespListed),
+		priorities:      make(map[ruleKey]int),
+	}
+}
+
+// prioritize sets the priority of a rule added to the set. A rule added more
+// than once keeps its highest priority.
+func (r ruleSet) prioritize(rule Rule, priority int) {
+	key := ruleKey{rule.Kind, rule.Value}
+	if current, ok := r.priorities[key]; ok && priority <= current {
+		return
+	}
+	if priority != 0 {
+		r.priorities[key] = priority
+	}
+}
+
+// addAnswer adds the address or canonical name listed by a rule. Addresses
+// already listed for the domain are ignored, and only the first canonical name
+// is kept.
+func (r ruleSet) addAnswer(rule Rule) {
+	answers := r.answers
+	if rule.Kind == RuleSuffix {
+		answers = r.wildcardAnswers
+	}
+	answers[rule.Value] = answers[rule.Value].with(rule.Address, rule.Target)
+}
+
+// add a rule to the set. Regex rules must be compiled.
+func (r ruleSet) add(rule Rule) {
+	switch rule.Kind {
+	case RuleExact:
+		r.domains[rule.Value] = true
+	case RuleSuffix:
+		r.wildcards[rule.Value] = true
+	case RuleRegex:
+		if _, ok := r.regex[rule.Value]; !ok {
+			r.regex[rule.Value] = rule.Regexp
+		}
+	}
+}
+
+// merge the rules of another set into the set
+func (r ruleSet) merge(other ruleSet) {
+	for domain := range other.domains {
+		r.domains[domain] = true
+	}
+	for expression, regex := range other.regex {
+		if _, ok := r.regex[expression]; !ok {
+			r.regex[expression] = regex
+		}
+	}
+	for wildcard := range other.wildcards {
+		r.wildcards[wildcard] = true
+	}
+	mergeAnswers(r.answers, other.answers)
+	mergeAnswers(r.wildcardAnswers, other.wildcardAnswers)
+	for key, priority := range other.priorities {
+		r.prioritize(Rule{Kind: key.kind, Value: key.value}, priority)
+	}
+}
+
+// mergeAnswers adds the answers listed in from to those listed in to
+func mergeAnswers(to, from map[string]RespListed) {
+	for domain, answer := range from {
+		for _, addr := range answer.Addrs {
+			to[domain] = to[domain].with(addr, "")
+		}
+		to[domain] = to[domain].with(netip.Addr{}, answer.Target)
+	}
+}
@@ -0,0 +1,146 @@
+package filter
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// parseTestABPLine parses a small subset of Adblock Plus filters, including
+// exceptions, to test parsers registered outside of the plugin
+func parseTestABPLine(line []byte) ([]Rule, error) {
+	exception := bytes.HasPrefix(line, []byte("@@"))
+	line = bytes.TrimPrefix(line, []byte("@@"))
+	if !bytes.HasPrefix(line, []byte("||")) || !bytes.HasSuffix(line, []byte("^")) {
+		return nil, fmt.Errorf("unsupported filter %q", line)
+	}
+	domain := string(line[2 : len(line)-1])
+	return []Rule{{Kind: RuleSuffix, Value: domain, Exception: exception}}, nil
+}
+
+func init() {
+	RegisterListParser("test-abp", ListParserFunc(parseTestABPLine))
+}
+
+func TestListParserRegistered(t *testing.T) {
+	list := writeTestFile(t, "abp.txt", []byte(
+		"[Adblock Plus]\n"+
+			"! comment\n"+
+			"||example.com^\n"+
+			"@@||safe.example.com^\n"+
+			"/banner/*\n",
+	))
+	corefile := `filter {
+		block list test-abp file://` + list + `
+	}`
+	tests := []TestFilterRequest{
+		{"check suffix rule blocked", "ads.example.com", true},
+		{"check exception allowed", "safe.example.com", false},
+		{"check exception subdomain allowed", "www.safe.example.com", false},
+		{"check unlisted allowed", "example.net", false},
+	}
+	RunFilterTests(t, corefile, tests)
+}
+
+func TestListParserRegisterDuplicate(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected panic registering duplicate list type")
+		}
+	}()
+	RegisterListParser("domain", ListParserFunc(parseDomainLine))
+}
+
+func TestListParserBuiltin(t *testing.T) {
+	tests := []struct {
+		kind    string
+		line    string
+		want    Rule
+		wantErr bool
+	}{
+		{"domain", "example.com", Rule{Kind: RuleExact, Value: "example.com"}, false},
+		{"domain", "example.com example.net", Rule{}, true},
+		{"hosts", "0.0.0.0 example.com", Rule{Kind: RuleExact, Value: "example.com"}, false},
+		{"hosts", "example.com", Rule{}, true},
+		{"regex", `^ads\.`, Rule{Kind: RuleRegex, Value: `^ads\.`}, false},
+		{"regex", "(invalid", Rule{}, true},
+		{"wildcard", "||example.com^", Rule{Kind: RuleSuffix, Value: "example.com"}, false},
+		{"wildcard", "*.example.com", Rule{Kind: RuleSuffix, Value: "example.com"}, false},
+		{"wildcard", "exa mple.com", Rule{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind+" "+tt.line, func(t *testing.T) {
+			parser, ok := getListParser(tt.kind)
+			if !ok {
+				t.Fatalf("expected %q parser to be registered", tt.kind)
+			}
+			rules, err := parser.ParseLine([]byte(tt.line))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error: %v, wanterr: %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(rules) != 1 {
+				t.Fatalf("expected 1 rule; got %d", len(rules))
+			}
+			if rules[0].Kind != tt.want.Kind || rules[0].Value != tt.want.Value {
+				t.Errorf("expected %s rule %q; got %s rule %q",
+					tt.want.Kind, tt.want.Value, rules[0].Kind, rules[0].Value)
+			}
+		})
+	}
+}
+
+func TestCompileRules(t *testing.T) {
+	rules, err := compileRules([]Rule{
+		{Kind: RuleExact, Value: "example.com"},
+		{Kind: RuleRegex, Value: `^ads\.`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rules[1].Regexp == nil || !rules[1].Regexp.MatchString("ads.example.com") {
+		t.Error("expected regex rule to be compiled")
+	}
+	if _, err := compileRules([]Rule{{Kind: RuleRegex, Value: "(invalid"}}); err == nil {
+		t.Error("expected error compiling invalid expression")
+	}
+}
+
+func TestDiagnosticError(t *testing.T) {
+	diagnostic := Diagnostic{Line: 12, Err: errors.New("invalid")}
+	if diagnostic.Error() != "line 12: invalid" {
+		t.Errorf("unexpected diagnostic %q", diagnostic.Error())
+	}
+}
+
+func TestSetupListParser(t *testing.T) {
+	tests := []TestSetup{
+		{
+			"list registered type",
+			`filter {
+				block list test-abp https://example.com/abp.txt
+			}`,
+			false,
+		},
+		{
+			"list unknown type",
+			`filter {
+				block list noop https://example.com/list.txt
+			}`,
+			true,
+		},
+		{
+			"list type without url",
+			`filter {
+				block list test-abp
+			}`,
+			true,
+		},
+	}
+	for _, test := range tests {
+		RunSetupTest(t, test)
+	}
+}
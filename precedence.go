@@ -0,0 +1,280 @@
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/coredns/caddy"
+)
+
+// Precedence decides which rule wins when a request matches both allow and
+// block rules
+type Precedence int
+
+const (
+	// PrecedenceAllow lets allow rules always win
+	PrecedenceAllow Precedence = iota
+
+	// PrecedenceSpecific lets the most specific rule win. Exact rules beat
+	// wildcards, longer wildcards beat shorter ones, and wildcards beat
+	// regular expressions. Allow rules win ties.
+	PrecedenceSpecific
+
+	// PrecedencePriority lets the rule of highest priority win. Ties are
+	// decided as by PrecedenceSpecific.
+	PrecedencePriority
+)
+
+// String returns the precedence
+func (p Precedence) String() string {
+	precedences := map[Precedence]string{
+		PrecedenceAllow:    "allow",
+		PrecedenceSpecific: "specific",
+		PrecedencePriority: "priority",
+	}
+	return precedences[p]
+}
+
+func parsePrecedence(c *caddy.Controller, f *Filter) error {
+	if !c.NextArg() {
+		return c.Err("no precedence specified")
+	}
+	switch c.Val() {
+	case "allow":
+		f.precedence = PrecedenceAllow
+	case "specific":
+		f.precedence = PrecedenceSpecific
+	case "priority":
+		f.precedence = PrecedencePriority
+	default:
+		return c.Errf(
+			"invalid precedence %q; expected 'allow', 'specific', or 'priority'",
+			c.Val(),
+		)
+	}
+	return ensureEOL(c)
+}
+
+// parseRulePriority parses the optional options block of an inline rule, which
+// sets the rule's priority
+func parseRulePriority(c *caddy.Controller, f *Filter, a ActionType, kind RuleKind, value string) error {
+	return parseBlock(c, func(c *caddy.Controller) error {
+		if c.Val() != "priority" {
+			return c.Errf("unknown %s rule option %q; expected 'priority'", a, c.Val())
+		}
+		if !c.NextArg() {
+			return c.Errf("no value specified for %s rule option %q", a, "priority")
+		}
+		priority, err := strconv.Atoi(c.Val())
+		if err != nil || priority < 0 {
+			return c.Errf("invalid %s rule priority %q; expected a non-negative integer", a, c.Val())
+		}
+		key := ruleKey{kind, value}
+		switch a {
+		case ActionTypeAllow:
+			f.allowConfig.priorities[key] = priority
+		case ActionTypeBlock:
+			f.blockConfig.priorities[key] = priority
+		case ActionTypeDeny:
+			f.denyConfig.priorities[key] = priority
+		}
+		return ensureEOL(c)
+	})
+}
+
+// ruleMatch is a rule matched by a request
+type ruleMatch struct {
+	action   ActionType
+	kind     RuleKind
+	value    string
+	priority int
+
+	// category is the category of a matched block rule, if any
+	category string
+}
+
+// String describes the matched rule, and its category if any
+func (m ruleMatch) String() string {
+	if m.category != "" {
+		return fmt.Sprintf("%s %s %q of category %q", m.action, m.kind, m.value, m.category)
+	}
+	return fmt.Sprintf("%s %s %q", m.action, m.kind, m.value)
+}
+
+// specificity ranks how narrowly a rule matches names. Exact rules are the
+// most specific, then wildcards by length, then regular expressions.
+func (m ruleMatch) specificity() int {
+	switch m.kind {
+	case RuleExact:
+		return maxSpecificity
+	case RuleSuffix:
+		return 1 + len(m.value)
+	}
+	return 0
+}
+
+// maxSpecificity is greater than that of any wildcard, whose length is limited
+// to 253 characters
+const maxSpecificity = 1 << 16
+
+// beats reports whether the match wins over another under a precedence. Ties
+// are won by neither.
+func (m ruleMatch) beats(other ruleMatch, precedence Precedence) bool {
+	if precedence == PrecedencePriority && m.priority != other.priority {
+		return other.priority < m.priority
+	}
+	return other.specificity() < m.specificity()
+}
+
+// actionRules are the compiled rules of an action, in the form they're
+// matched against requests
+type actionRules struct {
+	action     ActionType
+	domains    map[string]bool
+	regex      []*regexp.Regexp
+	wildcards  map[string]bool
+	priorities map[ruleKey]int
+
+	// category is the name of the category the rules are of, if any
+	category string
+}
+
+// size returns the number of rules
+func (r actionRules) size() int {
+	return len(r.domains) + len(r.regex) + len(r.wildcards)
+}
+
+// match returns the winning rule of the action matched by a request. Unless
+// the precedence is 'priority', the first match of the most specific kind wins
+// and the remaining rules aren't evaluated.
+func (r actionRules) match(qname string, precedence Precedence) (ruleMatch, bool) {
+	var best ruleMatch
+	var matched bool
+	consider := func(kind RuleKind, value string) {
+		candidate := ruleMatch{
+			action:   r.action,
+			kind:     kind,
+			value:    value,
+			priority: r.priorities[ruleKey{kind, value}],
+			category: r.category,
+		}
+		if !matched || candidate.beats(best, precedence) {
+			best, matched = candidate, true
+		}
+	}
+	exhaustive := precedence == PrecedencePriority
+
+	if _, ok := r.domains[qname]; ok {
+		consider(RuleExact, qname)
+		if !exhaustive {
+			return best, true
+		}
+	}
+
+	// Wildcards are tested from the longest, at each subdomain boundary
+	for i := -1; i < len(qname); i++ {
+		if i != -1 && qname[i] != '.' {
+			continue
+		}
+		if wildcard := qname[i+1:]; r.wildcards[wildcard] {
+			consider(RuleSuffix, wildcard)
+			if !exhaustive {
+				return best, true
+			}
+		}
+	}
+
+	// Evaluate regular expressions last, as they're the most expensive
+	for _, exp := range r.regex {
+		if exp.MatchString(qname) {
+			consider(RuleRegex, exp.String())
+			if !exhaustive {
+				return best, true
+			}
+		}
+	}
+
+	return best, matched
+}
+
+// evaluate returns the rule which decides how a request of a client is
+// handled. Denied domains are matched first, and can't be allowed. The block
+// rules of categories active for the client are matched with the filter's own.
+// The filter must be read locked.
+func (f *Filter) evaluate(qname string, client clientInfo) (ruleMatch, bool) {
+	block := append([]actionRules{f.blockRules()}, f.activeCategories(client, time.Now())...)
+	return f.decide(qname, f.denyRules(), f.allowRules(), block...)
+}
+
+// decide returns the winning rule of a request among rules of each action.
+// The winning match of the block rules is that which beats the others, or the
+// first of them on a tie.
+func (f *Filter) decide(qname string, deny, allow actionRules, block ...actionRules) (ruleMatch, bool) {
+	if winner, denied := deny.match(qname, PrecedenceAllow); denied {
+		return winner, true
+	}
+	allowMatch, allowed := allow.match(qname, f.precedence)
+	if allowed && f.precedence == PrecedenceAllow {
+		return allowMatch, true
+	}
+	var blockMatch ruleMatch
+	var blocked bool
+	for _, rules := range block {
+		candidate, ok := rules.match(qname, f.precedence)
+		if ok && (!blocked || candidate.beats(blockMatch, f.precedence)) {
+			blockMatch, blocked = candidate, true
+		}
+	}
+	switch {
+	case !blocked:
+		return allowMatch, allowed
+	case !allowed:
+		return blockMatch, true
+	case blockMatch.beats(allowMatch, f.precedence):
+		return blockMatch, true
+	}
+	return allowMatch, true
+}
+
+// newActionRules returns the rules of an action in the form they're matched
+// against requests
+func (f *Filter) newActionRules(action ActionType, rules ruleSet) actionRules {
+	return actionRules{
+		action:     action,
+		domains:    rules.domains,
+		regex:      f.consolidateRegex(rules.regex),
+		wildcards:  rules.wildcards,
+		priorities: rules.priorities,
+	}
+}
+
+func (f *Filter) allowRules() actionRules {
+	return actionRules{
+		action:     ActionTypeAllow,
+		domains:    f.allowDomains,
+		regex:      f.allowRegex,
+		wildcards:  f.allowWildcards,
+		priorities: f.allowPriorities,
+	}
+}
+
+func (f *Filter) blockRules() actionRules {
+	return actionRules{
+		action:     ActionTypeBlock,
+		domains:    f.blockDomains,
+		regex:      f.blockRegex,
+		wildcards:  f.blockWildcards,
+		priorities: f.blockPriorities,
+	}
+}
+
+func (f *Filter) denyRules() actionRules {
+	return actionRules{
+		action:    ActionTypeDeny,
+		domains:   f.denyDomains,
+		regex:     f.denyRegex,
+		wildcards: f.denyWildcards,
+	}
+}
@@ -0,0 +1,225 @@
+package filter
+
+import "testing"
+
+func TestPrecedence(t *testing.T) {
+	malware := writeTestFile(t, "malware", []byte(
+		"malware.microsoft.com\n",
+	))
+	trackers := writeTestFile(t, "trackers", []byte(
+		"||telemetry.microsoft.com^\n",
+	))
+	entries := `
+		allow wildcard *.microsoft.com
+		allow wildcard *.ads.example.com
+		allow regex ^safe\.
+		block wildcard example.com
+		block domain ads.example.com
+		block domain safe.example.net
+		block list domain file://` + malware + ` {
+			priority 10
+		}
+		block list wildcard file://` + trackers + ` {
+			priority 5
+		}
+	`
+	tests := []struct {
+		precedence string
+		requests   []TestFilterRequest
+	}{
+		{
+			"",
+			[]TestFilterRequest{
+				{"check allow wildcard wins over exact", "malware.microsoft.com", false},
+				{"check allow wildcard wins over wildcard", "a.telemetry.microsoft.com", false},
+				{"check allow regex wins", "safe.example.net", false},
+				{"check block wildcard", "www.example.com", true},
+			},
+		},
+		{
+			"precedence specific",
+			[]TestFilterRequest{
+				{"check exact block wins over wildcard", "malware.microsoft.com", true},
+				{"check longer block wildcard wins", "a.telemetry.microsoft.com", true},
+				{"check allow wildcard", "www.microsoft.com", false},
+				{"check exact block wins over regex", "safe.example.net", true},
+				{"check exact wins over longer wildcard", "ads.example.com", true},
+				{"check longer allow wildcard wins", "x.ads.example.com", false},
+				{"check block wildcard", "www.example.com", true},
+			},
+		},
+		{
+			"precedence priority",
+			[]TestFilterRequest{
+				{"check priority wins", "malware.microsoft.com", true},
+				{"check priority wins over specific", "telemetry.microsoft.com", true},
+				{"check equal priority falls back to specific", "ads.example.com", true},
+				{"check equal priority longer allow wildcard", "x.ads.example.com", false},
+				{"check allow wildcard", "www.microsoft.com", false},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.precedence, func(t *testing.T) {
+			RunFilterTests(t, "filter {\n"+tt.precedence+entries+"}", tt.requests)
+		})
+	}
+}
+
+func TestPrecedenceInlinePriority(t *testing.T) {
+	corefile := `filter {
+		precedence priority
+		block list wildcard file://` + writeTestFile(t, "list", []byte("example.com\n")) + ` {
+			priority 10
+		}
+		allow domain www.example.com {
+			priority 20
+		}
+		allow wildcard *.cdn.example.com {
+			priority 20
+		}
+		allow regex ^api\. {
+			priority 5
+		}
+		block domain ads.example.net {
+			priority 1
+		}
+		allow wildcard example.net
+	}`
+	tests := []TestFilterRequest{
+		{"check inline domain priority", "www.example.com", false},
+		{"check inline wildcard priority", "a.cdn.example.com", false},
+		{"check lower inline regex priority", "api.example.com", true},
+		{"check list priority", "mail.example.com", true},
+		{"check inline priority over zero", "ads.example.net", true},
+		{"check zero priority", "www.example.net", false},
+	}
+	RunFilterTests(t, corefile, tests)
+}
+
+func TestPrecedenceEvaluate(t *testing.T) {
+	filter := NewTestFilter(t, `filter {
+		precedence priority
+		allow wildcard example.com
+		block domain www.example.com
+		block regex ^www\.
+	}`)
+	filter.Build()
+	winner, matched := filter.evaluate("www.example.com", clientInfo{})
+	if !matched {
+		t.Fatal("expected a match")
+	}
+	if winner.action != ActionTypeBlock || winner.kind != RuleExact || winner.value != "www.example.com" {
+		t.Errorf("expected exact block rule to win; got %s %s %q", winner.action, winner.kind, winner.value)
+	}
+	if _, matched := filter.evaluate("example.net", clientInfo{}); matched {
+		t.Error("expected no match")
+	}
+}
+
+func TestSetupPrecedence(t *testing.T) {
+	tests := []TestSetup{
+		{
+			"precedence allow",
+			`filter {
+				precedence allow
+			}`,
+			false,
+		},
+		{
+			"precedence specific",
+			`filter {
+				precedence specific
+			}`,
+			false,
+		},
+		{
+			"precedence priority",
+			`filter {
+				precedence priority
+				block list domain https://example.com/list.txt {
+					priority 10
+				}
+			}`,
+			false,
+		},
+		{
+			"precedence missing",
+			`filter {
+				precedence
+			}`,
+			true,
+		},
+		{
+			"precedence invalid",
+			`filter {
+				precedence block
+			}`,
+			true,
+		},
+		{
+			"precedence extra argument",
+			`filter {
+				precedence specific priority
+			}`,
+			true,
+		},
+		{
+			"inline priority",
+			`filter {
+				deny regex ^ads\. {
+					priority 10
+				}
+			}`,
+			false,
+		},
+		{
+			"inline priority invalid",
+			`filter {
+				block domain example.com {
+					priority -1
+				}
+			}`,
+			true,
+		},
+		{
+			"inline priority missing",
+			`filter {
+				allow wildcard *.example.com {
+					priority
+				}
+			}`,
+			true,
+		},
+		{
+			"inline unknown option",
+			`filter {
+				allow domain example.com {
+					noop 1
+				}
+			}`,
+			true,
+		},
+		{
+			"list priority negative",
+			`filter {
+				block list domain https://example.com/list.txt {
+					priority -1
+				}
+			}`,
+			true,
+		},
+		{
+			"list priority invalid",
+			`filter {
+				block list domain https://example.com/list.txt {
+					priority high
+				}
+			}`,
+			true,
+		},
+	}
+	for _, test := range tests {
+		RunSetupTest(t, test)
+	}
+}
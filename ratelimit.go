@@ -0,0 +1,138 @@
+package filter
+
+import (
+	"container/list"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/coredns/caddy"
+)
+
+// rateLimiter limits the rate of responses to blocked requests of each client,
+// or of each client and name, with a token bucket
+type rateLimiter struct {
+	// rate is the number of tokens added to a bucket each second
+	rate float64
+
+	// burst is the number of tokens a bucket holds
+	burst float64
+
+	// perName keys buckets by the client and requested name, rather than the
+	// client alone
+	perName bool
+
+	// capacity is the number of buckets tracked. The least recently used are
+	// forgotten first, which refills them.
+	capacity int
+
+	lock sync.Mutex
+	// order holds *tokenBucket, from the most recently used
+	order   *list.List
+	buckets map[rateLimitKey]*list.Element
+}
+
+type rateLimitKey struct {
+	client string
+	qname  string
+}
+
+type tokenBucket struct {
+	key    rateLimitKey
+	tokens float64
+	last   time.Time
+}
+
+func parseRateLimit(c *caddy.Controller, f *Filter) error {
+	if f.rateLimit != nil {
+		return c.Err("ratelimit is already configured")
+	}
+	l := &rateLimiter{
+		capacity: 10000,
+		order:    list.New(),
+		buckets:  make(map[rateLimitKey]*list.Element),
+	}
+	args := c.RemainingArgs()
+	if len(args) == 0 || 2 < len(args) {
+		return c.Errf("expected a ratelimit rate and an optional burst; got %q", args)
+	}
+	rate, err := strconv.ParseFloat(args[0], 64)
+	if err != nil || rate <= 0 {
+		return c.Errf("invalid ratelimit rate %q; expected a positive number", args[0])
+	}
+	l.rate = rate
+	// Buckets hold a second of tokens unless a burst is specified
+	l.burst = max(1, rate)
+	if len(args) == 2 {
+		burst, err := strconv.Atoi(args[1])
+		if err != nil || burst < 1 {
+			return c.Errf("invalid ratelimit burst %q; expected a positive integer", args[1])
+		}
+		l.burst = float64(burst)
+	}
+	err = parseBlock(c, func(c *caddy.Controller) error {
+		option := c.Val()
+		if !c.NextArg() {
+			return c.Errf("no value specified for ratelimit option %q", option)
+		}
+		switch option {
+		case "key":
+			switch c.Val() {
+			case "client":
+				l.perName = false
+			case "name":
+				l.perName = true
+			default:
+				return c.Errf("invalid ratelimit key %q; expected 'client' or 'name'", c.Val())
+			}
+		case "capacity":
+			count, err := strconv.Atoi(c.Val())
+			if err != nil || count < 1 {
+				return c.Errf("invalid ratelimit capacity %q; expected a positive integer", c.Val())
+			}
+			l.capacity = count
+		default:
+			return c.Errf("unknown ratelimit option %q; expected 'key' or 'capacity'", option)
+		}
+		return ensureEOL(c)
+	})
+	if err != nil {
+		return err
+	}
+	f.rateLimit = l
+	return nil
+}
+
+// allow takes a token from the bucket of a client's request, and reports
+// whether there was one to take
+func (l *rateLimiter) allow(client clientInfo, qname string, now time.Time) bool {
+	key := rateLimitKey{client: client.key()}
+	if l.perName {
+		key.qname = qname
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var bucket *tokenBucket
+	if elem, ok := l.buckets[key]; ok {
+		l.order.MoveToFront(elem)
+		bucket = elem.Value.(*tokenBucket)
+		if elapsed := now.Sub(bucket.last); 0 < elapsed {
+			bucket.tokens = min(l.burst, bucket.tokens+elapsed.Seconds()*l.rate)
+			bucket.last = now
+		}
+	} else {
+		bucket = &tokenBucket{key: key, tokens: l.burst, last: now}
+		l.buckets[key] = l.order.PushFront(bucket)
+		for l.capacity < l.order.Len() {
+			oldest := l.order.Back()
+			l.order.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*tokenBucket).key)
+		}
+	}
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
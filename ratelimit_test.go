@@ -0,0 +1,234 @@
+package filter
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newTestRateLimiter(t *testing.T, directive string) *rateLimiter {
+	controller := caddy.NewTestController("dns", "filter {\n"+directive+"\n}")
+	filter := newFilter()
+	if err := Parse(controller, filter); err != nil {
+		t.Fatal(err)
+	}
+	return filter.rateLimit
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := newTestRateLimiter(t, "ratelimit 2 3")
+	client := clientInfo{addr: netip.MustParseAddr("192.0.2.1")}
+	other := clientInfo{addr: netip.MustParseAddr("192.0.2.2")}
+	start := time.Unix(1700000000, 0)
+	tests := []struct {
+		name   string
+		client clientInfo
+		qname  string
+		at     time.Time
+		want   bool
+	}{
+		{"burst 1", client, "a.example", start, true},
+		{"burst 2", client, "b.example", start, true},
+		{"burst 3", client, "a.example", start, true},
+		{"over burst", client, "a.example", start, false},
+		{"other client", other, "a.example", start, true},
+		{"refilled token", client, "a.example", start.Add(500 * time.Millisecond), true},
+		{"refilled token spent", client, "a.example", start.Add(500 * time.Millisecond), false},
+		{"refilled to burst", client, "a.example", start.Add(time.Hour), true},
+		{"refilled burst 2", client, "a.example", start.Add(time.Hour), true},
+		{"refilled burst 3", client, "a.example", start.Add(time.Hour), true},
+		{"refilled over burst", client, "a.example", start.Add(time.Hour), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := l.allow(tt.client, tt.qname, tt.at); got != tt.want {
+				t.Errorf("expected %t; got %t", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRateLimiterPerName(t *testing.T) {
+	l := newTestRateLimiter(t, "ratelimit 1 {\nkey name\n}")
+	client := clientInfo{addr: netip.MustParseAddr("192.0.2.1")}
+	now := time.Now()
+	if !l.allow(client, "a.example", now) || l.allow(client, "a.example", now) {
+		t.Error("expected one response for a.example")
+	}
+	if !l.allow(client, "b.example", now) {
+		t.Error("expected b.example to have its own bucket")
+	}
+}
+
+func TestRateLimiterCapacity(t *testing.T) {
+	l := newTestRateLimiter(t, "ratelimit 1 {\ncapacity 2\n}")
+	now := time.Now()
+	for _, addr := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		l.allow(clientInfo{addr: netip.MustParseAddr(addr)}, "a.example", now)
+	}
+	if len(l.buckets) != 2 || l.order.Len() != 2 {
+		t.Fatalf("expected 2 buckets; got %d", len(l.buckets))
+	}
+	if _, ok := l.buckets[rateLimitKey{client: "192.0.2.1"}]; ok {
+		t.Error("expected least recently used bucket to be evicted")
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	filter := NewTestFilter(t, `filter {
+		ratelimit 1 2
+		block domain telemetry.example
+	}`)
+	filter.Build()
+	serve := func(qname string) *dns.Msg {
+		req := new(dns.Msg).SetQuestion(qname, dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		filter.ServeDNS(context.Background(), rec, req)
+		return rec.Msg
+	}
+
+	before := testutil.ToFloat64(suppressedCount.WithLabelValues(""))
+	for i := range 2 {
+		if serve("telemetry.example.") == nil {
+			t.Fatalf("expected response %d within the burst", i)
+		}
+	}
+	if serve("telemetry.example.") != nil {
+		t.Error("expected no response over the limit")
+	}
+	if after := testutil.ToFloat64(suppressedCount.WithLabelValues("")); after-before != 1 {
+		t.Errorf("expected suppressed count to increase by 1; got %v", after-before)
+	}
+	// Requests which aren't blocked aren't limited
+	if serve("www.example.") == nil {
+		t.Error("expected requests which aren't blocked to be passed on")
+	}
+}
+
+func TestRateLimitAudit(t *testing.T) {
+	filter := NewTestFilter(t, `filter {
+		mode audit
+		ratelimit 1
+		block domain telemetry.example
+	}`)
+	filter.Build()
+	for i := range 3 {
+		req := new(dns.Msg).SetQuestion("telemetry.example.", dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		filter.ServeDNS(context.Background(), rec, req)
+		if rec.Msg == nil {
+			t.Fatalf("expected audited request %d to be passed on", i)
+		}
+	}
+}
+
+func TestSetupRateLimit(t *testing.T) {
+	tests := []TestSetup{
+		{
+			"ratelimit",
+			`filter {
+				ratelimit 10
+			}`,
+			false,
+		},
+		{
+			"ratelimit fractional rate",
+			`filter {
+				ratelimit 0.5 5
+			}`,
+			false,
+		},
+		{
+			"ratelimit options",
+			`filter {
+				ratelimit 10 50 {
+					key name
+					capacity 1000
+				}
+			}`,
+			false,
+		},
+		{
+			"ratelimit no rate",
+			`filter {
+				ratelimit
+			}`,
+			true,
+		},
+		{
+			"ratelimit too many arguments",
+			`filter {
+				ratelimit 10 20 30
+			}`,
+			true,
+		},
+		{
+			"ratelimit invalid rate",
+			`filter {
+				ratelimit 0
+			}`,
+			true,
+		},
+		{
+			"ratelimit invalid burst",
+			`filter {
+				ratelimit 10 1.5
+			}`,
+			true,
+		},
+		{
+			"ratelimit duplicate",
+			`filter {
+				ratelimit 10
+				ratelimit 20
+			}`,
+			true,
+		},
+		{
+			"ratelimit invalid key",
+			`filter {
+				ratelimit 10 {
+					key server
+				}
+			}`,
+			true,
+		},
+		{
+			"ratelimit invalid capacity",
+			`filter {
+				ratelimit 10 {
+					capacity 0
+				}
+			}`,
+			true,
+		},
+		{
+			"ratelimit unknown option",
+			`filter {
+				ratelimit 10 {
+					noop 1
+				}
+			}`,
+			true,
+		},
+		{
+			"ratelimit no value",
+			`filter {
+				ratelimit 10 {
+					key
+				}
+			}`,
+			true,
+		},
+	}
+	for _, test := range tests {
+		RunSetupTest(t, test)
+	}
+}
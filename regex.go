@@ -1,8 +1,6 @@
 package filter
 
 import (
-	"bufio"
-	"bytes"
 	"regexp"
 
 	"github.com/coredns/caddy"
@@ -21,25 +19,12 @@ func parseActionRegex(c *caddy.Controller, f *Filter, a ActionType) error {
 		if err := f.blockConfig.AddRegex(c.Val()); err != nil {
 			return err
 		}
-	}
-	return ensureEOL(c)
-}
-
-func parseActionListRegex(c *caddy.Controller, f *Filter, a ActionType) error {
-	if !c.NextArg() {
-		return c.Errf("no %s regex list specified", a)
-	}
-	switch a {
-	case ActionTypeAllow:
-		if err := f.allowConfig.AddRegexList(c.Val()); err != nil {
-			return err
-		}
-	case ActionTypeBlock:
-		if err := f.blockConfig.AddRegexList(c.Val()); err != nil {
+	case ActionTypeDeny:
+		if err := f.denyConfig.AddRegex(c.Val()); err != nil {
 			return err
 		}
 	}
-	return ensureEOL(c)
+	return parseRulePriority(c, f, a, RuleRegex, c.Val())
 }
 
 // AddRegex to match
@@ -48,67 +33,24 @@ func (a ActionConfig) AddRegex(expr string) error {
 	if err != nil {
 		return err
 	}
+	if err := checkRegexLiterals(expr); err != nil {
+		return err
+	}
 	if _, ok := a.regex[expr]; !ok {
 		a.regex[expr] = comp
 	}
 	return nil
 }
 
-// AddRegexList to match contents
-func (a ActionConfig) AddRegexList(url string) error {
-	if _, ok := a.regexLists[url]; !ok {
-		loadFunc, err := a.GetListLoader(url)
-		if err != nil {
-			return err
-		}
-		a.regexLists[url] = loadFunc
-	}
-	return nil
+func init() {
+	RegisterListParser("regex", ListParserFunc(parseRegexLine))
 }
 
-// BuildRegExps consolidates individual regular expressions then loads and
-// compiles regular expressions from any configured lists
-func (a ActionConfig) BuildRegExps(regexps map[string]*regexp.Regexp) {
-	for expression, regex := range a.regex {
-		regexps[expression] = regex
-	}
-
-	for domain, loader := range a.regexLists {
-		file, err := loader.Load(domain)
-		if err != nil {
-			log.Errorf(
-				"there was a problem fetching %s regex list %q; %s",
-				a.configType,
-				domain,
-				err,
-			)
-			continue
-		}
-		defer file.Close()
-		scanner := bufio.NewScanner(file)
-		scanner.Split(bufio.ScanLines)
-		for scanner.Scan() {
-			line := scanner.Bytes()
-			line = bytes.TrimSpace(line)
-			if a.shouldSkip(line) {
-				continue
-			}
-			lineString := string(line)
-			if _, ok := regexps[lineString]; ok {
-				continue
-			}
-			expression, err := regexp.Compile(lineString)
-			if err != nil {
-				log.Debugf(
-					"error compiling %s regular expression %q from list %q; %s",
-					a.configType,
-					lineString,
-					domain,
-					err,
-				)
-				continue
-			}
-			regexps[lineString] = expression
-		}
+// parseRegexLine parses a line of a list of regular expressions, one per line
+func parseRegexLine(line []byte) ([]Rule, error) {
+	expression, err := regexp.Compile(string(line))
+	if err != nil {
+		return nil, err
 	}
+	return []Rule{{Kind: RuleRegex, Value: string(line), Regexp: expression}}, nil
 }
@@ -29,6 +29,20 @@ func TestRegexInvalid(t *testing.T) {
 			}`,
 			true,
 		},
+		{
+			"check regex uppercase literal",
+			`filter {
+				block regex ^Ads\.example\.com$
+			}`,
+			true,
+		},
+		{
+			"check regex non-ascii literal",
+			`filter {
+				block regex ^bücher\.example$
+			}`,
+			true,
+		},
 	}
 	for _, test := range tests {
 		RunSetupTest(t, test)
@@ -0,0 +1,510 @@
+package filter
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/nonwriter"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// ListResolver resolves the host names of remote lists. *net.Resolver
+// implements ListResolver.
+type ListResolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+// resolverTimeout is the maximum time for a single resolver exchange
+const resolverTimeout = 5 * time.Second
+
+// resolverDialer returns a dial function which resolves host names using r,
+// then connects to each address until a connection succeeds
+func resolverDialer(r ListResolver) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ipNetwork := "ip"
+		switch network {
+		case "tcp4", "udp4":
+			ipNetwork = "ip4"
+		case "tcp6", "udp6":
+			ipNetwork = "ip6"
+		}
+		addrs, err := r.LookupNetIP(ctx, ipNetwork, host)
+		if err != nil {
+			return nil, err
+		}
+		var d net.Dialer
+		var errs []error
+		for _, ip := range addrs {
+			conn, err := d.DialContext(ctx, network, net.JoinHostPort(ip.Unmap().String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			errs = append(errs, err)
+		}
+		return nil, errors.Join(errs...)
+	}
+}
+
+// ResolverTransport is the transport used by a DNSListResolver
+type ResolverTransport int
+
+const (
+	// ResolverTransportUDP queries using UDP, retrying using TCP if the
+	// response is truncated
+	ResolverTransportUDP ResolverTransport = iota
+
+	// ResolverTransportTCP queries using only TCP
+	ResolverTransportTCP
+
+	// ResolverTransportTLS queries using DNS-over-TLS (RFC 7858)
+	ResolverTransportTLS
+)
+
+// String returns the scheme of the transport
+func (t ResolverTransport) String() string {
+	switch t {
+	case ResolverTransportUDP:
+		return "dns"
+	case ResolverTransportTCP:
+		return "tcp"
+	case ResolverTransportTLS:
+		return "tls"
+	default:
+		return fmt.Sprintf("ResolverTransport(%d)", int(t))
+	}
+}
+
+// DNSListResolver resolves list host names using a single server over UDP,
+// TCP, or TLS
+type DNSListResolver struct {
+	// Addr is the address of the server
+	Addr netip.AddrPort
+
+	Transport ResolverTransport
+
+	// ServerName is used to verify the server's certificate when using TLS
+	ServerName string
+
+	// TLSConfig used for TLS connections. A configuration with ServerName is
+	// used if nil.
+	TLSConfig *tls.Config
+}
+
+// LookupNetIP implements ListResolver
+func (d *DNSListResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	return lookupNetIP(ctx, d, network, host)
+}
+
+func (d *DNSListResolver) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	msg.Id = dns.Id()
+	client := &dns.Client{Timeout: resolverTimeout}
+	switch d.Transport {
+	case ResolverTransportUDP:
+		client.Net = "udp"
+		// Advertise a buffer large enough for most responses, so that fewer
+		// are truncated
+		msg.SetEdns0(dns.DefaultMsgSize, false)
+	case ResolverTransportTCP:
+		client.Net = "tcp"
+	case ResolverTransportTLS:
+		client.Net = "tcp-tls"
+		client.TLSConfig = d.TLSConfig
+		if client.TLSConfig == nil {
+			client.TLSConfig = &tls.Config{ServerName: d.ServerName}
+		}
+	default:
+		return nil, fmt.Errorf("unknown list resolver transport %s", d.Transport)
+	}
+	reply, _, err := client.ExchangeContext(ctx, msg, d.Addr.String())
+	if err != nil {
+		return nil, err
+	}
+	if reply.Truncated && d.Transport == ResolverTransportUDP {
+		client.Net = "tcp"
+		reply, _, err = client.ExchangeContext(ctx, msg, d.Addr.String())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return reply, nil
+}
+
+// exchanger sends a single DNS query and returns its response
+type exchanger interface {
+	exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error)
+}
+
+// lookupNetIP resolves a host's addresses by querying A and AAAA records, as
+// selected by network ("ip", "ip4", or "ip6"), through an exchanger
+func lookupNetIP(ctx context.Context, ex exchanger, network, host string) ([]netip.Addr, error) {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return []netip.Addr{addr}, nil
+	}
+	var qtypes []uint16
+	switch network {
+	case "ip4":
+		qtypes = []uint16{dns.TypeA}
+	case "ip6":
+		qtypes = []uint16{dns.TypeAAAA}
+	default:
+		qtypes = []uint16{dns.TypeA, dns.TypeAAAA}
+	}
+
+	var addrs []netip.Addr
+	var errs []error
+	for _, qtype := range qtypes {
+		msg := new(dns.Msg)
+		msg.SetQuestion(dns.Fqdn(host), qtype)
+		resp, err := ex.exchange(ctx, msg)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			errs = append(errs, fmt.Errorf(
+				"lookup %s %s: %s",
+				host,
+				dns.TypeToString[qtype],
+				dns.RcodeToString[resp.Rcode],
+			))
+			continue
+		}
+		for _, rr := range resp.Answer {
+			switch rec := rr.(type) {
+			case *dns.A:
+				if addr, ok := netip.AddrFromSlice(rec.A.To4()); ok {
+					addrs = append(addrs, addr)
+				}
+			case *dns.AAAA:
+				if addr, ok := netip.AddrFromSlice(rec.AAAA); ok {
+					addrs = append(addrs, addr)
+				}
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		if len(errs) != 0 {
+			return nil, errors.Join(errs...)
+		}
+		return nil, fmt.Errorf("lookup %s: no addresses found", host)
+	}
+	return addrs, nil
+}
+
+// DoHListResolver resolves list host names using DNS-over-HTTPS (RFC 8484)
+type DoHListResolver struct {
+	// URL of the DNS-over-HTTPS endpoint, such as https://9.9.9.9/dns-query
+	URL string
+
+	// ServerName is used to verify the server's certificate and as the
+	// request's Host, if set
+	ServerName string
+
+	// Client used for requests. A client with the default transport and
+	// ServerName is used if nil.
+	Client *http.Client
+
+	// once builds defaultClient, which is reused so that its connections are
+	// too
+	once          sync.Once
+	defaultClient *http.Client
+}
+
+// LookupNetIP implements ListResolver
+func (d *DoHListResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	return lookupNetIP(ctx, d, network, host)
+}
+
+func (d *DoHListResolver) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	// RFC 8484 Section 4.1; the message ID should be zero for cache friendliness
+	msg.Id = 0
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, resolverTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(packed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	if len(d.ServerName) != 0 {
+		req.Host = d.ServerName
+	}
+	resp, err := d.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("dns-over-https server %q returned %s", d.URL, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	reply := new(dns.Msg)
+	if err := reply.Unpack(body); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func (d *DoHListResolver) client() *http.Client {
+	if d.Client != nil {
+		return d.Client
+	}
+	d.once.Do(func() {
+		transport := listTransport.Clone()
+		transport.Proxy = nil
+		transport.TLSClientConfig = &tls.Config{ServerName: d.ServerName}
+		d.defaultClient = &http.Client{Transport: transport}
+	})
+	return d.defaultClient
+}
+
+// DoQListResolver resolves list host names using DNS-over-QUIC (RFC 9250)
+type DoQListResolver struct {
+	// Addr is the address of the DNS-over-QUIC server
+	Addr netip.AddrPort
+
+	// ServerName is used to verify the server's certificate
+	ServerName string
+
+	// TLSConfig used for connections. A configuration with ServerName and the
+	// 'doq' protocol is used if nil.
+	TLSConfig *tls.Config
+}
+
+// LookupNetIP implements ListResolver
+func (d *DoQListResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	return lookupNetIP(ctx, d, network, host)
+}
+
+func (d *DoQListResolver) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	// RFC 9250 Section 4.2.1; the message ID must be zero
+	msg.Id = 0
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, resolverTimeout)
+	defer cancel()
+
+	tlsConfig := d.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{ServerName: d.ServerName}
+	}
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{"doq"}
+
+	conn, err := quic.DialAddr(ctx, d.Addr.String(), tlsConfig, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.CloseWithError(0, "")
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+	// Each message is prefixed with its length; RFC 9250 Section 4.2
+	query := binary.BigEndian.AppendUint16(nil, uint16(len(packed)))
+	if _, err := stream.Write(append(query, packed...)); err != nil {
+		return nil, err
+	}
+	// The client must indicate that no more data will be sent on the stream
+	if err := stream.Close(); err != nil {
+		return nil, err
+	}
+
+	var length uint16
+	if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(stream, body); err != nil {
+		return nil, err
+	}
+	reply := new(dns.Msg)
+	if err := reply.Unpack(body); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// ResolverPolicy selects how a ResolverGroup uses its resolvers
+type ResolverPolicy int
+
+const (
+	// ResolverPolicySequential tries each resolver in order until one succeeds
+	ResolverPolicySequential ResolverPolicy = iota
+
+	// ResolverPolicyRace queries all resolvers at once and uses the first
+	// successful answer
+	ResolverPolicyRace
+)
+
+// NamedListResolver is a ListResolver with a name used to report its failures
+type NamedListResolver struct {
+	Name string
+	ListResolver
+}
+
+// ResolverGroup resolves list host names using several resolvers, so that
+// lists may still be fetched while some of them are unreachable. Each failed
+// attempt is logged with the name of its resolver.
+type ResolverGroup struct {
+	Resolvers []NamedListResolver
+	Policy    ResolverPolicy
+
+	// Timeout is the maximum time of a single resolver's attempt. Zero uses
+	// resolverTimeout.
+	Timeout time.Duration
+}
+
+// LookupNetIP implements ListResolver
+func (g *ResolverGroup) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	if len(g.Resolvers) == 0 {
+		return nil, fmt.Errorf("lookup %s: no list resolvers configured", host)
+	}
+	if g.Policy == ResolverPolicyRace {
+		return g.race(ctx, network, host)
+	}
+	var errs []error
+	for _, r := range g.Resolvers {
+		addrs, err := g.attempt(ctx, r, network, host)
+		if err == nil {
+			return addrs, nil
+		}
+		errs = append(errs, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// race queries every resolver concurrently, returning the first answer
+func (g *ResolverGroup) race(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		addrs []netip.Addr
+		err   error
+	}
+	results := make(chan result, len(g.Resolvers))
+	for _, r := range g.Resolvers {
+		go func(r NamedListResolver) {
+			addrs, err := g.attempt(ctx, r, network, host)
+			results <- result{addrs, err}
+		}(r)
+	}
+	var errs []error
+	for range g.Resolvers {
+		res := <-results
+		if res.err == nil {
+			return res.addrs, nil
+		}
+		errs = append(errs, res.err)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// attempt resolves host using a single resolver, logging any failure
+func (g *ResolverGroup) attempt(ctx context.Context, r NamedListResolver, network, host string) ([]netip.Addr, error) {
+	timeout := g.Timeout
+	if timeout == 0 {
+		timeout = resolverTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	addrs, err := r.LookupNetIP(ctx, network, host)
+	if err != nil {
+		// Attempts abandoned after another resolver answered aren't failures
+		if errors.Is(ctx.Err(), context.Canceled) {
+			return nil, err
+		}
+		log.Warningf("list resolver %s failed to resolve %q; %s", r.Name, host, err)
+		return nil, fmt.Errorf("list resolver %s; %w", r.Name, err)
+	}
+	return addrs, nil
+}
+
+// NextListResolver resolves list host names in-process using the plugins that
+// follow filter in its server block, such as forward or cache. Filter itself
+// isn't consulted, so lists are never blocked by their own entries.
+type NextListResolver struct {
+	Filter *Filter
+}
+
+// LookupNetIP implements ListResolver
+func (n *NextListResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	return lookupNetIP(ctx, n, network, host)
+}
+
+func (n *NextListResolver) exchange(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	// The plugin chain is only complete once the server is set up
+	next := n.Filter.Next
+	if next == nil {
+		return nil, errors.New("no plugins follow filter in the server block")
+	}
+	msg.Id = dns.Id()
+	w := nonwriter.New(&internalResponseWriter{})
+	rcode, err := next.ServeDNS(ctx, w, msg)
+	if w.Msg != nil {
+		return w.Msg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Handlers that don't write a response return the response code instead
+	reply := new(dns.Msg)
+	reply.SetRcode(msg, rcode)
+	return reply, nil
+}
+
+// internalResponseWriter is the dns.ResponseWriter of queries made by filter
+// itself. It appears as a TCP client on the loopback address, so that plugins
+// don't truncate responses to fit a UDP message.
+type internalResponseWriter struct{}
+
+func (internalResponseWriter) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (internalResponseWriter) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 0}
+}
+
+func (internalResponseWriter) WriteMsg(*dns.Msg) error { return nil }
+
+func (internalResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+
+func (internalResponseWriter) Close() error { return nil }
+
+func (internalResponseWriter) TsigStatus() error { return nil }
+
+func (internalResponseWriter) TsigTimersOnly(bool) {}
+
+func (internalResponseWriter) Hijack() {}
@@ -0,0 +1,443 @@
+package filter
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// testResolverReply answers A queries for lists.example with the loopback
+// address and fails all other names
+func testResolverReply(req *dns.Msg) *dns.Msg {
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	if req.Question[0].Name != "lists.example." {
+		reply.Rcode = dns.RcodeNameError
+		return reply
+	}
+	if req.Question[0].Qtype == dns.TypeA {
+		reply.Answer = append(reply.Answer, &dns.A{
+			Hdr: dns.RR_Header{
+				Name:   req.Question[0].Name,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    60,
+			},
+			A: net.IPv4(127, 0, 0, 1),
+		})
+	}
+	return reply
+}
+
+func newTestDoHServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/dns-query" || r.Header.Get("Content-Type") != "application/dns-message" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		req := new(dns.Msg)
+		if err := req.Unpack(body); err != nil || len(req.Question) != 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		packed, _ := testResolverReply(req).Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(packed)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestDoHListResolver(t *testing.T) {
+	doh := newTestDoHServer(t)
+	lists := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("example.com\nexample.net\n"))
+	}))
+	defer lists.Close()
+	_, port, _ := net.SplitHostPort(lists.Listener.Addr().String())
+
+	filter := NewTestFilter(t, `filter {
+		block list domain http://lists.example:`+port+`/list.txt
+	}`)
+	filter.blockConfig.HTTPLoader.Defaults.Resolver = &DoHListResolver{
+		URL:    doh.URL + "/dns-query",
+		Client: doh.Client(),
+	}
+	filter.Build()
+	if len(filter.blockDomains) != 2 {
+		t.Errorf("expected 2 domains; got %d", len(filter.blockDomains))
+	}
+
+	resolver := &DoHListResolver{URL: doh.URL + "/dns-query", Client: doh.Client()}
+	if _, err := resolver.LookupNetIP(context.Background(), "ip", "unknown.example"); err == nil {
+		t.Error("expected error resolving unknown name")
+	}
+	resolver.URL = doh.URL + "/noop"
+	if _, err := resolver.LookupNetIP(context.Background(), "ip", "lists.example"); err == nil {
+		t.Error("expected error from invalid endpoint")
+	}
+}
+
+func TestDoHListResolverClient(t *testing.T) {
+	resolver := &DoHListResolver{URL: "https://9.9.9.9/dns-query", ServerName: "dns.quad9.net"}
+	client := resolver.client()
+	if client != resolver.client() {
+		t.Error("expected client to be reused")
+	}
+	transport := client.Transport.(*http.Transport)
+	if transport.TLSClientConfig.ServerName != "dns.quad9.net" {
+		t.Errorf("expected server name %q; got %q", "dns.quad9.net", transport.TLSClientConfig.ServerName)
+	}
+	if transport.IdleConnTimeout == 0 {
+		t.Error("expected idle connections to time out")
+	}
+}
+
+func TestDoQListResolver(t *testing.T) {
+	_, _, cert := testCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dns.example"},
+		DNSNames:              []string{"dns.example"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}, nil)
+	listener, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"doq"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				stream, err := conn.AcceptStream(context.Background())
+				if err != nil {
+					return
+				}
+				defer stream.Close()
+				var length uint16
+				if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
+					return
+				}
+				body := make([]byte, length)
+				if _, err := io.ReadFull(stream, body); err != nil {
+					return
+				}
+				req := new(dns.Msg)
+				if err := req.Unpack(body); err != nil || req.Id != 0 {
+					return
+				}
+				packed, _ := testResolverReply(req).Pack()
+				stream.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(packed))), packed...))
+			}()
+		}
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	resolver := &DoQListResolver{
+		Addr: netip.MustParseAddrPort(listener.Addr().String()),
+		TLSConfig: &tls.Config{
+			ServerName: "dns.example",
+			RootCAs:    roots,
+		},
+	}
+	addrs, err := resolver.LookupNetIP(context.Background(), "ip4", "lists.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 1 || addrs[0] != netip.MustParseAddr("127.0.0.1") {
+		t.Errorf("expected 127.0.0.1; got %v", addrs)
+	}
+	if _, err := resolver.LookupNetIP(context.Background(), "ip", "unknown.example"); err == nil {
+		t.Error("expected error resolving unknown name")
+	}
+}
+
+// testListResolver resolves every name to addr after delay, or fails if addr
+// is invalid
+type testListResolver struct {
+	addr  netip.Addr
+	delay time.Duration
+}
+
+func (r testListResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	select {
+	case <-time.After(r.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if !r.addr.IsValid() {
+		return nil, errors.New("server failure")
+	}
+	return []netip.Addr{r.addr}, nil
+}
+
+func TestResolverGroup(t *testing.T) {
+	first := netip.MustParseAddr("192.0.2.1")
+	second := netip.MustParseAddr("192.0.2.2")
+	tests := []struct {
+		name    string
+		group   ResolverGroup
+		want    netip.Addr
+		wantErr bool
+	}{
+		{
+			"sequential first",
+			ResolverGroup{Resolvers: []NamedListResolver{
+				{"first", testListResolver{first, 0}},
+				{"second", testListResolver{second, 0}},
+			}},
+			first,
+			false,
+		},
+		{
+			"sequential failover",
+			ResolverGroup{Resolvers: []NamedListResolver{
+				{"failing", testListResolver{}},
+				{"second", testListResolver{second, 0}},
+			}},
+			second,
+			false,
+		},
+		{
+			"sequential timeout",
+			ResolverGroup{
+				Resolvers: []NamedListResolver{
+					{"slow", testListResolver{first, time.Minute}},
+					{"second", testListResolver{second, 0}},
+				},
+				Timeout: 50 * time.Millisecond,
+			},
+			second,
+			false,
+		},
+		{
+			"sequential all failing",
+			ResolverGroup{Resolvers: []NamedListResolver{
+				{"failing", testListResolver{}},
+				{"failing", testListResolver{}},
+			}},
+			netip.Addr{},
+			true,
+		},
+		{
+			"race fastest",
+			ResolverGroup{
+				Resolvers: []NamedListResolver{
+					{"slow", testListResolver{first, time.Minute}},
+					{"failing", testListResolver{}},
+					{"fast", testListResolver{second, 10 * time.Millisecond}},
+				},
+				Policy: ResolverPolicyRace,
+			},
+			second,
+			false,
+		},
+		{
+			"race all failing",
+			ResolverGroup{
+				Resolvers: []NamedListResolver{
+					{"slow", testListResolver{first, time.Minute}},
+					{"failing", testListResolver{}},
+				},
+				Policy:  ResolverPolicyRace,
+				Timeout: 50 * time.Millisecond,
+			},
+			netip.Addr{},
+			true,
+		},
+		{
+			"empty",
+			ResolverGroup{},
+			netip.Addr{},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addrs, err := tt.group.LookupNetIP(context.Background(), "ip", "lists.example")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error: %v, wanterr: %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && (len(addrs) != 1 || addrs[0] != tt.want) {
+				t.Errorf("expected %s; got %v", tt.want, addrs)
+			}
+		})
+	}
+}
+
+func TestNextListResolver(t *testing.T) {
+	lists := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("example.com\nexample.net\n"))
+	}))
+	defer lists.Close()
+	_, port, _ := net.SplitHostPort(lists.Listener.Addr().String())
+	corefile := `filter {
+		listresolver next
+		block list domain http://lists.example:` + port + `/list.txt
+	}`
+
+	var queries int
+	filter := NewTestFilter(t, corefile)
+	filter.Next = plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		queries++
+		w.WriteMsg(testResolverReply(r))
+		return dns.RcodeSuccess, nil
+	})
+	filter.Build()
+	if len(filter.blockDomains) != 2 {
+		t.Errorf("expected 2 domains; got %d", len(filter.blockDomains))
+	}
+	if queries == 0 {
+		t.Error("expected list host to be resolved by next plugin")
+	}
+
+	filter = NewTestFilter(t, corefile)
+	filter.Build()
+	if len(filter.blockDomains) != 0 {
+		t.Errorf("expected no domains when next plugin fails; got %d", len(filter.blockDomains))
+	}
+
+	resolver := &NextListResolver{Filter: newFilter()}
+	if _, err := resolver.LookupNetIP(context.Background(), "ip", "lists.example"); err == nil {
+		t.Error("expected error without next plugin")
+	}
+}
+
+// startTestDNSServer serves testResolverReply on a local miekg/dns server of
+// the given network ("udp", "tcp", or "tcp-tls") at addr. UDP responses are
+// truncated if truncate is set. The network of each query is sent to queries.
+func startTestDNSServer(t *testing.T, network, addr string, tlsConfig *tls.Config, truncate bool, queries chan<- string) netip.AddrPort {
+	t.Helper()
+	server := &dns.Server{
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			queries <- network
+			reply := testResolverReply(r)
+			if truncate && network == "udp" {
+				reply.Answer = nil
+				reply.Truncated = true
+			}
+			w.WriteMsg(reply)
+		}),
+	}
+	started := make(chan struct{})
+	server.NotifyStartedFunc = func() { close(started) }
+	var local net.Addr
+	if network == "udp" {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.PacketConn = conn
+		local = conn.LocalAddr()
+	} else {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tlsConfig != nil {
+			listener = tls.NewListener(listener, tlsConfig)
+		}
+		server.Listener = listener
+		local = listener.Addr()
+	}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return netip.MustParseAddrPort(local.String())
+}
+
+func TestDNSListResolver(t *testing.T) {
+	_, _, cert := testCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dns.example"},
+		DNSNames:              []string{"dns.example"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+
+	tests := []struct {
+		name      string
+		transport ResolverTransport
+		servers   []string
+		truncate  bool
+		want      []string
+	}{
+		{"udp", ResolverTransportUDP, []string{"udp", "tcp"}, false, []string{"udp"}},
+		{"udp truncated", ResolverTransportUDP, []string{"udp", "tcp"}, true, []string{"udp", "tcp"}},
+		{"tcp", ResolverTransportTCP, []string{"udp", "tcp"}, false, []string{"tcp"}},
+		{"tcp without udp", ResolverTransportTCP, []string{"tcp"}, false, []string{"tcp"}},
+		{"tls", ResolverTransportTLS, []string{"tcp-tls"}, false, []string{"tcp-tls"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queries := make(chan string, 4)
+			var tlsConfig *tls.Config
+			if tt.transport == ResolverTransportTLS {
+				tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+			}
+			// Every server listens on the same port
+			addr := "127.0.0.1:0"
+			var resolverAddr netip.AddrPort
+			for _, network := range tt.servers {
+				resolverAddr = startTestDNSServer(t, network, addr, tlsConfig, tt.truncate, queries)
+				addr = resolverAddr.String()
+			}
+			resolver := &DNSListResolver{
+				Addr:      resolverAddr,
+				Transport: tt.transport,
+				TLSConfig: &tls.Config{ServerName: "dns.example", RootCAs: roots},
+			}
+			addrs, err := resolver.LookupNetIP(context.Background(), "ip4", "lists.example")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(addrs) != 1 || addrs[0] != netip.MustParseAddr("127.0.0.1") {
+				t.Errorf("expected 127.0.0.1; got %v", addrs)
+			}
+			// Queries are recorded before they're answered
+			var got []string
+			for len(queries) != 0 {
+				got = append(got, <-queries)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("expected queries over %v; got %v", tt.want, got)
+			}
+		})
+	}
+}
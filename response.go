@@ -3,6 +3,7 @@ package filter
 import (
 	"net"
 	"net/netip"
+	"slices"
 
 	"github.com/miekg/dns"
 )
@@ -56,6 +57,53 @@ func (r RespAddress) Render(qname string, qtype uint16) RenderedResponse {
 	return RenderedResponse{dns.RcodeSuccess, false, []dns.RR{answer}}
 }
 
+// RespListed implements Response
+// Returns the addresses or canonical name listed for a domain, such as in a
+// hosts file. A canonical name is returned as a CNAME record for any type of
+// request. Requests for a record type without listed addresses return no
+// records.
+type RespListed struct {
+	Addrs  []netip.Addr
+	Target string
+}
+
+func (r RespListed) Render(qname string, qtype uint16) RenderedResponse {
+	header := dns.RR_Header{
+		Name:   qname,
+		Class:  dns.ClassINET,
+		Ttl:    3600,
+		Rrtype: qtype,
+	}
+	if r.Target != "" {
+		header.Rrtype = dns.TypeCNAME
+		answer := &dns.CNAME{Hdr: header, Target: dns.Fqdn(r.Target)}
+		return RenderedResponse{dns.RcodeSuccess, false, []dns.RR{answer}}
+	}
+	answers := []dns.RR{}
+	for _, addr := range r.Addrs {
+		addr = addr.Unmap()
+		switch {
+		case qtype == dns.TypeA && addr.Is4():
+			answers = append(answers, &dns.A{Hdr: header, A: net.IP(addr.AsSlice())})
+		case qtype == dns.TypeAAAA && addr.Is6():
+			answers = append(answers, &dns.AAAA{Hdr: header, AAAA: net.IP(addr.AsSlice())})
+		}
+	}
+	return RenderedResponse{dns.RcodeSuccess, false, answers}
+}
+
+// with returns the response with an address or canonical name added. Addresses
+// already listed are ignored, and only the first canonical name is kept.
+func (r RespListed) with(addr netip.Addr, target string) RespListed {
+	if addr.IsValid() && !slices.Contains(r.Addrs, addr) {
+		r.Addrs = append(slices.Clip(r.Addrs), addr)
+	}
+	if r.Target == "" {
+		r.Target = target
+	}
+	return r
+}
+
 // RespNoData implements Response
 // Returns no records
 type RespNoData struct{}
@@ -64,6 +112,14 @@ func (r RespNoData) Render(_ string, _ uint16) RenderedResponse {
 	return RenderedResponse{dns.RcodeSuccess, false, []dns.RR{}}
 }
 
+// RespRefused implements Response
+// Returns no records and a REFUSED error code
+type RespRefused struct{}
+
+func (r RespRefused) Render(_ string, _ uint16) RenderedResponse {
+	return RenderedResponse{dns.RcodeRefused, false, []dns.RR{}}
+}
+
 // RespNXDomain implements Response
 // Returns a dummy SOA record and an NXDOMAIN error code
 type RespNXDomain struct{}
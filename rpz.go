@@ -0,0 +1,40 @@
+package filter
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+func init() {
+	RegisterListParser("rpz", ListParserFunc(parseRPZLine))
+}
+
+// parseRPZLine parses a QNAME trigger of a Response Policy Zone, relative to
+// the zone origin, optionally followed by 'CNAME' and its policy target.
+// Wildcard triggers match the domain and its subdomains, and other triggers
+// match the domain only. Triggers whose target is 'rpz-passthru.' are
+// exceptions.
+func parseRPZLine(line []byte) ([]Rule, error) {
+	fields := bytes.Fields(line)
+	var passthru bool
+	switch len(fields) {
+	case 1:
+	case 3:
+		if !strings.EqualFold(string(fields[1]), "CNAME") {
+			return nil, fmt.Errorf("unexpected rpz record type %q; expected 'CNAME'", fields[1])
+		}
+		passthru = strings.EqualFold(string(fields[2]), rpzPassthru)
+	default:
+		return nil, fmt.Errorf("expected TRIGGER [ CNAME TARGET ]; got %q", line)
+	}
+	rule := Rule{Kind: RuleExact, Value: string(fields[0]), Exception: passthru}
+	if wildcard, ok := strings.CutPrefix(rule.Value, "*."); ok {
+		rule.Kind = RuleSuffix
+		rule.Value = wildcard
+	}
+	if !validName(rule.Value) {
+		return nil, fmt.Errorf("rpz trigger %q is invalid", fields[0])
+	}
+	return []Rule{rule}, nil
+}
@@ -0,0 +1,62 @@
+package filter
+
+import (
+	"testing"
+)
+
+func TestParseRPZLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    Rule
+		wantErr bool
+	}{
+		{"example.com", Rule{Kind: RuleExact, Value: "example.com"}, false},
+		{"*.example.com", Rule{Kind: RuleSuffix, Value: "example.com"}, false},
+		{"example.com CNAME .", Rule{Kind: RuleExact, Value: "example.com"}, false},
+		{"example.com cname *.", Rule{Kind: RuleExact, Value: "example.com"}, false},
+		{
+			"example.com CNAME rpz-passthru.",
+			Rule{Kind: RuleExact, Value: "example.com", Exception: true},
+			false,
+		},
+		{
+			"*.example.com CNAME RPZ-PASSTHRU.",
+			Rule{Kind: RuleSuffix, Value: "example.com", Exception: true},
+			false,
+		},
+		{"example.com A 192.0.2.1", Rule{}, true},
+		{"example.com CNAME", Rule{}, true},
+		{"exa$mple.com", Rule{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			rules, err := parseRPZLine([]byte(tt.line))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error: %v, wanterr: %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(rules) != 1 || rules[0].Kind != tt.want.Kind ||
+				rules[0].Value != tt.want.Value || rules[0].Exception != tt.want.Exception {
+				t.Errorf("expected %+v; got %+v", tt.want, rules)
+			}
+		})
+	}
+}
+
+func TestRPZListFile(t *testing.T) {
+	path := writeTestFile(t, "rpz.txt", []byte(
+		"example.com\n*.example.net CNAME .\nsafe.example.net CNAME rpz-passthru.\n",
+	))
+	corefile := `filter {
+		block list rpz file://` + path + `
+	}`
+	tests := []TestFilterRequest{
+		{"check exact trigger", "example.com", true},
+		{"check subdomain of exact trigger", "www.example.com", false},
+		{"check wildcard trigger", "www.example.net", true},
+		{"check passthru trigger", "safe.example.net", false},
+	}
+	RunFilterTests(t, corefile, tests)
+}
@@ -0,0 +1,110 @@
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"embed"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/coredns/caddy"
+)
+
+// safeSearchMappings are the built-in mappings of each safe search provider,
+// in the format of a records list
+//
+//go:embed safesearch/*.txt
+var safeSearchMappings embed.FS
+
+// safeSearchProviders are the providers enforced if none are specified.
+// youtube-moderate may be specified instead of youtube.
+var safeSearchProviders = []string{"google", "bing", "duckduckgo", "youtube"}
+
+// parseSafeSearch adds the mappings of safe search providers to the filter's
+// overrides, so that they're answered before requests are allowed or blocked
+func parseSafeSearch(c *caddy.Controller, f *Filter) error {
+	providers := c.RemainingArgs()
+	if len(providers) == 0 {
+		providers = safeSearchProviders
+	}
+	mappings := make(map[ruleKey][]Rule)
+	var youtube string
+	for _, provider := range providers {
+		if provider == "youtube" || provider == "youtube-moderate" {
+			if youtube != "" && youtube != provider {
+				return c.Err("safesearch providers 'youtube' and 'youtube-moderate' are exclusive")
+			}
+			youtube = provider
+		}
+		data, err := safeSearchMappings.ReadFile("safesearch/" + provider + ".txt")
+		if err != nil {
+			return c.Errf(
+				"unknown safesearch provider %q; "+
+					"expected 'google', 'bing', 'duckduckgo', 'youtube', or 'youtube-moderate'",
+				provider,
+			)
+		}
+		if err := readSafeSearchMappings(bytes.NewReader(data), mappings); err != nil {
+			return c.Errf("invalid safesearch provider %q; %s", provider, err)
+		}
+	}
+
+	err := parseBlock(c, func(c *caddy.Controller) error {
+		switch c.Val() {
+		case "mappings":
+			if !c.NextArg() {
+				return c.Err("no safesearch mappings file specified")
+			}
+			file, err := os.Open(c.Val())
+			if err != nil {
+				return c.Errf("error reading safesearch mappings; %s", err)
+			}
+			defer file.Close()
+			// Mappings of the file replace those of the providers for the same
+			// names
+			custom := make(map[ruleKey][]Rule)
+			if err := readSafeSearchMappings(file, custom); err != nil {
+				return c.Errf("invalid safesearch mappings %q; %s", c.Val(), err)
+			}
+			for key, rules := range custom {
+				mappings[key] = rules
+			}
+		default:
+			return c.Errf("unknown safesearch option %q; expected 'mappings'", c.Val())
+		}
+		return ensureEOL(c)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, rules := range mappings {
+		for _, rule := range rules {
+			f.overrideConfig.AddAnswer(rule)
+		}
+	}
+	return nil
+}
+
+// readSafeSearchMappings reads the records of a mappings file, grouped by the
+// name they map
+func readSafeSearchMappings(r io.Reader, mappings map[ruleKey][]Rule) error {
+	scanner := bufio.NewScanner(r)
+	for number := 1; scanner.Scan(); number++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if (ActionConfig{}).shouldSkip(line) {
+			continue
+		}
+		rules, err := parseRecordsLine(line)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", number, err)
+		}
+		for _, rule := range rules {
+			name, _ := normalizeName(rule.Value)
+			key := ruleKey{rule.Kind, name}
+			mappings[key] = append(mappings[key], rule)
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,286 @@
+package filter
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/miekg/dns"
+)
+
+// safeSearchNext answers A requests for the safe search hostnames
+func safeSearchNext() plugin.Handler {
+	addrs := map[string]string{
+		"forcesafesearch.google.com.":   "216.239.38.120",
+		"strict.bing.com.":              "204.79.197.220",
+		"safe.duckduckgo.com.":          "52.142.124.215",
+		"restrict.youtube.com.":         "216.239.38.120",
+		"restrictmoderate.youtube.com.": "216.239.38.119",
+	}
+	return plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		msg := new(dns.Msg).SetReply(r)
+		q := r.Question[0]
+		if addr, ok := addrs[q.Name]; ok && q.Qtype == dns.TypeA {
+			msg.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP(addr),
+			}}
+		}
+		w.WriteMsg(msg)
+		return dns.RcodeSuccess, nil
+	})
+}
+
+func TestSafeSearch(t *testing.T) {
+	mappings := writeTestFile(t, "mappings", []byte(
+		"# use the address instead of strict.bing.com\n"+
+			"www.bing.com A 204.79.197.220\n"+
+			"search.example.com CNAME strict.bing.com\n",
+	))
+	tests := []struct {
+		name     string
+		corefile string
+		qname    string
+		want     []string
+	}{
+		{
+			"google",
+			`filter {
+				safesearch
+			}`,
+			"www.google.com",
+			[]string{
+				"www.google.com. CNAME forcesafesearch.google.com.",
+				"forcesafesearch.google.com. A 216.239.38.120",
+			},
+		},
+		{
+			"google country",
+			`filter {
+				safesearch
+			}`,
+			"WWW.Google.co.uk",
+			[]string{
+				"www.google.co.uk. CNAME forcesafesearch.google.com.",
+				"forcesafesearch.google.com. A 216.239.38.120",
+			},
+		},
+		{
+			"bing",
+			`filter {
+				safesearch
+			}`,
+			"bing.com",
+			[]string{
+				"bing.com. CNAME strict.bing.com.",
+				"strict.bing.com. A 204.79.197.220",
+			},
+		},
+		{
+			"duckduckgo",
+			`filter {
+				safesearch
+			}`,
+			"duckduckgo.com",
+			[]string{
+				"duckduckgo.com. CNAME safe.duckduckgo.com.",
+				"safe.duckduckgo.com. A 52.142.124.215",
+			},
+		},
+		{
+			"youtube",
+			`filter {
+				safesearch
+			}`,
+			"m.youtube.com",
+			[]string{
+				"m.youtube.com. CNAME restrict.youtube.com.",
+				"restrict.youtube.com. A 216.239.38.120",
+			},
+		},
+		{
+			"youtube moderate",
+			`filter {
+				safesearch youtube-moderate
+			}`,
+			"www.youtube.com",
+			[]string{
+				"www.youtube.com. CNAME restrictmoderate.youtube.com.",
+				"restrictmoderate.youtube.com. A 216.239.38.119",
+			},
+		},
+		{
+			"provider not selected",
+			`filter {
+				safesearch youtube
+			}`,
+			"www.google.com",
+			nil,
+		},
+		{
+			"overrides block",
+			`filter {
+				safesearch google
+				block wildcard google.com
+			}`,
+			"www.google.com",
+			[]string{
+				"www.google.com. CNAME forcesafesearch.google.com.",
+				"forcesafesearch.google.com. A 216.239.38.120",
+			},
+		},
+		{
+			"overrides allow",
+			`filter {
+				safesearch google
+				allow domain www.google.com
+			}`,
+			"www.google.com",
+			[]string{
+				"www.google.com. CNAME forcesafesearch.google.com.",
+				"forcesafesearch.google.com. A 216.239.38.120",
+			},
+		},
+		{
+			"mappings replace provider",
+			`filter {
+				safesearch bing {
+					mappings ` + mappings + `
+				}
+			}`,
+			"www.bing.com",
+			[]string{"www.bing.com. A 204.79.197.220"},
+		},
+		{
+			"mappings keep other names",
+			`filter {
+				safesearch bing {
+					mappings ` + mappings + `
+				}
+			}`,
+			"bing.com",
+			[]string{
+				"bing.com. CNAME strict.bing.com.",
+				"strict.bing.com. A 204.79.197.220",
+			},
+		},
+		{
+			"mappings add names",
+			`filter {
+				safesearch bing {
+					mappings ` + mappings + `
+				}
+			}`,
+			"search.example.com",
+			[]string{
+				"search.example.com. CNAME strict.bing.com.",
+				"strict.bing.com. A 204.79.197.220",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := NewTestFilter(t, tt.corefile)
+			filter.Next = safeSearchNext()
+			filter.Build()
+			_, got := overrideAnswers(t, filter, tt.qname, dns.TypeA)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("expected answers %q; got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSafeSearchProviders(t *testing.T) {
+	for _, provider := range append(safeSearchProviders, "youtube-moderate") {
+		t.Run(provider, func(t *testing.T) {
+			data, err := safeSearchMappings.ReadFile("safesearch/" + provider + ".txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			mappings := make(map[ruleKey][]Rule)
+			if err := readSafeSearchMappings(bytes.NewReader(data), mappings); err != nil {
+				t.Fatal(err)
+			}
+			if len(mappings) == 0 {
+				t.Error("expected mappings")
+			}
+		})
+	}
+}
+
+func TestSetupSafeSearch(t *testing.T) {
+	invalid := writeTestFile(t, "invalid", []byte("www.bing.com MX mail.bing.com\n"))
+	tests := []TestSetup{
+		{
+			"safesearch",
+			`filter {
+				safesearch
+			}`,
+			false,
+		},
+		{
+			"safesearch providers",
+			`filter {
+				safesearch google bing duckduckgo youtube-moderate
+			}`,
+			false,
+		},
+		{
+			"safesearch unknown provider",
+			`filter {
+				safesearch yahoo
+			}`,
+			true,
+		},
+		{
+			"safesearch youtube exclusive",
+			`filter {
+				safesearch youtube youtube-moderate
+			}`,
+			true,
+		},
+		{
+			"safesearch mappings missing",
+			`filter {
+				safesearch {
+					mappings
+				}
+			}`,
+			true,
+		},
+		{
+			"safesearch mappings not found",
+			`filter {
+				safesearch {
+					mappings /nonexistent/mappings.txt
+				}
+			}`,
+			true,
+		},
+		{
+			"safesearch mappings invalid",
+			`filter {
+				safesearch {
+					mappings ` + invalid + `
+				}
+			}`,
+			true,
+		},
+		{
+			"safesearch unknown option",
+			`filter {
+				safesearch {
+					strict
+				}
+			}`,
+			true,
+		},
+	}
+	for _, test := range tests {
+		RunSetupTest(t, test)
+	}
+}
@@ -0,0 +1,153 @@
+package filter
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/coredns/caddy"
+)
+
+// schedule is a named set of times of the week
+type schedule struct {
+	// days are the days of the week the schedule is active. Every day if
+	// empty.
+	days map[time.Weekday]bool
+
+	// start and end are the time of day the schedule is active from and
+	// until. A schedule ending before it starts spans midnight, and is active
+	// on the days it starts. All day if both are zero.
+	start, end time.Duration
+
+	// location is the time zone of the schedule
+	location *time.Location
+}
+
+// active reports whether the schedule is active at a time
+func (s schedule) active(t time.Time) bool {
+	t = t.In(s.location)
+	day := t.Weekday()
+	clock := time.Duration(t.Hour())*time.Hour +
+		time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+	switch {
+	case s.start == s.end:
+		return s.onDay(day)
+	case s.start < s.end:
+		return s.onDay(day) && s.start <= clock && clock < s.end
+	case s.start <= clock:
+		return s.onDay(day)
+	case clock < s.end:
+		// The end of a period which started the day before
+		return s.onDay((day + 6) % 7)
+	}
+	return false
+}
+
+func (s schedule) onDay(day time.Weekday) bool {
+	return len(s.days) == 0 || s.days[day]
+}
+
+var scheduleDays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func parseSchedule(c *caddy.Controller, f *Filter) error {
+	if !c.NextArg() {
+		return c.Err("no schedule name specified")
+	}
+	name := c.Val()
+	if _, ok := f.schedules[name]; ok {
+		return c.Errf("schedule %q is already defined", name)
+	}
+	sched := schedule{days: make(map[time.Weekday]bool), location: time.Local}
+	err := parseBlock(c, func(c *caddy.Controller) error {
+		option := c.Val()
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.Errf("no value specified for schedule option %q", option)
+		}
+		switch option {
+		case "days":
+			for _, arg := range args {
+				day, ok := scheduleDays[strings.ToLower(arg)]
+				if !ok {
+					return c.Errf(
+						"invalid schedule day %q; expected 'mon', 'tue', 'wed', "+
+							"'thu', 'fri', 'sat', or 'sun'",
+						arg,
+					)
+				}
+				sched.days[day] = true
+			}
+		case "hours":
+			if len(args) != 1 {
+				return c.Errf("expected one range of schedule hours; got %q", args)
+			}
+			start, end, err := parseHours(args[0])
+			if err != nil {
+				return c.Errf("invalid schedule hours %q; %s", args[0], err)
+			}
+			sched.start, sched.end = start, end
+		case "timezone":
+			if len(args) != 1 {
+				return c.Errf("expected one schedule timezone; got %q", args)
+			}
+			location, err := time.LoadLocation(args[0])
+			if err != nil {
+				return c.Errf("invalid schedule timezone %q; %s", args[0], err)
+			}
+			sched.location = location
+		default:
+			return c.Errf(
+				"unknown schedule option %q; expected 'days', 'hours', or 'timezone'",
+				option,
+			)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	f.schedules[name] = sched
+	return nil
+}
+
+// parseHours parses a range of times of day in the form 'HH:MM-HH:MM'
+func parseHours(hours string) (time.Duration, time.Duration, error) {
+	from, to, ok := strings.Cut(hours, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("expected HH:MM-HH:MM")
+	}
+	start, err := parseClock(from)
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := parseClock(to)
+	if err != nil {
+		return 0, 0, err
+	}
+	if start == end {
+		return 0, 0, fmt.Errorf("range is empty")
+	}
+	return start, end, nil
+}
+
+// parseClock parses a time of day in the form 'HH:MM'. '24:00' is the end of
+// the day.
+func parseClock(clock string) (time.Duration, error) {
+	if clock == "24:00" {
+		return 24 * time.Hour, nil
+	}
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q; expected HH:MM", clock)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
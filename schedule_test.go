@@ -0,0 +1,214 @@
+package filter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleActive(t *testing.T) {
+	weekdays := map[time.Weekday]bool{
+		time.Monday:    true,
+		time.Tuesday:   true,
+		time.Wednesday: true,
+		time.Thursday:  true,
+		time.Friday:    true,
+	}
+	// 2026-10-16 is a Friday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2026, time.October, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name     string
+		schedule schedule
+		at       time.Time
+		want     bool
+	}{
+		{
+			"always",
+			schedule{location: time.UTC},
+			at(17, 3, 0),
+			true,
+		},
+		{
+			"day",
+			schedule{days: weekdays, location: time.UTC},
+			at(16, 12, 0),
+			true,
+		},
+		{
+			"other day",
+			schedule{days: weekdays, location: time.UTC},
+			at(17, 12, 0),
+			false,
+		},
+		{
+			"hours start",
+			schedule{start: 8 * time.Hour, end: 15 * time.Hour, location: time.UTC},
+			at(16, 8, 0),
+			true,
+		},
+		{
+			"hours end",
+			schedule{start: 8 * time.Hour, end: 15 * time.Hour, location: time.UTC},
+			at(16, 15, 0),
+			false,
+		},
+		{
+			"overnight before midnight",
+			schedule{days: weekdays, start: 22 * time.Hour, end: 6 * time.Hour, location: time.UTC},
+			at(16, 23, 0),
+			true,
+		},
+		{
+			"overnight after midnight",
+			schedule{days: weekdays, start: 22 * time.Hour, end: 6 * time.Hour, location: time.UTC},
+			at(17, 5, 59),
+			true,
+		},
+		{
+			"overnight after midnight of other day",
+			schedule{days: weekdays, start: 22 * time.Hour, end: 6 * time.Hour, location: time.UTC},
+			at(19, 5, 0),
+			false,
+		},
+		{
+			"overnight daytime",
+			schedule{days: weekdays, start: 22 * time.Hour, end: 6 * time.Hour, location: time.UTC},
+			at(16, 12, 0),
+			false,
+		},
+		{
+			"until end of day",
+			schedule{start: 20 * time.Hour, end: 24 * time.Hour, location: time.UTC},
+			at(16, 23, 59),
+			true,
+		},
+		{
+			"timezone",
+			schedule{
+				start:    8 * time.Hour,
+				end:      15 * time.Hour,
+				location: time.FixedZone("UTC-5", -5*60*60),
+			},
+			at(16, 14, 0),
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.schedule.active(tt.at); got != tt.want {
+				t.Errorf("expected %t; got %t", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSetupSchedule(t *testing.T) {
+	tests := []TestSetup{
+		{
+			"schedule",
+			`filter {
+				schedule school {
+					days Mon tue wed thu fri
+					hours 08:00-15:30
+					timezone America/New_York
+				}
+			}`,
+			false,
+		},
+		{
+			"schedule until midnight",
+			`filter {
+				schedule evening {
+					hours 18:00-24:00
+				}
+			}`,
+			false,
+		},
+		{
+			"schedule no name",
+			`filter {
+				schedule
+			}`,
+			true,
+		},
+		{
+			"schedule duplicate",
+			`filter {
+				schedule night {
+					hours 22:00-06:00
+				}
+				schedule night {
+					hours 22:00-06:00
+				}
+			}`,
+			true,
+		},
+		{
+			"schedule invalid day",
+			`filter {
+				schedule night {
+					days someday
+				}
+			}`,
+			true,
+		},
+		{
+			"schedule invalid hours",
+			`filter {
+				schedule night {
+					hours 22:00
+				}
+			}`,
+			true,
+		},
+		{
+			"schedule empty hours",
+			`filter {
+				schedule night {
+					hours 22:00-22:00
+				}
+			}`,
+			true,
+		},
+		{
+			"schedule invalid time",
+			`filter {
+				schedule night {
+					hours 25:00-06:00
+				}
+			}`,
+			true,
+		},
+		{
+			"schedule invalid timezone",
+			`filter {
+				schedule night {
+					timezone Nowhere/Nothing
+				}
+			}`,
+			true,
+		},
+		{
+			"schedule no value",
+			`filter {
+				schedule night {
+					hours
+				}
+			}`,
+			true,
+		},
+		{
+			"schedule unknown option",
+			`filter {
+				schedule night {
+					noop 1
+				}
+			}`,
+			true,
+		},
+	}
+	for _, test := range tests {
+		RunSetupTest(t, test)
+	}
+}
@@ -1,6 +1,7 @@
 package filter
 
 import (
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"net/netip"
@@ -29,6 +30,9 @@ func setup(c *caddy.Controller) error {
 	c.OnShutdown(f.OnShutdown)
 	c.OnStartup(func() error {
 		f.startupOnce.Do(func() {
+			if f.newDomains != nil {
+				f.newDomains.start(f.updateShutdown)
+			}
 			f.Build()
 			f.InitUpdate()
 		})
@@ -63,12 +67,81 @@ func Parse(c *caddy.Controller, f *Filter) error {
 			if err := parseAction(c, f, ActionTypeBlock); err != nil {
 				return err
 			}
+		case "category":
+			if err := parseCategory(c, f); err != nil {
+				return err
+			}
+		case "clientid":
+			if err := parseClientID(c, f); err != nil {
+				return err
+			}
+		case "deny":
+			if err := parseAction(c, f, ActionTypeDeny); err != nil {
+				return err
+			}
+		case "dga":
+			if err := parseDGA(c, f); err != nil {
+				return err
+			}
+		case "group":
+			if err := parseGroup(c, f); err != nil {
+				return err
+			}
+		case "http":
+			opts, err := parseHTTPOptions(c)
+			if err != nil {
+				return err
+			}
+			// The resolver is set by listresolver, which may come first
+			opts.Resolver = f.allowConfig.HTTPLoader.Defaults.Resolver
+			*f.allowConfig.HTTPLoader.Defaults = opts
+			*f.blockConfig.HTTPLoader.Defaults = opts
 		case "listresolver":
 			if err := parseListResolver(c, f); err != nil {
 				return err
 			}
+		case "listtsig":
+			if err := parseListTsig(c, f); err != nil {
+				return err
+			}
+		case "listworkers":
+			if err := parseListWorkers(c, f); err != nil {
+				return err
+			}
+		case "mode":
+			if err := parseMode(c, f); err != nil {
+				return err
+			}
+		case "newdomains":
+			if err := parseNewDomains(c, f); err != nil {
+				return err
+			}
+		case "override":
+			if err := parseOverride(c, f); err != nil {
+				return err
+			}
+		case "precedence":
+			if err := parsePrecedence(c, f); err != nil {
+				return err
+			}
+		case "ratelimit":
+			if err := parseRateLimit(c, f); err != nil {
+				return err
+			}
 		case "response":
-			if err := parseResponse(c, f); err != nil {
+			if err := parseResponse(c, &f.response); err != nil {
+				return err
+			}
+		case "safesearch":
+			if err := parseSafeSearch(c, f); err != nil {
+				return err
+			}
+		case "schedule":
+			if err := parseSchedule(c, f); err != nil {
+				return err
+			}
+		case "tunnel":
+			if err := parseTunnel(c, f); err != nil {
 				return err
 			}
 		case "update":
@@ -82,13 +155,16 @@ func Parse(c *caddy.Controller, f *Filter) error {
 			f.updateInterval = duration
 		default:
 			return c.Errf(
-				"unknown token %q;"+
-					"expected 'allow', 'block', 'response', or 'update'",
+				"unknown token %q; "+
+					"expected 'allow', 'block', 'category', 'clientid', 'deny', 'dga', "+
+					"'group', 'http', 'listresolver', 'listtsig', 'listworkers', "+
+					"'mode', 'newdomains', 'override', 'precedence', 'ratelimit', "+
+					"'response', 'safesearch', 'schedule', 'tunnel', or 'update'",
 				c.Val(),
 			)
 		}
 	}
-	return nil
+	return validateCategories(c, f)
 }
 
 func parseAction(c *caddy.Controller, f *Filter, a ActionType) error {
@@ -116,6 +192,18 @@ func parseAction(c *caddy.Controller, f *Filter, a ActionType) error {
 		if err := parseActionList(c, f, a); err != nil {
 			return err
 		}
+	case "category":
+		if err := parseActionCategory(c, f, a); err != nil {
+			return err
+		}
+	case "response":
+		// Only denied domains have their own response
+		if a != ActionTypeDeny {
+			return c.Errf("unexpected %s token %q", a, c.Val())
+		}
+		if err := parseResponse(c, &f.denyResponse); err != nil {
+			return err
+		}
 	default:
 		return c.Errf("unexpected %s token %q", a, c.Val())
 	}
@@ -123,38 +211,61 @@ func parseAction(c *caddy.Controller, f *Filter, a ActionType) error {
 }
 
 func parseActionList(c *caddy.Controller, f *Filter, a ActionType) error {
+	kind, url, opts, err := parseList(c, a)
+	if err != nil {
+		return err
+	}
+	if opts.Audit && a != ActionTypeBlock && a != ActionTypeDeny {
+		return c.Errf("%s lists can't be audited; only block and deny lists can", a)
+	}
+	switch a {
+	case ActionTypeAllow:
+		return f.allowConfig.AddList(kind, url, opts)
+	case ActionTypeBlock:
+		return f.blockConfig.AddList(kind, url, opts)
+	case ActionTypeDeny:
+		return f.denyConfig.AddList(kind, url, opts)
+	case ActionTypeOverride:
+		return f.overrideConfig.AddList(kind, url, opts)
+	}
+	return nil
+}
+
+// parseList parses the type, URL, and options of a list of an action
+func parseList(c *caddy.Controller, a ActionType) (string, string, ListOptions, error) {
 	if !c.NextArg() {
-		return c.Errf("no %s list type specified", a)
+		return "", "", ListOptions{}, c.Errf("no %s list type specified", a)
 	}
-	switch c.Val() {
-	case "domain":
-		if err := parseActionListDomain(c, f, a); err != nil {
-			return err
-		}
-	case "hosts":
-		if err := parseActionListHosts(c, f, a); err != nil {
-			return err
+	kind := c.Val()
+	if _, ok := getListParser(kind); !ok {
+		names := listParserNames()
+		for i, name := range names {
+			names[i] = "'" + name + "'"
 		}
-	case "regex":
-		if err := parseActionListRegex(c, f, a); err != nil {
-			return err
-		}
-	case "wildcard":
-		if err := parseActionListWildcard(c, f, a); err != nil {
-			return err
+		expected := strings.Join(names, ", ")
+		if 1 < len(names) {
+			expected = strings.Join(names[:len(names)-1], ", ") + ", or " + names[len(names)-1]
 		}
-	default:
-		return c.Errf(
-			"unexpected %s token %q; "+
-				"expected 'domain', 'regex', or 'wildcard'",
+		return "", "", ListOptions{}, c.Errf(
+			"unexpected %s token %q; expected %s",
 			a,
-			c.Val(),
+			kind,
+			expected,
 		)
 	}
-	return nil
+	if !c.NextArg() {
+		return "", "", ListOptions{}, c.Errf("no %s %s list specified", a, kind)
+	}
+	url := c.Val()
+	opts, err := parseListOptions(c)
+	if err != nil {
+		return "", "", ListOptions{}, err
+	}
+	return kind, url, opts, nil
 }
 
-func parseResponse(c *caddy.Controller, f *Filter) error {
+// parseResponse parses the response to blocked domains into to
+func parseResponse(c *caddy.Controller, to *Response) error {
 	if !c.NextArg() {
 		return c.Err(
 			"no response type specified; " +
@@ -164,15 +275,15 @@ func parseResponse(c *caddy.Controller, f *Filter) error {
 	r := strings.ToLower(c.Val())
 	switch r {
 	case "address":
-		if err := parseResponseAddress(c, f); err != nil {
+		if err := parseResponseAddress(c, to); err != nil {
 			return err
 		}
 	case "nxdomain":
-		f.response = RespNXDomain{}
+		*to = RespNXDomain{}
 	case "nodata":
-		f.response = RespNoData{}
+		*to = RespNoData{}
 	case "null":
-		f.response = RespAddress{
+		*to = RespAddress{
 			IP4: netip.IPv4Unspecified(),
 			IP6: netip.IPv6Unspecified(),
 		}
@@ -186,7 +297,7 @@ func parseResponse(c *caddy.Controller, f *Filter) error {
 	return nil
 }
 
-func parseResponseAddress(c *caddy.Controller, f *Filter) error {
+func parseResponseAddress(c *caddy.Controller, to *Response) error {
 	if !c.NextArg() {
 		return c.Errf("no address records specified")
 	}
@@ -217,7 +328,7 @@ func parseResponseAddress(c *caddy.Controller, f *Filter) error {
 	}
 
 	if len(remaining) != 4 {
-		f.response = resp
+		*to = resp
 		return nil
 	}
 
@@ -238,7 +349,7 @@ func parseResponseAddress(c *caddy.Controller, f *Filter) error {
 		resp.IP6 = secondAddr
 	}
 
-	f.response = resp
+	*to = resp
 
 	return nil
 }
@@ -290,39 +401,232 @@ func parseAddress(rec ...string) (uint16, netip.Addr, error) {
 }
 
 func parseListResolver(c *caddy.Controller, f *Filter) error {
-	to := c.RemainingArgs()
-	if len(to) == 0 {
-		return c.Errf("no list resolver address specified")
+	group, ok := f.allowConfig.HTTPLoader.Defaults.Resolver.(*ResolverGroup)
+	if !ok {
+		group = &ResolverGroup{}
+		f.allowConfig.HTTPLoader.Defaults.Resolver = group
+		f.blockConfig.HTTPLoader.Defaults.Resolver = group
 	}
-	toHosts, err := parse.HostPortOrFile([]string{to[0]}...)
+	// A resolver may be given on the directive's line, in its block, or both
+	if args := c.RemainingArgs(); len(args) != 0 {
+		resolver, err := parseResolverAddress(c, f, args)
+		if err != nil {
+			return err
+		}
+		group.Resolvers = append(group.Resolvers, resolver)
+	}
+	err := parseBlock(c, func(c *caddy.Controller) error {
+		option := c.Val()
+		args := c.RemainingArgs()
+		switch option {
+		case "resolver":
+			resolver, err := parseResolverAddress(c, f, args)
+			if err != nil {
+				return err
+			}
+			group.Resolvers = append(group.Resolvers, resolver)
+		case "policy":
+			if len(args) != 1 {
+				return c.Errf("expected one listresolver policy; got %q", args)
+			}
+			switch args[0] {
+			case "sequential":
+				group.Policy = ResolverPolicySequential
+			case "race":
+				group.Policy = ResolverPolicyRace
+			default:
+				return c.Errf(
+					"unknown listresolver policy %q; expected 'sequential' or 'race'",
+					args[0],
+				)
+			}
+		case "timeout":
+			if len(args) != 1 {
+				return c.Errf("expected one listresolver timeout; got %q", args)
+			}
+			timeout, err := time.ParseDuration(args[0])
+			if err != nil || timeout <= 0 {
+				return c.Errf(
+					"invalid listresolver timeout %q; expected a positive duration",
+					args[0],
+				)
+			}
+			group.Timeout = timeout
+		default:
+			return c.Errf(
+				"unknown listresolver option %q; "+
+					"expected 'resolver', 'policy', or 'timeout'",
+				option,
+			)
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
+	if len(group.Resolvers) == 0 {
+		return c.Err("no list resolver address specified")
+	}
+	return nil
+}
+
+// parseResolverAddress parses a list resolver's address and optional server
+// name, or 'next' to resolve using the plugins following filter
+func parseResolverAddress(c *caddy.Controller, f *Filter, to []string) (NamedListResolver, error) {
+	if len(to) == 0 {
+		return NamedListResolver{}, c.Errf("no list resolver address specified")
+	}
+	if to[0] == "next" {
+		if 1 < len(to) {
+			return NamedListResolver{}, errorExpectedEOL{data: to[1:]}
+		}
+		return NamedListResolver{Name: to[0], ListResolver: &NextListResolver{Filter: f}}, nil
+	}
+	if 2 < len(to) {
+		return NamedListResolver{}, errorExpectedEOL{data: to[2:]}
+	}
+	// DNS-over-HTTPS resolvers may include a path, which isn't accepted by
+	// parse.HostPortOrFile. TCP isn't a transport known to parse.Transport, so
+	// its addresses are parsed as DNS.
+	addr, path := to[0], ""
+	tcp := strings.HasPrefix(addr, "tcp://")
+	if tcp {
+		addr = transport.DNS + "://" + strings.TrimPrefix(addr, "tcp://")
+	}
+	if strings.HasPrefix(addr, transport.HTTPS+"://") {
+		scheme := len(transport.HTTPS + "://")
+		if i := strings.IndexByte(addr[scheme:], '/'); 0 <= i {
+			addr, path = addr[:scheme+i], addr[scheme+i:]
+		}
+	}
+	toHosts, err := parse.HostPortOrFile([]string{addr}...)
+	if err != nil {
+		return NamedListResolver{}, err
+	}
 	xprt, host := parse.Transport(toHosts[0])
 	ipaddr, err := netip.ParseAddrPort(host)
 	if err != nil {
-		return err
+		return NamedListResolver{}, err
+	}
+	var serverName string
+	if len(to) == 2 {
+		serverName = to[1]
 	}
+
+	var resolver ListResolver
 	switch xprt {
-	case transport.DNS, transport.TLS:
-		f.allowConfig.HTTPLoader.Network = xprt
-		f.blockConfig.HTTPLoader.Network = xprt
+	case transport.DNS:
+		resolver = &DNSListResolver{Addr: ipaddr, Transport: ResolverTransportUDP}
+		if tcp {
+			resolver = &DNSListResolver{Addr: ipaddr, Transport: ResolverTransportTCP}
+		}
+	case transport.TLS, transport.QUIC:
+		if len(serverName) == 0 {
+			return NamedListResolver{}, c.Errf(
+				"listresolver is using %s scheme without a server name",
+				xprt,
+			)
+		}
+		if xprt == transport.TLS {
+			resolver = &DNSListResolver{
+				Addr:       ipaddr,
+				Transport:  ResolverTransportTLS,
+				ServerName: serverName,
+			}
+		} else {
+			resolver = &DoQListResolver{Addr: ipaddr, ServerName: serverName}
+		}
+	case transport.HTTPS:
+		if len(path) == 0 {
+			path = "/dns-query"
+		}
+		resolver = &DoHListResolver{
+			URL:        "https://" + ipaddr.String() + path,
+			ServerName: serverName,
+		}
 	default:
-		return fmt.Errorf(
+		return NamedListResolver{}, fmt.Errorf(
 			"%q is not a supported transport for listresolver",
 			xprt,
 		)
 	}
-	if xprt == transport.TLS {
-		if len(to) == 1 {
-			return c.Err(
-				"listresolver is using tls scheme without a server name",
-			)
+	return NamedListResolver{Name: to[0], ListResolver: resolver}, nil
+}
+
+func parseListTsig(c *caddy.Controller, f *Filter) error {
+	args := c.RemainingArgs()
+	if len(args) == 0 || 3 < len(args) {
+		return c.Errf(
+			"unexpected number of listtsig arguments %q; "+
+				"expected key name, secret, and optional algorithm",
+			args,
+		)
+	}
+	name := dns.Fqdn(strings.ToLower(args[0]))
+	if _, ok := dns.IsDomainName(name); !ok {
+		return c.Errf("invalid listtsig key name %q", args[0])
+	}
+	var secret, secretFile string
+	algorithm := dns.HmacSHA256
+	if 1 < len(args) {
+		secret = args[1]
+	}
+	if len(args) == 3 {
+		algorithm = args[2]
+	}
+	if len(args) == 1 {
+		err := parseBlock(c, func(c *caddy.Controller) error {
+			option := c.Val()
+			if !c.NextArg() {
+				return c.Errf("no value specified for listtsig option %q", option)
+			}
+			switch option {
+			case "secret_file":
+				secretFile = c.Val()
+			case "algorithm":
+				algorithm = c.Val()
+			default:
+				return c.Errf("unknown listtsig option %q; expected 'secret_file' or 'algorithm'", option)
+			}
+			return ensureEOL(c)
+		})
+		if err != nil {
+			return err
 		}
-		f.allowConfig.HTTPLoader.ServerName = to[1]
-		f.blockConfig.HTTPLoader.ServerName = to[1]
+		if secretFile == "" {
+			return c.Err("no listtsig secret specified; expected a secret or 'secret_file'")
+		}
+		// The file is read again for each transfer, so that it may be rotated
+		if secret, err = readSecret(secretFile); err != nil {
+			return c.Errf("error reading listtsig secret file; %s", err)
+		}
+	}
+	if _, err := base64.StdEncoding.DecodeString(secret); err != nil {
+		return c.Errf("invalid listtsig secret; %s", err)
+	}
+	original := algorithm
+	algorithm = dns.Fqdn(strings.ToLower(algorithm))
+	switch algorithm {
+	case dns.HmacSHA1, dns.HmacSHA224, dns.HmacSHA256,
+		dns.HmacSHA384, dns.HmacSHA512:
+	default:
+		return c.Errf(
+			"unsupported listtsig algorithm %q; "+
+				"expected 'hmac-sha1', 'hmac-sha224', 'hmac-sha256', "+
+				"'hmac-sha384', or 'hmac-sha512'",
+			original,
+		)
+	}
+	for _, loader := range []*AXFRListLoader{
+		f.allowConfig.AXFRLoader,
+		f.blockConfig.AXFRLoader,
+		f.denyConfig.AXFRLoader,
+		f.overrideConfig.AXFRLoader,
+	} {
+		loader.TsigName = name
+		loader.TsigSecret = secret
+		loader.TsigSecretFile = secretFile
+		loader.TsigAlgorithm = algorithm
 	}
-	f.allowConfig.HTTPLoader.ResolverIP = ipaddr
-	f.blockConfig.HTTPLoader.ResolverIP = ipaddr
 	return nil
 }
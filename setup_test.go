@@ -318,10 +318,142 @@ func TestSetupListResolver(t *testing.T) {
 			false,
 		},
 		{
-			"listresolver quad9 unsupported transport",
+			"listresolver quad9 tcp",
+			`filter {
+				listresolver tcp://9.9.9.9
+			}`,
+			false,
+		},
+		{
+			"listresolver quad9 tcp with port",
+			`filter {
+				listresolver tcp://9.9.9.9:53
+			}`,
+			false,
+		},
+		{
+			"listresolver quad9 https",
 			`filter {
 				listresolver https://9.9.9.9
 			}`,
+			false,
+		},
+		{
+			"listresolver quad9 https with path and server name",
+			`filter {
+				listresolver https://9.9.9.9:443/dns-query dns.quad9.net
+			}`,
+			false,
+		},
+		{
+			"listresolver quad9 quic without server name",
+			`filter {
+				listresolver quic://9.9.9.9
+			}`,
+			true,
+		},
+		{
+			"listresolver quad9 quic",
+			`filter {
+				listresolver quic://9.9.9.9 dns.quad9.net
+			}`,
+			false,
+		},
+		{
+			"listresolver multiple",
+			`filter {
+				listresolver tls://9.9.9.9 dns.quad9.net
+				listresolver https://1.1.1.1 cloudflare-dns.com
+			}`,
+			false,
+		},
+		{
+			"listresolver block",
+			`filter {
+				listresolver {
+					resolver tls://9.9.9.9 dns.quad9.net
+					resolver quic://94.140.14.14 dns.adguard-dns.com
+					resolver 1.1.1.1
+					policy race
+					timeout 2s
+				}
+			}`,
+			false,
+		},
+		{
+			"listresolver block without resolvers",
+			`filter {
+				listresolver {
+					policy sequential
+				}
+			}`,
+			true,
+		},
+		{
+			"listresolver block unknown policy",
+			`filter {
+				listresolver {
+					resolver 9.9.9.9
+					policy random
+				}
+			}`,
+			true,
+		},
+		{
+			"listresolver block invalid timeout",
+			`filter {
+				listresolver {
+					resolver 9.9.9.9
+					timeout 0s
+				}
+			}`,
+			true,
+		},
+		{
+			"listresolver block unknown option",
+			`filter {
+				listresolver {
+					noop
+				}
+			}`,
+			true,
+		},
+		{
+			"listresolver too many arguments",
+			`filter {
+				listresolver tls://9.9.9.9 dns.quad9.net noop
+			}`,
+			true,
+		},
+		{
+			"listresolver next",
+			`filter {
+				listresolver next
+			}`,
+			false,
+		},
+		{
+			"listresolver next with fallback",
+			`filter {
+				listresolver {
+					resolver next
+					resolver tls://9.9.9.9 dns.quad9.net
+				}
+			}`,
+			false,
+		},
+		{
+			"listresolver next with server name",
+			`filter {
+				listresolver next dns.quad9.net
+			}`,
+			true,
+		},
+		{
+			"listresolver quad9 unsupported transport",
+			`filter {
+				listresolver grpc://9.9.9.9
+			}`,
 			true,
 		},
 		{
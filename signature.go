@@ -0,0 +1,181 @@
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// SignatureVerifier verifies a detached signature of a list
+type SignatureVerifier interface {
+	Verify(content, signature []byte) error
+}
+
+// ParsePublicKey returns the verifier for a minisign public key, or a PEM
+// encoded ECDSA or Ed25519 public key such as one generated by cosign
+func ParsePublicKey(data []byte) (SignatureVerifier, error) {
+	if block, _ := pem.Decode(data); block != nil {
+		return parsePKIXPublicKey(block)
+	}
+	return parseMinisignPublicKey(data)
+}
+
+// pkixVerifier verifies signatures made by ECDSA or Ed25519 keys. ECDSA
+// signatures are ASN.1 encoded and made over the content digest, as produced by
+// 'cosign sign-blob'. Signatures may be raw or base64 encoded.
+type pkixVerifier struct {
+	key crypto.PublicKey
+}
+
+func parsePKIXPublicKey(block *pem.Block) (SignatureVerifier, error) {
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key; %w", err)
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, ed25519.PublicKey:
+		return pkixVerifier{key: key}, nil
+	default:
+		return nil, fmt.Errorf(
+			"unsupported public key type %T; expected ECDSA or Ed25519",
+			key,
+		)
+	}
+}
+
+func (p pkixVerifier) Verify(content, signature []byte) error {
+	sig := decodeSignature(signature)
+	switch key := p.key.(type) {
+	case *ecdsa.PublicKey:
+		var digest []byte
+		switch key.Curve {
+		case elliptic.P384():
+			sum := sha512.Sum384(content)
+			digest = sum[:]
+		case elliptic.P521():
+			sum := sha512.Sum512(content)
+			digest = sum[:]
+		default:
+			sum := sha256.Sum256(content)
+			digest = sum[:]
+		}
+		if !ecdsa.VerifyASN1(key, digest, sig) {
+			return errors.New("invalid ECDSA signature")
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, content, sig) {
+			return errors.New("invalid Ed25519 signature")
+		}
+	}
+	return nil
+}
+
+// decodeSignature returns the base64 decoded signature, or the signature as-is
+// if it is not base64 encoded
+func decodeSignature(signature []byte) []byte {
+	trimmed := bytes.TrimSpace(signature)
+	decoded, err := base64.StdEncoding.DecodeString(string(trimmed))
+	if err != nil {
+		return signature
+	}
+	return decoded
+}
+
+// minisignVerifier verifies minisign signatures, including the signature of the
+// trusted comment
+type minisignVerifier struct {
+	keyID [8]byte
+	key   ed25519.PublicKey
+}
+
+func parseMinisignPublicKey(data []byte) (SignatureVerifier, error) {
+	for _, line := range minisignLines(data) {
+		decoded, err := base64.StdEncoding.DecodeString(line)
+		if err != nil || len(decoded) != 2+8+ed25519.PublicKeySize {
+			continue
+		}
+		if string(decoded[:2]) != "Ed" {
+			return nil, fmt.Errorf(
+				"unsupported minisign key algorithm %q",
+				decoded[:2],
+			)
+		}
+		var v minisignVerifier
+		copy(v.keyID[:], decoded[2:10])
+		v.key = ed25519.PublicKey(decoded[10:])
+		return v, nil
+	}
+	return nil, errors.New(
+		"invalid public key; expected PEM or minisign public key",
+	)
+}
+
+func (m minisignVerifier) Verify(content, signature []byte) error {
+	lines := minisignLines(signature)
+	if len(lines) != 3 || !strings.HasPrefix(lines[1], "trusted comment: ") {
+		return errors.New("invalid minisign signature format")
+	}
+	sig, err := base64.StdEncoding.DecodeString(lines[0])
+	if err != nil || len(sig) != 2+8+ed25519.SignatureSize {
+		return errors.New("invalid minisign signature encoding")
+	}
+	if !bytes.Equal(sig[2:10], m.keyID[:]) {
+		return fmt.Errorf(
+			"minisign signature key ID %X does not match public key ID %X",
+			sig[2:10],
+			m.keyID,
+		)
+	}
+
+	message := content
+	switch string(sig[:2]) {
+	case "Ed":
+	case "ED":
+		digest := blake2b.Sum512(content)
+		message = digest[:]
+	default:
+		return fmt.Errorf("unsupported minisign signature algorithm %q", sig[:2])
+	}
+	if !ed25519.Verify(m.key, message, sig[10:]) {
+		return errors.New("invalid minisign signature")
+	}
+
+	globalSig, err := base64.StdEncoding.DecodeString(lines[2])
+	if err != nil {
+		return errors.New("invalid minisign trusted comment signature encoding")
+	}
+	comment := strings.TrimPrefix(lines[1], "trusted comment: ")
+	global := append(append([]byte{}, sig[10:]...), comment...)
+	if !ed25519.Verify(m.key, global, globalSig) {
+		return errors.New("invalid minisign trusted comment signature")
+	}
+	return nil
+}
+
+// minisignLines returns the non-empty lines of a minisign file, excluding the
+// untrusted comment
+func minisignLines(data []byte) []string {
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "untrusted comment:") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
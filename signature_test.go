@@ -0,0 +1,318 @@
+package filter
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// testSignedListServer serves a list and its detached signature. The list may
+// be replaced without updating the signature to simulate tampering.
+type testSignedListServer struct {
+	lock      sync.Mutex
+	list      []byte
+	signature []byte
+	server    *httptest.Server
+
+	// encoding is the HTTP content encoding the list is served with
+	encoding compression
+
+	// token, if set, is the bearer token required for the list and signature
+	token string
+}
+
+func newTestSignedListServer(t *testing.T, list, signature []byte) *testSignedListServer {
+	t.Helper()
+	s := &testSignedListServer{list: list, signature: signature}
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.token != "" && r.Header.Get("Authorization") != "Bearer "+s.token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/list.txt":
+			if s.encoding != compressionNone {
+				w.Header().Set("Content-Encoding", s.encoding.String())
+			}
+			w.Write(compressTestList(t, s.encoding, s.list))
+		case "/list.txt.sig":
+			w.Write(s.signature)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+func (s *testSignedListServer) tamper(list []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.list = list
+}
+
+func (s *testSignedListServer) corefile(pubkey string) string {
+	return `filter {
+		block list domain ` + s.server.URL + `/list.txt {
+			signature ` + s.server.URL + `/list.txt.sig
+			pubkey ` + filepath.ToSlash(pubkey) + `
+		}
+	}`
+}
+
+func writeTestKey(t *testing.T, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "list.pub")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// minisignTestKey returns a minisign public key file and a function that
+// produces prehashed minisign signatures with its private key
+func minisignTestKey(t *testing.T) ([]byte, func([]byte) []byte) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	pubkey := "untrusted comment: minisign public key\n" +
+		base64.StdEncoding.EncodeToString(append(append([]byte("Ed"), keyID...), pub...)) + "\n"
+	sign := func(content []byte) []byte {
+		digest := blake2b.Sum512(content)
+		sig := ed25519.Sign(priv, digest[:])
+		comment := "timestamp:1700000000"
+		global := ed25519.Sign(priv, append(append([]byte{}, sig...), comment...))
+		return []byte("untrusted comment: signature\n" +
+			base64.StdEncoding.EncodeToString(append(append([]byte("ED"), keyID...), sig...)) + "\n" +
+			"trusted comment: " + comment + "\n" +
+			base64.StdEncoding.EncodeToString(global) + "\n")
+	}
+	return []byte(pubkey), sign
+}
+
+// cosignTestKey returns a PEM encoded ECDSA public key and a function that
+// produces base64 encoded signatures in the format of 'cosign sign-blob'
+func cosignTestKey(t *testing.T) ([]byte, func([]byte) []byte) {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubkey := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	sign := func(content []byte) []byte {
+		digest := sha256.Sum256(content)
+		sig, err := ecdsa.SignASN1(rand.Reader, priv, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []byte(base64.StdEncoding.EncodeToString(sig))
+	}
+	return pubkey, sign
+}
+
+func TestSignatureVerified(t *testing.T) {
+	list := []byte("example.com\nexample.net\n")
+	keys := map[string]func(*testing.T) ([]byte, func([]byte) []byte){
+		"minisign": minisignTestKey,
+		"cosign":   cosignTestKey,
+	}
+	for name, key := range keys {
+		t.Run(name, func(t *testing.T) {
+			pubkey, sign := key(t)
+			server := newTestSignedListServer(t, list, sign(list))
+			filter := NewTestFilter(t, server.corefile(writeTestKey(t, pubkey)))
+			filter.Build()
+			if len(filter.blockDomains) != 2 {
+				t.Fatalf("expected 2 domains; got %d", len(filter.blockDomains))
+			}
+
+			// A list that fails verification keeps the previous entries
+			server.tamper([]byte("example.com\nexample.net\ncorp.example\n"))
+			filter.Build()
+			if len(filter.blockDomains) != 2 || filter.blockDomains["corp.example"] {
+				t.Errorf("expected tampered list to be rejected; got %v", filter.blockDomains)
+			}
+		})
+	}
+}
+
+func TestSignatureContentEncoding(t *testing.T) {
+	list := []byte("example.com\nexample.net\n")
+	pubkey, sign := cosignTestKey(t)
+	for _, encoding := range []compression{compressionGzip, compressionZstd} {
+		t.Run(encoding.String(), func(t *testing.T) {
+			// The signature is of the list file, not of its encoded response
+			server := newTestSignedListServer(t, list, sign(list))
+			server.encoding = encoding
+			filter := NewTestFilter(t, server.corefile(writeTestKey(t, pubkey)))
+			filter.Build()
+			if len(filter.blockDomains) != 2 {
+				t.Errorf("expected 2 domains; got %d", len(filter.blockDomains))
+			}
+		})
+	}
+}
+
+func TestSignatureHTTPOptions(t *testing.T) {
+	list := []byte("example.com\nexample.net\n")
+	pubkey, sign := cosignTestKey(t)
+	server := newTestSignedListServer(t, list, sign(list))
+	server.token = "secret"
+	filter := NewTestFilter(t, `filter {
+		block list domain `+server.server.URL+`/list.txt {
+			signature `+server.server.URL+`/list.txt.sig
+			pubkey `+filepath.ToSlash(writeTestKey(t, pubkey))+`
+			http {
+				bearer_file `+writeTestFile(t, "token", []byte("secret"))+`
+			}
+		}
+	}`)
+	filter.Build()
+	if len(filter.blockDomains) != 2 {
+		t.Errorf("expected 2 domains; got %d", len(filter.blockDomains))
+	}
+}
+
+func TestSignatureInvalid(t *testing.T) {
+	list := []byte("example.com\n")
+	pubkey, _ := cosignTestKey(t)
+	_, otherSign := cosignTestKey(t)
+	server := newTestSignedListServer(t, list, otherSign(list))
+	test := TestFilterBuild{
+		"check list signed by another key",
+		server.corefile(writeTestKey(t, pubkey)),
+		true,
+	}
+	RunFilterBuildTest(t, test)
+
+	filter := NewTestFilter(t, server.corefile(writeTestKey(t, pubkey)))
+	filter.Build()
+	if len(filter.blockDomains) != 0 {
+		t.Errorf("expected no domains from unverified list; got %d", len(filter.blockDomains))
+	}
+}
+
+func TestSignatureProjectKey(t *testing.T) {
+	data, err := os.ReadFile("cosign.pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParsePublicKey(data); err != nil {
+		t.Errorf("expected project cosign key to parse; %v", err)
+	}
+}
+
+func TestSetupListOptions(t *testing.T) {
+	pubkey, _ := minisignTestKey(t)
+	keyPath := filepath.ToSlash(writeTestKey(t, pubkey))
+	invalidPath := filepath.ToSlash(writeTestKey(t, []byte("not a key")))
+	tests := []TestSetup{
+		{
+			"list options signature",
+			`filter {
+				block list domain https://example.com/list.txt {
+					signature https://example.com/list.txt.minisig
+					pubkey ` + keyPath + `
+				}
+			}`,
+			false,
+		},
+		{
+			"list options empty",
+			`filter {
+				block list domain https://example.com/list.txt {
+				}
+			}`,
+			false,
+		},
+		{
+			"list options signature without pubkey",
+			`filter {
+				block list hosts https://example.com/list.txt {
+					signature https://example.com/list.txt.minisig
+				}
+			}`,
+			true,
+		},
+		{
+			"list options pubkey without signature",
+			`filter {
+				block list regex https://example.com/list.txt {
+					pubkey ` + keyPath + `
+				}
+			}`,
+			true,
+		},
+		{
+			"list options invalid pubkey",
+			`filter {
+				block list wildcard https://example.com/list.txt {
+					signature https://example.com/list.txt.minisig
+					pubkey ` + invalidPath + `
+				}
+			}`,
+			true,
+		},
+		{
+			"list options missing pubkey",
+			`filter {
+				block list domain https://example.com/list.txt {
+					signature https://example.com/list.txt.minisig
+					pubkey /noop/list.pub
+				}
+			}`,
+			true,
+		},
+		{
+			"list options invalid signature scheme",
+			`filter {
+				block list domain https://example.com/list.txt {
+					signature scheme://example.com/list.txt.minisig
+					pubkey ` + keyPath + `
+				}
+			}`,
+			true,
+		},
+		{
+			"list options unknown option",
+			`filter {
+				block list domain https://example.com/list.txt {
+					noop
+				}
+			}`,
+			true,
+		},
+		{
+			"list options expected eol",
+			`filter {
+				block list domain https://example.com/list.txt noop
+			}`,
+			true,
+		},
+	}
+	for _, test := range tests {
+		RunSetupTest(t, test)
+	}
+}
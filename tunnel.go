@@ -0,0 +1,215 @@
+package filter
+
+import (
+	"container/list"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/caddy"
+)
+
+// tunnelCategory is the category reported for requests of tunneling clients
+const tunnelCategory = "tunnel"
+
+// tunnelDetector blocks the requests of clients to a domain after they request
+// many long or random subdomains of it, such as those encoding data tunneled
+// through DNS
+type tunnelDetector struct {
+	// window is the time subdomains are counted over
+	window time.Duration
+
+	// subdomains is the number of unique suspicious subdomains of a domain
+	// requested within the window which trips the detector
+	subdomains int
+
+	// length is the length from which a subdomain is suspicious
+	length int
+
+	// entropy is the Shannon entropy in bits per character from which a
+	// subdomain is suspicious
+	entropy float64
+
+	// cooldown is how long a client's requests to a domain are blocked after
+	// the detector trips
+	cooldown time.Duration
+
+	// refuse answers blocked requests with REFUSED instead of the response to
+	// blocked domains
+	refuse bool
+
+	// audit logs and counts requests instead of blocking them
+	audit bool
+
+	// capacity is the number of clients and domains tracked. The least
+	// recently updated are forgotten first.
+	capacity int
+
+	lock sync.Mutex
+	// order holds *tunnelTracker, from the most recently updated
+	order    *list.List
+	trackers map[tunnelKey]*list.Element
+}
+
+// tunnelKey identifies the requests of a client to a domain
+type tunnelKey struct {
+	client string
+	domain string
+}
+
+type tunnelTracker struct {
+	key tunnelKey
+
+	// seen is when each suspicious subdomain was last requested within the
+	// window
+	seen map[string]time.Time
+
+	// blockedUntil is the end of the cooldown
+	blockedUntil time.Time
+}
+
+func parseTunnel(c *caddy.Controller, f *Filter) error {
+	if f.tunnel != nil {
+		return c.Err("tunnel is already configured")
+	}
+	d := &tunnelDetector{
+		window:     time.Minute,
+		subdomains: 30,
+		length:     40,
+		entropy:    3.5,
+		cooldown:   10 * time.Minute,
+		capacity:   10000,
+		order:      list.New(),
+		trackers:   make(map[tunnelKey]*list.Element),
+	}
+	err := parseBlock(c, func(c *caddy.Controller) error {
+		option := c.Val()
+		if !c.NextArg() {
+			return c.Errf("no value specified for tunnel option %q", option)
+		}
+		switch option {
+		case "window", "cooldown":
+			duration, err := time.ParseDuration(c.Val())
+			if err != nil || duration <= 0 {
+				return c.Errf("invalid tunnel %s %q; expected a positive duration", option, c.Val())
+			}
+			if option == "window" {
+				d.window = duration
+			} else {
+				d.cooldown = duration
+			}
+		case "subdomains", "length", "capacity":
+			count, err := strconv.Atoi(c.Val())
+			if err != nil || count < 1 {
+				return c.Errf("invalid tunnel %s %q; expected a positive integer", option, c.Val())
+			}
+			switch option {
+			case "subdomains":
+				d.subdomains = count
+			case "length":
+				d.length = count
+			case "capacity":
+				d.capacity = count
+			}
+		case "entropy":
+			entropy, err := strconv.ParseFloat(c.Val(), 64)
+			if err != nil || entropy <= 0 {
+				return c.Errf("invalid tunnel entropy %q; expected a positive number", c.Val())
+			}
+			d.entropy = entropy
+		case "response":
+			switch c.Val() {
+			case "block":
+				d.refuse = false
+			case "refuse":
+				d.refuse = true
+			default:
+				return c.Errf("invalid tunnel response %q; expected 'block' or 'refuse'", c.Val())
+			}
+		case "mode":
+			switch c.Val() {
+			case "audit":
+				d.audit = true
+			case "enforce":
+				d.audit = false
+			default:
+				return c.Errf("invalid tunnel mode %q; expected 'audit' or 'enforce'", c.Val())
+			}
+		default:
+			return c.Errf(
+				"unknown tunnel option %q; expected 'window', 'subdomains', 'length', "+
+					"'entropy', 'cooldown', 'response', 'mode', or 'capacity'",
+				option,
+			)
+		}
+		return ensureEOL(c)
+	})
+	if err != nil {
+		return err
+	}
+	f.tunnel = d
+	return nil
+}
+
+// suspicious reports whether a subdomain is long or random enough to carry
+// tunneled data
+func (d *tunnelDetector) suspicious(subdomain string) bool {
+	return d.length <= len(subdomain) ||
+		d.entropy <= shannonEntropy(strings.ReplaceAll(subdomain, ".", ""))
+}
+
+// match records a client's request and returns a match if the client's
+// requests to the request's registrable domain are blocked. The detector trips
+// when the client has requested enough unique suspicious subdomains of the
+// domain within the window, which the caller is told by tripped.
+func (d *tunnelDetector) match(qname string, client clientInfo, now time.Time) (match ruleMatch, matched, tripped bool) {
+	domain, ok := registrableDomain(qname)
+	if !ok || qname == domain {
+		return ruleMatch{}, false, false
+	}
+	subdomain := strings.TrimSuffix(qname, "."+domain)
+	key := tunnelKey{client: client.key(), domain: domain}
+	match = ruleMatch{
+		action:   ActionTypeBlock,
+		kind:     RuleSuffix,
+		value:    domain,
+		category: tunnelCategory,
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	elem, ok := d.trackers[key]
+	if ok {
+		d.order.MoveToFront(elem)
+	}
+	if ok && now.Before(elem.Value.(*tunnelTracker).blockedUntil) {
+		return match, true, false
+	}
+	if !d.suspicious(subdomain) {
+		return ruleMatch{}, false, false
+	}
+	if !ok {
+		elem = d.order.PushFront(&tunnelTracker{key: key, seen: make(map[string]time.Time)})
+		d.trackers[key] = elem
+		for d.capacity < d.order.Len() {
+			oldest := d.order.Back()
+			d.order.Remove(oldest)
+			delete(d.trackers, oldest.Value.(*tunnelTracker).key)
+		}
+	}
+
+	tracker := elem.Value.(*tunnelTracker)
+	for name, last := range tracker.seen {
+		if d.window <= now.Sub(last) {
+			delete(tracker.seen, name)
+		}
+	}
+	tracker.seen[subdomain] = now
+	if len(tracker.seen) < d.subdomains {
+		return ruleMatch{}, false, false
+	}
+	tracker.blockedUntil = now.Add(d.cooldown)
+	clear(tracker.seen)
+	return match, true, true
+}
@@ -0,0 +1,278 @@
+package filter
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newTestTunnelDetector(t *testing.T, options string) *tunnelDetector {
+	controller := caddy.NewTestController("dns", "filter {\ntunnel {\n"+options+"\n}\n}")
+	filter := newFilter()
+	if err := Parse(controller, filter); err != nil {
+		t.Fatal(err)
+	}
+	return filter.tunnel
+}
+
+func TestTunnelSuspicious(t *testing.T) {
+	d := newTestTunnelDetector(t, "length 40\nentropy 3.5")
+	tests := []struct {
+		subdomain string
+		want      bool
+	}{
+		{"www", false},
+		{"api.v2", false},
+		{"mail-eu-west-1", false},
+		{"nbswy3dpeb3w64tmmqqgm4tpnuqgc3tfnzzxa4tj", true},
+		{"k3x9qz7p1mv4b8t2", true},
+		{"aGVsbG8.d29ybGQ.Zm9v", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.subdomain, func(t *testing.T) {
+			if got := d.suspicious(tt.subdomain); got != tt.want {
+				t.Errorf("expected %t; got %t", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestTunnelDetector(t *testing.T) {
+	d := newTestTunnelDetector(t, "subdomains 3\nwindow 1m\ncooldown 10m")
+	tunneler := clientInfo{addr: netip.MustParseAddr("192.0.2.1")}
+	other := clientInfo{addr: netip.MustParseAddr("192.0.2.2")}
+	start := time.Unix(1700000000, 0)
+	exfil := func(i int) string {
+		return fmt.Sprintf("k3x9qz7p1mv4b8t%d.tunnel.example.com", i)
+	}
+
+	for i := range 2 {
+		if _, ok, _ := d.match(exfil(i), tunneler, start); ok {
+			t.Fatalf("expected request %d not to be blocked", i)
+		}
+	}
+	// Repeating a subdomain doesn't count it twice
+	if _, ok, _ := d.match(exfil(1), tunneler, start); ok {
+		t.Fatal("expected repeated subdomain not to trip the detector")
+	}
+	match, ok, tripped := d.match(exfil(2), tunneler, start.Add(time.Second))
+	if !ok || !tripped {
+		t.Fatal("expected third unique subdomain to trip the detector")
+	}
+	if match.value != "example.com" || match.category != tunnelCategory {
+		t.Errorf("expected match of example.com; got %s", match)
+	}
+
+	tests := []struct {
+		name   string
+		qname  string
+		client clientInfo
+		at     time.Time
+		want   bool
+	}{
+		{"cooldown", "www.example.com", tunneler, start.Add(5 * time.Minute), true},
+		{"other client", "www.example.com", other, start.Add(5 * time.Minute), false},
+		{"other domain", "www.example.net", tunneler, start.Add(5 * time.Minute), false},
+		{"after cooldown", "www.example.com", tunneler, start.Add(11 * time.Minute), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, ok, tripped := d.match(tt.qname, tt.client, tt.at); ok != tt.want || tripped {
+				t.Errorf("expected blocked %t; got %t, tripped %t", tt.want, ok, tripped)
+			}
+		})
+	}
+}
+
+func TestTunnelDetectorWindow(t *testing.T) {
+	d := newTestTunnelDetector(t, "subdomains 3\nwindow 1m")
+	client := clientInfo{addr: netip.MustParseAddr("192.0.2.1")}
+	start := time.Unix(1700000000, 0)
+	for i := range 6 {
+		qname := fmt.Sprintf("k3x9qz7p1mv4b8t%d.example.com", i)
+		if _, ok, _ := d.match(qname, client, start.Add(time.Duration(i)*40*time.Second)); ok {
+			t.Fatalf("expected subdomains outside the window not to be counted; blocked request %d", i)
+		}
+	}
+}
+
+func TestTunnelDetectorCapacity(t *testing.T) {
+	d := newTestTunnelDetector(t, "capacity 2")
+	client := clientInfo{addr: netip.MustParseAddr("192.0.2.1")}
+	now := time.Now()
+	for _, domain := range []string{"a.com", "b.com", "c.com"} {
+		d.match("k3x9qz7p1mv4b8t2."+domain, client, now)
+	}
+	if len(d.trackers) != 2 || d.order.Len() != 2 {
+		t.Fatalf("expected 2 trackers; got %d", len(d.trackers))
+	}
+	if _, ok := d.trackers[tunnelKey{client.key(), "a.com"}]; ok {
+		t.Error("expected least recently updated tracker to be evicted")
+	}
+	// Requests that aren't suspicious aren't tracked
+	d.match("www.d.com", client, now)
+	if _, ok := d.trackers[tunnelKey{client.key(), "d.com"}]; ok {
+		t.Error("expected request that isn't suspicious not to be tracked")
+	}
+}
+
+func TestTunnel(t *testing.T) {
+	filter := NewTestFilter(t, `filter {
+		tunnel {
+			subdomains 2
+			response refuse
+		}
+		allow wildcard allowed.example.org
+		block domain blocked.example.net
+		response nxdomain
+	}`)
+	filter.Build()
+	serve := func(qname string) *dns.Msg {
+		req := new(dns.Msg).SetQuestion(dns.Fqdn(qname), dns.TypeTXT)
+		req.SetEdns0(4096, false)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		filter.ServeDNS(context.Background(), rec, req)
+		return rec.Msg
+	}
+
+	before := testutil.ToFloat64(tunnelCount.WithLabelValues(""))
+	serve("k3x9qz7p1mv4b8t1.tunnel.example.com")
+	if msg := serve("k3x9qz7p1mv4b8t2.tunnel.example.com"); msg.Rcode != dns.RcodeRefused {
+		t.Errorf("expected REFUSED; got %s", dns.RcodeToString[msg.Rcode])
+	}
+	if msg := serve("www.example.com"); msg.Rcode != dns.RcodeRefused {
+		t.Errorf("expected REFUSED during cooldown; got %s", dns.RcodeToString[msg.Rcode])
+	}
+	if after := testutil.ToFloat64(tunnelCount.WithLabelValues("")); after-before != 1 {
+		t.Errorf("expected tunnel detections to increase by 1; got %v", after-before)
+	}
+
+	// Other blocked requests keep the response code they've been sent with
+	if msg := serve("blocked.example.net"); msg.Rcode != dns.RcodeSuccess {
+		t.Errorf("expected blocked domain to be answered with NOERROR; got %s", dns.RcodeToString[msg.Rcode])
+	}
+
+	serve("k3x9qz7p1mv4b8t1.allowed.example.org")
+	if msg := serve("k3x9qz7p1mv4b8t2.allowed.example.org"); msg.Rcode == dns.RcodeRefused {
+		t.Error("expected allowed domain not to be refused")
+	}
+}
+
+func TestSetupTunnel(t *testing.T) {
+	tests := []TestSetup{
+		{
+			"tunnel",
+			`filter {
+				tunnel
+			}`,
+			false,
+		},
+		{
+			"tunnel options",
+			`filter {
+				tunnel {
+					window 2m
+					subdomains 50
+					length 60
+					entropy 3.8
+					cooldown 1h
+					response refuse
+					mode audit
+					capacity 5000
+				}
+			}`,
+			false,
+		},
+		{
+			"tunnel duplicate",
+			`filter {
+				tunnel
+				tunnel
+			}`,
+			true,
+		},
+		{
+			"tunnel invalid window",
+			`filter {
+				tunnel {
+					window 0s
+				}
+			}`,
+			true,
+		},
+		{
+			"tunnel invalid subdomains",
+			`filter {
+				tunnel {
+					subdomains -1
+				}
+			}`,
+			true,
+		},
+		{
+			"tunnel invalid entropy",
+			`filter {
+				tunnel {
+					entropy noop
+				}
+			}`,
+			true,
+		},
+		{
+			"tunnel invalid response",
+			`filter {
+				tunnel {
+					response nxdomain
+				}
+			}`,
+			true,
+		},
+		{
+			"tunnel invalid mode",
+			`filter {
+				tunnel {
+					mode noop
+				}
+			}`,
+			true,
+		},
+		{
+			"tunnel no value",
+			`filter {
+				tunnel {
+					cooldown
+				}
+			}`,
+			true,
+		},
+		{
+			"tunnel unknown option",
+			`filter {
+				tunnel {
+					noop 1
+				}
+			}`,
+			true,
+		},
+		{
+			"tunnel reserved category",
+			`filter {
+				category tunnel {
+					domain example.com
+				}
+			}`,
+			true,
+		},
+	}
+	for _, test := range tests {
+		RunSetupTest(t, test)
+	}
+}
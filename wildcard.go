@@ -1,8 +1,6 @@
 package filter
 
 import (
-	"bufio"
-	"bytes"
 	"errors"
 	"fmt"
 	"strings"
@@ -23,31 +21,18 @@ func parseActionWildcard(c *caddy.Controller, f *Filter, a ActionType) error {
 		if err := f.blockConfig.AddWildcard(c.Val()); err != nil {
 			return err
 		}
-	}
-	return ensureEOL(c)
-}
-
-func parseActionListWildcard(c *caddy.Controller, f *Filter, a ActionType) error {
-	if !c.NextArg() {
-		return c.Errf("no %s wildcard list specified", a)
-	}
-	switch a {
-	case ActionTypeAllow:
-		if err := f.allowConfig.AddWildcardList(c.Val()); err != nil {
-			return err
-		}
-	case ActionTypeBlock:
-		if err := f.blockConfig.AddWildcardList(c.Val()); err != nil {
+	case ActionTypeDeny:
+		if err := f.denyConfig.AddWildcard(c.Val()); err != nil {
 			return err
 		}
 	}
-	return ensureEOL(c)
+	return parseRulePriority(c, f, a, RuleSuffix, ActionConfig{}.cleanWildcardListLine(c.Val()))
 }
 
 // AddWildcard to match
 func (a ActionConfig) AddWildcard(wildcard string) error {
 	wc := a.cleanWildcardListLine(wildcard)
-	if !DNSNameRegexp.MatchString(wc) {
+	if !validName(wc) {
 		errString := fmt.Sprintf(
 			"wildcard %q is invalid",
 			wildcard,
@@ -60,56 +45,18 @@ func (a ActionConfig) AddWildcard(wildcard string) error {
 	return nil
 }
 
-// AddWildcardList to match contents
-func (a ActionConfig) AddWildcardList(url string) error {
-	if _, ok := a.wildcardLists[url]; !ok {
-		loadFunc, err := a.GetListLoader(url)
-		if err != nil {
-			return err
-		}
-		a.wildcardLists[url] = loadFunc
-	}
-	return nil
+func init() {
+	RegisterListParser("wildcard", ListParserFunc(parseWildcardLine))
 }
 
-func (a ActionConfig) BuildWildcards(wildcards map[string]bool) {
-	for wildcard := range a.wildcards {
-		wildcards[wildcard] = true
-	}
-
-	for domain, loader := range a.wildcardLists {
-		file, err := loader.Load(domain)
-		if err != nil {
-			log.Errorf(
-				"there was a problem fetching %s wildcard list %q; %s",
-				a.configType,
-				domain,
-				err,
-			)
-			continue
-		}
-		defer file.Close()
-		scanner := bufio.NewScanner(file)
-		scanner.Split(bufio.ScanLines)
-		for scanner.Scan() {
-			line := scanner.Bytes()
-			line = bytes.TrimSpace(line)
-			if a.shouldSkip(line) {
-				continue
-			}
-			clean := a.cleanWildcardListLine(string(line))
-			if !DNSNameRegexp.MatchString(clean) {
-				log.Debugf(
-					"wildcard %q is invalid",
-					clean,
-				)
-				continue
-			}
-			if _, ok := wildcards[clean]; !ok {
-				wildcards[clean] = true
-			}
-		}
+// parseWildcardLine parses a line of a list of wildcards in any of the formats
+// accepted by cleanWildcardListLine
+func parseWildcardLine(line []byte) ([]Rule, error) {
+	clean := ActionConfig{}.cleanWildcardListLine(string(line))
+	if !validName(clean) {
+		return nil, fmt.Errorf("wildcard %q is invalid", clean)
 	}
+	return []Rule{{Kind: RuleSuffix, Value: clean}}, nil
 }
 
 func (ActionConfig) cleanWildcardListLine(line string) string {